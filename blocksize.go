@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// blockSizeUnits are the multipliers of the --block-size suffixes
+const blockSizeUnits = "KMGTPE"
+
+// parseBlockSize parses a --block-size SIZE: an optional count followed by
+// an optional suffix. K, M, G and so on are powers of 1024, as are KiB and
+// MiB; KB and MB are powers of 1000.
+func parseBlockSize(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	digits := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(s)
+	}
+
+	count := int64(1)
+	if digits > 0 {
+		n, err := strconv.ParseInt(s[:digits], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		count = n
+	}
+
+	suffix := s[digits:]
+	if suffix == "" {
+		return count, count > 0
+	}
+
+	unit := strings.IndexByte(blockSizeUnits, strings.ToUpper(suffix[:1])[0])
+	if unit < 0 {
+		return 0, false
+	}
+	base := int64(1024)
+	switch suffix[1:] {
+	case "", "iB":
+	case "B":
+		base = 1000
+	default:
+		return 0, false
+	}
+
+	size := count
+	for range unit + 1 {
+		if size > (1<<62)/base {
+			return 0, false
+		}
+		size *= base
+	}
+	return size, size > 0
+}
+
+// envBlockSize returns the block size set by BLOCK_SIZE or BLOCKSIZE, or 0
+// when neither holds a valid size
+func envBlockSize() int64 {
+	for _, name := range []string{"BLOCK_SIZE", "BLOCKSIZE"} {
+		if value := os.Getenv(name); value != "" {
+			if size, ok := parseBlockSize(value); ok {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+// scaleBlocks converts a count of BLOCKSIZE-byte blocks into the unit
+// chosen by --block-size, -k or the environment, rounding up
+func scaleBlocks(blocks int64) int64 {
+	unit := int64(BLOCKSIZE)
+	switch {
+	case opts.BlockSize > 0:
+		unit = opts.BlockSize
+	case opts.Kilobytes:
+		unit = 1024
+	}
+	if blocks <= 0 || unit == BLOCKSIZE {
+		return blocks
+	}
+	return (blocks*BLOCKSIZE + unit - 1) / unit
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseBlockSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"1024", 1024, true},
+		{"K", 1024, true},
+		{"1K", 1024, true},
+		{"4k", 4096, true},
+		{"M", 1 << 20, true},
+		{"2MiB", 2 << 20, true},
+		{"G", 1 << 30, true},
+		{"KB", 1000, true},
+		{"MB", 1000000, true},
+		{"E", 1 << 60, true},
+		{"0", 0, false},
+		{"0K", 0, false},
+		{"", 0, false},
+		{"X", 0, false},
+		{"1Kb", 0, false},
+		{"1KiBs", 0, false},
+		{"-1", 0, false},
+		{"16E", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseBlockSize(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseBlockSize(%q) = %d, %v, want %d, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBlockSizeListing(t *testing.T) {
+	// 3000 bytes take six 512-byte blocks, 3072 bytes
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/f", strings.Repeat("x", 3000)))
+	tests := []struct {
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{nil, nil, "     6 f\n"},
+		{nil, []string{"-k"}, "     3 f\n"},
+		{nil, []string{"--block-size=1K"}, "     3 f\n"},
+		{nil, []string{"--block-size=M"}, "     1 f\n"},
+		{nil, []string{"--block-size=1000"}, "     4 f\n"},
+		{nil, []string{"--block-size=KB"}, "     4 f\n"},
+		{nil, []string{"--block-size=1", "-k"}, "  3072 f\n"},
+		{map[string]string{"BLOCK_SIZE": "1K"}, nil, "     3 f\n"},
+		{map[string]string{"BLOCKSIZE": "1024"}, nil, "     3 f\n"},
+		{map[string]string{"BLOCK_SIZE": "1K", "BLOCKSIZE": "1"}, nil, "     3 f\n"},
+		// An invalid BLOCK_SIZE falls through to BLOCKSIZE
+		{map[string]string{"BLOCK_SIZE": "huge", "BLOCKSIZE": "1"}, nil, "  3072 f\n"},
+		{map[string]string{"BLOCK_SIZE": "1K"}, []string{"--block-size=1"}, "  3072 f\n"},
+		{map[string]string{"BLOCK_SIZE": "1"}, []string{"-k"}, "     3 f\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-s1"}, tt.args...)
+		args = append(args, "/d")
+		if got := runLsEnv(t, tt.env, fake, args...); got != tt.want {
+			t.Errorf("%v ls %v = %q, want %q", tt.env, args, got, tt.want)
+		}
+	}
+
+	// The long format total is in the same unit
+	if got := runLs(t, fake, "-ls", "--block-size=1K", "/d"); !strings.HasPrefix(got, "total 3\n3 ") {
+		t.Errorf("ls -ls --block-size=1K /d = %q, want a total and a count of 3", got)
+	}
+
+	for _, value := range []string{"", "0", "1X", "-4"} {
+		status, stderr := lsStatus(t, "-s", "--block-size="+value, os.DevNull)
+		want := "ls: invalid argument '" + value + "' for '--block-size'\n"
+		if status != 2 || stderr != want {
+			t.Errorf("ls --block-size=%s exited %d with %q, want 2 with %q", value, status, stderr, want)
+		}
+	}
+}
+
+func TestTotalMatchesRows(t *testing.T) {
+	// Small files each round up to a whole block of the larger units, so
+	// the total only agrees with the rows when it is summed from them
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", "x"),
+		fakeReg("/d/b", "x"),
+		fakeReg("/d/c", strings.Repeat("x", 600)),
+		fakeReg("/d/d", strings.Repeat("x", 5000)),
+	)
+	tests := []struct {
+		args  []string
+		total int
+	}{
+		{nil, 14},
+		{[]string{"-k"}, 8},
+		{[]string{"--block-size=1K"}, 8},
+		{[]string{"--block-size=4K"}, 5},
+		{[]string{"--block-size=M"}, 4},
+		{[]string{"--block-size=1"}, 7168},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-lsn"}, tt.args...)
+		args = append(args, "/d")
+		lines := strings.Split(strings.TrimSuffix(runLs(t, fake, args...), "\n"), "\n")
+
+		var total, sum int
+		if _, err := fmt.Sscanf(lines[0], "total %d", &total); err != nil {
+			t.Fatalf("ls %v: first line %q: %v", args, lines[0], err)
+		}
+		for _, line := range lines[1:] {
+			var blocks int
+			if _, err := fmt.Sscan(line, &blocks); err != nil {
+				t.Fatalf("ls %v: row %q: %v", args, line, err)
+			}
+			sum += blocks
+		}
+		if total != tt.total || sum != tt.total {
+			t.Errorf("ls %v: total %d, rows sum to %d, want both %d", args, total, sum, tt.total)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// colorDepth is the number of colors the terminal can display
+type colorDepth int
+
+const (
+	colorDepthAuto colorDepth = iota // detect from the environment
+	colorDepth16
+	colorDepth256
+	colorDepthTrue
+)
+
+// parseColorDepth parses a --color-depth argument
+func parseColorDepth(value string) (colorDepth, bool) {
+	switch value {
+	case "16":
+		return colorDepth16, true
+	case "256":
+		return colorDepth256, true
+	case "truecolor", "24bit":
+		return colorDepthTrue, true
+	}
+	return 0, false
+}
+
+// detectColorDepth guesses the terminal's palette from $COLORTERM and $TERM
+func detectColorDepth() colorDepth {
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return colorDepthTrue
+	}
+	if strings.Contains(os.Getenv("TERM"), "256color") {
+		return colorDepth256
+	}
+	return colorDepth16
+}
+
+// rgb is a 24-bit color, downsampled to the terminal's palette on output
+type rgb struct {
+	r, g, b uint8
+}
+
+// gradient returns the color a fraction t (0 to 1) of the way from one color
+// to another
+func gradient(from, to rgb, t float64) rgb {
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	return rgb{mix(from.r, to.r), mix(from.g, to.g), mix(from.b, to.b)}
+}
+
+// escape returns the escape sequence setting c as the foreground color,
+// using the closest color the given depth can show
+func (c rgb) escape(depth colorDepth) string {
+	switch depth {
+	case colorDepthTrue:
+		return fmt.Sprintf("\033[38;2;%d;%d;%dm", c.r, c.g, c.b)
+	case colorDepth256:
+		return fmt.Sprintf("\033[38;5;%dm", c.cubeIndex())
+	default:
+		return fmt.Sprintf("\033[%dm", c.basicCode())
+	}
+}
+
+// cubeIndex maps c onto the 6x6x6 color cube of 256-color terminals
+func (c rgb) cubeIndex() int {
+	level := func(v uint8) int {
+		return (int(v)*5 + 127) / 255
+	}
+	return 16 + 36*level(c.r) + 6*level(c.g) + level(c.b)
+}
+
+// basicPalette approximates the 16 standard terminal colors, in SGR order
+var basicPalette = [16]rgb{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// basicCode returns the SGR foreground code of the nearest standard color
+func (c rgb) basicCode() int {
+	best, bestDist := 0, -1
+	for i, p := range basicPalette {
+		dr := int(c.r) - int(p.r)
+		dg := int(c.g) - int(p.g)
+		db := int(c.b) - int(p.b)
+		dist := dr*dr + dg*dg + db*db
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	if best < 8 {
+		return 30 + best
+	}
+	return 90 + best - 8
+}
+
+// Ends of the --time-color scale: files changed within timeColorNewest are
+// drawn in the bright color, those older than timeColorOldest in the dim one
+var (
+	timeColorBright = rgb{255, 215, 95}
+	timeColorDim    = rgb{88, 88, 88}
+)
+
+const (
+	timeColorNewest = time.Minute
+	timeColorOldest = 365 * 24 * time.Hour
+)
+
+// timeColor returns the color for a timestamp of the given age. Ages are
+// placed on a logarithmic scale so that minutes, days and months each get
+// a visibly different shade.
+func timeColor(age time.Duration) rgb {
+	if age <= timeColorNewest {
+		return timeColorBright
+	}
+	t := math.Log(float64(age)/float64(timeColorNewest)) /
+		math.Log(float64(timeColorOldest)/float64(timeColorNewest))
+	return gradient(timeColorBright, timeColorDim, t)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseColorDepth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  colorDepth
+		ok    bool
+	}{
+		{"16", colorDepth16, true},
+		{"256", colorDepth256, true},
+		{"truecolor", colorDepthTrue, true},
+		{"24bit", colorDepthTrue, true},
+		{"8", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseColorDepth(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseColorDepth(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDetectColorDepth(t *testing.T) {
+	tests := []struct {
+		colorterm string
+		term      string
+		want      colorDepth
+	}{
+		{"truecolor", "xterm", colorDepthTrue},
+		{"24BIT", "", colorDepthTrue},
+		{"", "xterm-256color", colorDepth256},
+		{"yes", "screen-256color", colorDepth256},
+		{"", "xterm", colorDepth16},
+		{"", "", colorDepth16},
+	}
+	for _, tt := range tests {
+		t.Setenv("COLORTERM", tt.colorterm)
+		t.Setenv("TERM", tt.term)
+		if got := detectColorDepth(); got != tt.want {
+			t.Errorf("COLORTERM=%q TERM=%q: detectColorDepth() = %v, want %v", tt.colorterm, tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestGradient(t *testing.T) {
+	black, white := rgb{0, 0, 0}, rgb{255, 255, 255}
+	tests := []struct {
+		t    float64
+		want rgb
+	}{
+		{0, black},
+		{1, white},
+		{0.5, rgb{128, 128, 128}},
+		{-1, black},
+		{2, white},
+	}
+	for _, tt := range tests {
+		if got := gradient(black, white, tt.t); got != tt.want {
+			t.Errorf("gradient(black, white, %v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestColorEscape(t *testing.T) {
+	tests := []struct {
+		c     rgb
+		depth colorDepth
+		want  string
+	}{
+		{rgb{255, 215, 95}, colorDepthTrue, "\033[38;2;255;215;95m"},
+		{rgb{255, 215, 95}, colorDepth256, "\033[38;5;222m"},
+		{rgb{0, 0, 0}, colorDepth256, "\033[38;5;16m"},
+		{rgb{255, 255, 255}, colorDepth256, "\033[38;5;231m"},
+		{rgb{0, 0, 0}, colorDepth16, "\033[30m"},
+		{rgb{200, 10, 10}, colorDepth16, "\033[31m"},
+		{rgb{250, 250, 250}, colorDepth16, "\033[97m"},
+		{rgb{88, 88, 88}, colorDepth16, "\033[90m"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.escape(tt.depth); got != tt.want {
+			t.Errorf("%v.escape(%v) = %q, want %q", tt.c, tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestTimeColor(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want rgb
+	}{
+		{-time.Hour, timeColorBright},
+		{0, timeColorBright},
+		{timeColorNewest, timeColorBright},
+		{timeColorOldest, timeColorDim},
+		{10 * timeColorOldest, timeColorDim},
+	}
+	for _, tt := range tests {
+		if got := timeColor(tt.age); got != tt.want {
+			t.Errorf("timeColor(%v) = %v, want %v", tt.age, got, tt.want)
+		}
+	}
+
+	// Older files are never brighter than newer ones, and the scale
+	// separates minutes, days and months
+	ages := []time.Duration{
+		time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour,
+		7 * 24 * time.Hour, 30 * 24 * time.Hour, 180 * 24 * time.Hour, timeColorOldest,
+	}
+	for i := 1; i < len(ages); i++ {
+		newer, older := timeColor(ages[i-1]), timeColor(ages[i])
+		if older.r >= newer.r || older.g >= newer.g {
+			t.Errorf("timeColor(%v) = %v is not dimmer than timeColor(%v) = %v", ages[i], older, ages[i-1], newer)
+		}
+	}
+}
+
+func TestTimeColorListing(t *testing.T) {
+	now := time.Now()
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/new", mode: syscall.S_IFREG | 0644, mtime: now},
+		&fakeFile{path: "/d/old", mode: syscall.S_IFREG | 0644, mtime: now.AddDate(-2, 0, 0)},
+	)
+
+	tests := []struct {
+		args []string
+		new  string
+		old  string
+	}{
+		{[]string{"-ln", "--time-color", "--color-depth=16", "/d"}, "\033[93m", "\033[90m"},
+		{[]string{"-ln", "--time-color", "--color-depth=truecolor", "/d"}, "\033[38;2;255;215;95m", "\033[38;2;88;88;88m"},
+		{[]string{"-ln", "/d"}, "", ""},
+	}
+	for _, tt := range tests {
+		got := runLs(t, fake, tt.args...)
+		lines := strings.Split(got, "\n")
+		if len(lines) != 4 {
+			t.Fatalf("ls %v = %q", tt.args, got)
+		}
+		for i, escape := range []string{tt.new, tt.old} {
+			line := lines[i+1]
+			if escape == "" && strings.Contains(line, colorReset) || !strings.Contains(line, escape) {
+				t.Errorf("ls %v printed %q, want time escape %q", tt.args, line, escape)
+			}
+		}
+	}
+}
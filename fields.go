@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// displayFields writes one line per file for --format=fields: the name,
+// size in bytes, mode and modification time, joined by --separator
+func displayFields(w io.Writer, files []FileInfo) {
+	for _, file := range files {
+		fields := []string{
+			escapeField(file.Name),
+			strconv.FormatInt(file.Size, 10),
+			formatMode(file.Mode, file.IsSymlink),
+			file.ModTime.Format(time.RFC3339),
+		}
+		fmt.Fprintln(w, strings.Join(fields, opts.Separator))
+	}
+}
+
+// escapeField keeps a name from splitting its line: backslashes are
+// doubled, and the separator and newlines become \xHH escapes. It makes a
+// single pass so that a separator containing a backslash is escaped once.
+func escapeField(name string) string {
+	hex := func(b *strings.Builder, s string) {
+		for i := 0; i < len(s); i++ {
+			fmt.Fprintf(b, "\\x%02x", s[i])
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if opts.Separator != "" && strings.HasPrefix(name[i:], opts.Separator) {
+			hex(&b, opts.Separator)
+			i += len(opts.Separator) - 1
+			continue
+		}
+		switch name[i] {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			hex(&b, "\n")
+		default:
+			b.WriteByte(name[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEscapeField(t *testing.T) {
+	tests := []struct {
+		separator string
+		name      string
+		want      string
+	}{
+		{"\t", "plain.txt", "plain.txt"},
+		{"\t", "tab\there", `tab\x09here`},
+		{"\t", "line\nbreak", `line\x0abreak`},
+		{"\t", `back\slash`, `back\\slash`},
+		{",", "a,b\tc", `a\x2cb` + "\tc"},
+		{"::", "a::b:c", `a\x3a\x3ab:c`},
+		{`\`, `a\b`, `a\x5cb`},
+		{`\t`, `a\tb\c`, `a\x5c\x74b\\c`},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Separator: tt.separator})
+		if got := escapeField(tt.name); got != tt.want {
+			t.Errorf("escapeField(%q) with separator %q = %q, want %q", tt.name, tt.separator, got, tt.want)
+		}
+	}
+}
+
+func TestFieldsFormat(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/notes.txt", mode: syscall.S_IFREG | 0644, content: "hello", mtime: stamp},
+		&fakeFile{path: "/d/odd\tname", mode: syscall.S_IFREG | 0755, mtime: stamp},
+		&fakeFile{path: "/d/sub", mode: syscall.S_IFDIR | 0700, mtime: stamp},
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"--format=fields", "/d"},
+			"notes.txt\t5\t-rw-r--r--\t2020-01-02T03:04:05Z\n" +
+				"odd\\x09name\t0\t-rwxr-xr-x\t2020-01-02T03:04:05Z\n" +
+				"sub\t0\tdrwx------\t2020-01-02T03:04:05Z\n",
+		},
+		{
+			[]string{"--format=fields", "--separator=|", "/d"},
+			"notes.txt|5|-rw-r--r--|2020-01-02T03:04:05Z\n" +
+				"odd\tname|0|-rwxr-xr-x|2020-01-02T03:04:05Z\n" +
+				"sub|0|drwx------|2020-01-02T03:04:05Z\n",
+		},
+		{
+			[]string{"--format=fields", "--separator", ", ", "/d/notes.txt"},
+			"/d/notes.txt, 5, -rw-r--r--, 2020-01-02T03:04:05Z\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %q =\n%q\nwant\n%q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// fileSystem is the filesystem the listing reads. Stat results, directory
+// entries, link targets, --head previews and extended attributes all come
+// through fsys, so a fake can stand in for the real one. The extras that
+// need a kernel interface of their own (statx birth times, inode
+// generations, the overlayfs whiteout check) and --print-realpath's path
+// resolution still go to the OS directly.
+type fileSystem interface {
+	Lstat(path string, stat *syscall.Stat_t) error
+	Stat(path string, stat *syscall.Stat_t) error
+	OpenDir(path string) (dirReader, error)
+	Open(path string) (io.ReadCloser, error)
+	Readlink(path string) (string, error)
+	Listxattr(path string) ([]string, error)
+	Getxattr(path, name string) ([]byte, error)
+}
+
+// dirReader reads the entries of an open directory in batches, as
+// *os.File does
+type dirReader interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+	Close() error
+}
+
+// osFileSystem is the fileSystem of the running system
+type osFileSystem struct{}
+
+func (osFileSystem) Lstat(path string, stat *syscall.Stat_t) error {
+	return syscall.Lstat(path, stat)
+}
+
+func (osFileSystem) Stat(path string, stat *syscall.Stat_t) error {
+	return syscall.Stat(path, stat)
+}
+
+func (osFileSystem) OpenDir(path string) (dirReader, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, bareError(err)
+	}
+	return osDir{f}, nil
+}
+
+// osDir is a directory of the running system. Its errors, like those of
+// Lstat and Stat, carry no path, since ls reports the path itself.
+type osDir struct {
+	*os.File
+}
+
+func (d osDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.ReadDir(n)
+	return entries, bareError(err)
+}
+
+// bareError strips the operation and path that the os package wraps
+// around a system call error
+func bareError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+func (osFileSystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (osFileSystem) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (osFileSystem) Listxattr(path string) ([]string, error) {
+	return listXattrs(path)
+}
+
+func (osFileSystem) Getxattr(path, name string) ([]byte, error) {
+	return getXattr(path, name)
+}
+
+// fsys is the filesystem being listed
+var fsys fileSystem = osFileSystem{}
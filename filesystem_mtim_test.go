@@ -0,0 +1,14 @@
+//go:build linux || openbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// setStatTimes sets every time of stat to t
+func setStatTimes(stat *syscall.Stat_t, t time.Time) {
+	ts := syscall.NsecToTimespec(t.UnixNano())
+	stat.Mtim, stat.Atim, stat.Ctim = ts, ts, ts
+}
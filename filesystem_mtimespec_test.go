@@ -0,0 +1,14 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// setStatTimes sets every time of stat to t
+func setStatTimes(stat *syscall.Stat_t, t time.Time) {
+	ts := syscall.NsecToTimespec(t.UnixNano())
+	stat.Mtimespec, stat.Atimespec, stat.Ctimespec = ts, ts, ts
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeFS is an in-memory fileSystem. A directory lists the files directly
+// beneath it in the order they were given to newFakeFS, which stands in for
+// the order the kernel returns entries in.
+type fakeFS struct {
+	mu     sync.Mutex
+	files  []*fakeFile
+	byPath map[string]*fakeFile
+
+	// lstatFailures counts the EIO errors Lstat returns for a path before
+	// it succeeds, and lstatCalls how often Lstat was asked about it
+	lstatFailures map[string]int
+	lstatCalls    map[string]int
+
+	// lstatDelays holds paths whose Lstat hangs for a while, as on a stuck
+	// mount
+	lstatDelays map[string]time.Duration
+
+	// dirOpens counts how often each directory was opened
+	dirOpens map[string]int
+}
+
+// fakeFile is one file of a fakeFS
+type fakeFile struct {
+	path    string
+	mode    uint32 // st_mode, including the file type bits
+	ino     uint64
+	nlink   uint64
+	uid     uint32
+	gid     uint32
+	mtime   time.Time
+	content string
+	target  string // symlink target
+	xattrs  map[string]string
+
+	// infoPanic, when set, is what the fs.FileInfo of a directory entry
+	// panics with, standing in for metadata the code cannot handle
+	infoPanic any
+}
+
+func (f *fakeFile) size() int64 {
+	if f.mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return int64(len(f.target))
+	}
+	return int64(len(f.content))
+}
+
+// newFakeFS builds a fakeFS from files, filling in inode numbers and link
+// counts that were left zero
+func newFakeFS(files ...*fakeFile) *fakeFS {
+	fake := &fakeFS{
+		byPath:        make(map[string]*fakeFile),
+		lstatFailures: make(map[string]int),
+		lstatCalls:    make(map[string]int),
+		lstatDelays:   make(map[string]time.Duration),
+		dirOpens:      make(map[string]int),
+	}
+	for i, f := range files {
+		if f.ino == 0 {
+			f.ino = uint64(i + 2)
+		}
+		if f.nlink == 0 {
+			f.nlink = 1
+		}
+		fake.files = append(fake.files, f)
+		fake.byPath[f.path] = f
+	}
+	return fake
+}
+
+// fakeDir, fakeReg and fakeLink describe the common kinds of fake files
+func fakeDir(path string) *fakeFile {
+	return &fakeFile{path: path, mode: syscall.S_IFDIR | 0755}
+}
+
+func fakeReg(path, content string) *fakeFile {
+	return &fakeFile{path: path, mode: syscall.S_IFREG | 0644, content: content}
+}
+
+func fakeLink(path, target string) *fakeFile {
+	return &fakeFile{path: path, mode: syscall.S_IFLNK | 0777, target: target}
+}
+
+// useFS makes fake the filesystem being listed until the test ends
+func useFS(t *testing.T, fake fileSystem) {
+	saved := fsys
+	fsys = fake
+	t.Cleanup(func() { fsys = saved })
+}
+
+// lookup finds the file at p, resolving symlinks in the directories
+// leading up to it but not in p itself, as lstat does
+func (fake *fakeFS) lookup(p string) (*fakeFile, error) {
+	p = path.Clean(p)
+	if f, ok := fake.byPath[p]; ok {
+		return f, nil
+	}
+	dir, base := path.Split(p)
+	dir = path.Clean(dir)
+	if dir == p || dir == "." {
+		return nil, syscall.ENOENT
+	}
+	d, err := fake.follow(dir)
+	if err != nil || d.path == dir {
+		return nil, syscall.ENOENT
+	}
+	return fake.lookup(path.Join(d.path, base))
+}
+
+// follow finds the file at p, resolving symlinks all the way, as stat does
+func (fake *fakeFS) follow(p string) (*fakeFile, error) {
+	for range 40 {
+		f, err := fake.lookup(p)
+		if err != nil {
+			return nil, err
+		}
+		if f.mode&syscall.S_IFMT != syscall.S_IFLNK {
+			return f, nil
+		}
+		if path.IsAbs(f.target) {
+			p = f.target
+		} else {
+			p = path.Join(path.Dir(f.path), f.target)
+		}
+	}
+	return nil, syscall.ELOOP
+}
+
+func (fake *fakeFS) Lstat(p string, stat *syscall.Stat_t) error {
+	fake.mu.Lock()
+	delay := fake.lstatDelays[p]
+	fake.mu.Unlock()
+	time.Sleep(delay)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.lstatCalls[p]++
+	if fake.lstatFailures[p] > 0 {
+		fake.lstatFailures[p]--
+		return syscall.EIO
+	}
+	f, err := fake.lookup(p)
+	if err != nil {
+		return err
+	}
+	fillStat(stat, f)
+	return nil
+}
+
+func (fake *fakeFS) Stat(p string, stat *syscall.Stat_t) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	f, err := fake.follow(p)
+	if err != nil {
+		return err
+	}
+	fillStat(stat, f)
+	return nil
+}
+
+func (fake *fakeFS) OpenDir(p string) (dirReader, error) {
+	fake.mu.Lock()
+	fake.dirOpens[p]++
+	fake.mu.Unlock()
+
+	f, err := fake.follow(p)
+	if err != nil {
+		return nil, err
+	}
+	if f.mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, syscall.ENOTDIR
+	}
+	// A directory nobody may read stands in for one the user cannot
+	if f.mode&0444 == 0 {
+		return nil, syscall.EACCES
+	}
+
+	dir := &fakeDirReader{}
+	for _, child := range fake.files {
+		if child.path != f.path && path.Dir(child.path) == f.path {
+			dir.entries = append(dir.entries, fakeDirEntry{fake, child})
+		}
+	}
+	return dir, nil
+}
+
+func (fake *fakeFS) Open(p string) (io.ReadCloser, error) {
+	f, err := fake.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(f.content)), nil
+}
+
+func (fake *fakeFS) Readlink(p string) (string, error) {
+	f, err := fake.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	if f.mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", syscall.EINVAL
+	}
+	return f.target, nil
+}
+
+func (fake *fakeFS) Listxattr(p string) ([]string, error) {
+	f, err := fake.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range f.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fake *fakeFS) Getxattr(p, name string) ([]byte, error) {
+	f, err := fake.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := f.xattrs[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return []byte(value), nil
+}
+
+// fakeDirReader hands out a fake directory's entries in batches
+type fakeDirReader struct {
+	entries []fs.DirEntry
+}
+
+func (d *fakeDirReader) ReadDir(n int) ([]fs.DirEntry, error) {
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	batch := d.entries[:n]
+	d.entries = d.entries[n:]
+	return batch, nil
+}
+
+func (d *fakeDirReader) Close() error {
+	return nil
+}
+
+// fakeDirEntry is a directory entry of a fakeFS
+type fakeDirEntry struct {
+	fake *fakeFS
+	file *fakeFile
+}
+
+func (e fakeDirEntry) Name() string      { return path.Base(e.file.path) }
+func (e fakeDirEntry) IsDir() bool       { return e.file.mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (e fakeDirEntry) Type() fs.FileMode { return fileModeFromStat(e.file.mode).Type() }
+
+func (e fakeDirEntry) Info() (fs.FileInfo, error) {
+	var stat syscall.Stat_t
+	if err := e.fake.Lstat(e.file.path, &stat); err != nil {
+		return nil, err
+	}
+	return fakeFileInfo{e.file}, nil
+}
+
+// fakeFileInfo is the fs.FileInfo of a fake file
+type fakeFileInfo struct {
+	file *fakeFile
+}
+
+func (i fakeFileInfo) Name() string       { return path.Base(i.file.path) }
+func (i fakeFileInfo) Size() int64        { return i.file.size() }
+func (i fakeFileInfo) ModTime() time.Time { return i.file.mtime }
+func (i fakeFileInfo) IsDir() bool        { return i.file.mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (i fakeFileInfo) Sys() any           { return nil }
+
+func (i fakeFileInfo) Mode() fs.FileMode {
+	if i.file.infoPanic != nil {
+		panic(i.file.infoPanic)
+	}
+	return fileModeFromStat(i.file.mode)
+}
+
+// fillStat fills stat in from f. The field types vary between platforms,
+// hence setUint; the time fields, whose names vary too, are set by
+// setStatTimes.
+func fillStat(stat *syscall.Stat_t, f *fakeFile) {
+	*stat = syscall.Stat_t{}
+	setUint(&stat.Mode, uint64(f.mode))
+	setUint(&stat.Ino, f.ino)
+	setUint(&stat.Nlink, f.nlink)
+	stat.Uid, stat.Gid = f.uid, f.gid
+	stat.Size = f.size()
+	stat.Blocks = (f.size() + 511) / 512
+	setStatTimes(stat, f.mtime)
+}
+
+func setUint[T ~uint16 | ~uint32 | ~uint64](field *T, value uint64) {
+	*field = T(value)
+}
+
+func TestReadDirFast(t *testing.T) {
+	setOptions(t, Options{})
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	useFS(t, newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/notes.txt", mode: syscall.S_IFREG | 0600, content: "hello", mtime: mtime},
+		fakeDir("/d/sub"),
+		fakeLink("/d/link", "notes.txt"),
+		&fakeFile{path: "/d/shared", mode: syscall.S_IFREG | 0644, nlink: 3},
+	))
+
+	entries, err := readDirFast("/d")
+	if err != nil {
+		t.Fatalf("readDirFast: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		mode      fs.FileMode
+		size      int64
+		links     uint64
+		isDir     bool
+		isSymlink bool
+		target    string
+		mtime     time.Time
+	}{
+		{name: "notes.txt", mode: 0600, size: 5, links: 1, mtime: mtime},
+		{name: "sub", mode: fs.ModeDir | 0755, links: 1, isDir: true},
+		{name: "link", mode: fs.ModeSymlink | 0777, size: 9, links: 1, isSymlink: true, target: "notes.txt"},
+		{name: "shared", mode: 0644, links: 3},
+	}
+	if len(entries) != len(tests) {
+		t.Fatalf("readDirFast returned %d entries, want %d", len(entries), len(tests))
+	}
+	for i, tt := range tests {
+		got := entries[i]
+		if got.Name != tt.name || got.Mode != tt.mode || got.Size != tt.size ||
+			got.Links != tt.links || got.IsDir != tt.isDir ||
+			got.IsSymlink != tt.isSymlink || got.LinkTarget != tt.target ||
+			!got.ModTime.Equal(tt.mtime) {
+			t.Errorf("entry %d = {%q %v size %d links %d dir %v link %v -> %q %v}, want {%q %v size %d links %d dir %v link %v -> %q %v}",
+				i, got.Name, got.Mode, got.Size, got.Links, got.IsDir, got.IsSymlink, got.LinkTarget, got.ModTime,
+				tt.name, tt.mode, tt.size, tt.links, tt.isDir, tt.isSymlink, tt.target, tt.mtime)
+		}
+	}
+}
+
+func TestGetFileInfo(t *testing.T) {
+	setOptions(t, Options{})
+	useFS(t, newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/f", mode: syscall.S_IFREG | 0640, ino: 77, uid: 5, gid: 6, content: "abc"},
+		fakeLink("/d/link", "f"),
+		fakeLink("/d/dirlink", "/d"),
+		fakeLink("/d/dangling", "gone"),
+	))
+
+	tests := []struct {
+		path      string
+		follow    bool
+		mode      fs.FileMode
+		size      int64
+		isDir     bool
+		isSymlink bool
+		target    string
+		err       error
+	}{
+		{path: "/d/f", mode: 0640, size: 3},
+		{path: "/d/f", follow: true, mode: 0640, size: 3},
+		{path: "/d", mode: fs.ModeDir | 0755, isDir: true},
+		{path: "/d/link", mode: fs.ModeSymlink | 0777, size: 1, isSymlink: true, target: "f"},
+		{path: "/d/link", follow: true, mode: 0640, size: 3},
+		{path: "/d/dirlink", follow: true, mode: fs.ModeDir | 0755, isDir: true},
+		{path: "/d/dangling", mode: fs.ModeSymlink | 0777, size: 4, isSymlink: true, target: "gone"},
+		{path: "/d/dangling", follow: true, err: syscall.ENOENT},
+		{path: "/d/missing", err: syscall.ENOENT},
+	}
+	for _, tt := range tests {
+		got, err := getFileInfo(tt.path, tt.follow)
+		if err != tt.err {
+			t.Errorf("getFileInfo(%s, %v) error = %v, want %v", tt.path, tt.follow, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Name != tt.path || got.Mode != tt.mode || got.Size != tt.size || got.IsDir != tt.isDir ||
+			got.IsSymlink != tt.isSymlink || got.LinkTarget != tt.target {
+			t.Errorf("getFileInfo(%s, %v) = {%q %v size %d dir %v link %v -> %q}, want {%q %v size %d dir %v link %v -> %q}",
+				tt.path, tt.follow, got.Name, got.Mode, got.Size, got.IsDir, got.IsSymlink, got.LinkTarget,
+				tt.path, tt.mode, tt.size, tt.isDir, tt.isSymlink, tt.target)
+		}
+	}
+}
+
+// TestOSFileSystem checks that the real filesystem behaves as the fake
+// does for the calls the listing makes
+func TestOSFileSystem(t *testing.T) {
+	setOptions(t, Options{})
+	useFS(t, osFileSystem{})
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/f", []byte("abc"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("f", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Whatever the umask
+	for name, mode := range map[string]fs.FileMode{"f": 0640, "sub": 0755} {
+		if err := os.Chmod(dir+"/"+name, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := readDirFast(dir)
+	if err != nil {
+		t.Fatalf("readDirFast: %v", err)
+	}
+	sortFiles(entries)
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s %v %q", e.Name, e.Mode, e.LinkTarget))
+	}
+	want := []string{`f -rw-r----- ""`, `link Lrwxrwxrwx "f"`, `sub drwxr-xr-x ""`}
+	if !slices.Equal(got, want) {
+		t.Errorf("readDirFast(%s) = %q, want %q", dir, got, want)
+	}
+
+	if _, err := readDirFast(dir + "/f"); err != syscall.ENOTDIR {
+		t.Errorf("readDirFast of a file = %v, want %v", err, syscall.ENOTDIR)
+	}
+	if _, err := getFileInfo(dir+"/missing", false); err != syscall.ENOENT {
+		t.Errorf("getFileInfo of a missing file = %v, want %v", err, syscall.ENOENT)
+	}
+}
+
+func TestReadDirFastMissing(t *testing.T) {
+	setOptions(t, Options{})
+	useFS(t, newFakeFS(fakeDir("/d"), fakeReg("/d/file", "")))
+
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{"/nowhere", syscall.ENOENT},
+		{"/d/file", syscall.ENOTDIR},
+	}
+	for _, tt := range tests {
+		if _, err := readDirFast(tt.path); err != tt.err {
+			t.Errorf("readDirFast(%q) error = %v, want %v", tt.path, err, tt.err)
+		}
+	}
+}
+
+func TestHeadPreview(t *testing.T) {
+	tests := []struct {
+		content string
+		head    int
+		want    string
+	}{
+		{"hello", 10, "hello"},
+		{"hello, world", 5, "hello…"},
+		{"a\tb\n", 10, `a\x09b\x0a`},
+		{"", 4, ""},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Head: tt.head})
+		useFS(t, newFakeFS(fakeReg("/f", tt.content)))
+
+		if got := headPreview("/f", int64(len(tt.content))); got != tt.want {
+			t.Errorf("headPreview(%q) with --head=%d = %q, want %q", tt.content, tt.head, got, tt.want)
+		}
+	}
+
+	setOptions(t, Options{Head: 4})
+	useFS(t, newFakeFS())
+	if got := headPreview("/missing", 10); got != "?" {
+		t.Errorf("headPreview of a missing file = %q, want %q", got, "?")
+	}
+}
+
+func TestHeadListing(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/conf", "key=value\nmore"),
+		fakeReg("/d/empty", ""),
+		fakeLink("/d/ln", "conf"),
+		fakeDir("/d/sub"),
+	)
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		// Only regular files with content get a preview line
+		{[]string{"-ln", "--head=5"}, "total 2\n" +
+			"-rw-r--r-- 1 0 0 14 May  1  2024 conf\n" +
+			"\tkey=v…\n" +
+			"-rw-r--r-- 1 0 0  0 May  1  2024 empty\n" +
+			"lrwxrwxrwx 1 0 0  4 May  1  2024 ln -> conf\n" +
+			"drwxr-xr-x 1 0 0  0 May  1  2024 sub\n"},
+		{[]string{"-ln", "--head=100"}, "total 2\n" +
+			"-rw-r--r-- 1 0 0 14 May  1  2024 conf\n" +
+			"\tkey=value\\x0amore\n" +
+			"-rw-r--r-- 1 0 0  0 May  1  2024 empty\n" +
+			"lrwxrwxrwx 1 0 0  4 May  1  2024 ln -> conf\n" +
+			"drwxr-xr-x 1 0 0  0 May  1  2024 sub\n"},
+		// Previews follow long format lines only
+		{[]string{"--head=5"}, "conf\nempty\nln\nsub\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"0", "-1", "x"} {
+		status, stderr := lsStatus(t, "-l", "--head="+value, os.DevNull)
+		want := "ls: invalid argument '" + value + "' for '--head'\n"
+		if status != 2 || stderr != want {
+			t.Errorf("ls --head=%s exited %d with %q, want 2 with %q", value, status, stderr, want)
+		}
+	}
+}
+
+func TestDisplayXattrValues(t *testing.T) {
+	tests := []struct {
+		xattrs map[string]string
+		want   string
+	}{
+		{nil, ""},
+		{map[string]string{"user.note": "hi"}, "\tuser.note: hi\n"},
+		{
+			map[string]string{"user.b": "two\x00", "user.a": "\x01"},
+			"\tuser.a: \\x01\n\tuser.b: two\n",
+		},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{})
+		useFS(t, newFakeFS(&fakeFile{path: "/f", mode: syscall.S_IFREG | 0644, xattrs: tt.xattrs}))
+
+		var buf bytes.Buffer
+		displayXattrValues(&buf, "/f")
+		if buf.String() != tt.want {
+			t.Errorf("displayXattrValues with %v wrote %q, want %q", tt.xattrs, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestReadDirFastOrder(t *testing.T) {
+	// Names in an order no sort would produce, some of them slow to stat so
+	// that the stats finish out of order
+	files := []*fakeFile{fakeDir("/d")}
+	var want []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("f%03d", (i*7919)%300)
+		files = append(files, fakeReg("/d/"+name, ""))
+		want = append(want, name)
+	}
+	fake := newFakeFS(files...)
+	for i, name := range want {
+		if i%13 == 0 {
+			fake.lstatDelays["/d/"+name] = time.Millisecond
+		}
+	}
+
+	tests := []struct {
+		jobs int
+		runs int
+	}{
+		{1, 2},
+		{4, 10},
+		{64, 10},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{NoSort: true, All: true, Jobs: tt.jobs})
+		useFS(t, fake)
+		for run := 0; run < tt.runs; run++ {
+			entries, err := readDirFast("/d")
+			if err != nil {
+				t.Fatalf("readDirFast: %v", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name)
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("-j %d run %d: readDirFast order = %v, want directory order %v", tt.jobs, run, got, want)
+			}
+		}
+	}
+
+	if got := runLs(t, fake, "-f", "/d"); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("ls -f = %q, want directory order", got)
+	}
+}
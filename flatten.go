@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// processFlat lists everything beneath the directory operand dir as one
+// list for --flatten, naming each entry by its path relative to dir
+func processFlat(w io.Writer, dir FileInfo) {
+	dirPath := dir.Name
+	var files []FileInfo
+	visited := map[fileID]bool{{dir.Dev, dir.Inode}: true}
+	collectFlat(dirPath, "", &files, visited)
+	sortFiles(files)
+
+	if opts.UniqueHardlinks {
+		files = collapseHardlinks(files)
+	}
+
+	displayFiles(w, files, dirPath)
+	if opts.ExtSummary {
+		displayExtSummary(w, files)
+	}
+	if opts.HardlinkSummary {
+		displayHardlinkSummary(w, files)
+	}
+	histogram.add(files)
+}
+
+// collectFlat appends the entries of the directory at prefix beneath
+// dirPath to files, descending into subdirectories as -R would, except
+// those in visited
+func collectFlat(dirPath, prefix string, files *[]FileInfo, visited map[fileID]bool) {
+	path := filepath.Join(dirPath, prefix)
+	entries, err := readDirFast(path)
+	if err != nil {
+		reportError(path, err)
+		return
+	}
+	progress.addDirectory(len(entries))
+
+	for _, entry := range entries {
+		if shouldSkipEntry(entry) {
+			continue
+		}
+
+		// Filters match the entry's own name, before it becomes a path
+		name := entry.Name
+		matches := matchesFilters(entry)
+		entry.Name = filepath.Join(prefix, name)
+		if matches {
+			*files = append(*files, entry)
+		}
+
+		if !entry.IsDir || name == "." || name == ".." || isExcludedDir(name) {
+			continue
+		}
+		id := fileID{entry.Dev, entry.Inode}
+		if visited[id] {
+			fmt.Fprintf(os.Stderr, "ls: %s: not listing already-listed directory\n", filepath.Join(dirPath, entry.Name))
+			continue
+		}
+		visited[id] = true
+		collectFlat(dirPath, entry.Name, files, visited)
+	}
+}
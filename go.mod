@@ -2,4 +2,7 @@ module ls-go
 
 go 1.23.4
 
-require github.com/alitto/pond v1.9.2
+require (
+	github.com/alitto/pond v1.9.2
+	golang.org/x/sys v0.30.0
+)
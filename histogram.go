@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// sizeHistogram counts listed files by size magnitude for --histogram. It
+// is shared by the goroutines listing each operand, so with -R the footer
+// covers the whole tree.
+type sizeHistogram struct {
+	mu     sync.Mutex
+	counts [len(histogramBuckets)]int
+}
+
+// histogramBuckets are the size ranges of the histogram; each holds sizes
+// below its limit that did not fit an earlier bucket
+var histogramBuckets = [...]struct {
+	label string
+	limit int64
+}{
+	{"0-1K", 1 << 10},
+	{"1K-1M", 1 << 20},
+	{"1M-1G", 1 << 30},
+	{">1G", -1},
+}
+
+// histogramBarWidth is the length of the longest bar
+const histogramBarWidth = 40
+
+// histogram is nil unless --histogram is active
+var histogram *sizeHistogram
+
+// add counts the non-directories among files
+func (h *sizeHistogram) add(files []FileInfo) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, file := range files {
+		if file.IsDir || file.StatFailed {
+			continue
+		}
+		h.counts[histogramBucket(file.Size)]++
+	}
+}
+
+// histogramBucket returns the index of the bucket holding size
+func histogramBucket(size int64) int {
+	for i, bucket := range histogramBuckets {
+		if bucket.limit < 0 || size < bucket.limit {
+			return i
+		}
+	}
+	return len(histogramBuckets) - 1
+}
+
+// display writes the footer: one bar per bucket, scaled to the largest count
+func (h *sizeHistogram) display(w io.Writer) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	most := 0
+	for _, count := range h.counts {
+		if count > most {
+			most = count
+		}
+	}
+
+	fmt.Fprintln(w)
+	for i, bucket := range histogramBuckets {
+		bar := 0
+		if most > 0 {
+			bar = (h.counts[i]*histogramBarWidth + most - 1) / most
+		}
+		line := fmt.Sprintf("%-6s %8d %s", bucket.label, h.counts[i], strings.Repeat("#", bar))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
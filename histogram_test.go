@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0-1K"},
+		{1023, "0-1K"},
+		{1024, "1K-1M"},
+		{1<<20 - 1, "1K-1M"},
+		{1 << 20, "1M-1G"},
+		{1<<30 - 1, "1M-1G"},
+		{1 << 30, ">1G"},
+		{1 << 50, ">1G"},
+	}
+	for _, tt := range tests {
+		if got := histogramBuckets[histogramBucket(tt.size)].label; got != tt.want {
+			t.Errorf("histogramBucket(%d) = %s, want %s", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramDisplay(t *testing.T) {
+	tests := []struct {
+		files []FileInfo
+		want  string
+	}{
+		{
+			nil,
+			"\n0-1K          0\n1K-1M         0\n1M-1G         0\n>1G           0\n",
+		},
+		{
+			[]FileInfo{
+				{Size: 10}, {Size: 20}, {Size: 30}, {Size: 40},
+				{Size: 5 << 10}, {Size: 6 << 10},
+				{Size: 3 << 30},
+				{Size: 1 << 40, IsDir: true},
+				{Size: 1 << 40, StatFailed: true},
+			},
+			"\n" +
+				"0-1K          4 " + strings.Repeat("#", 40) + "\n" +
+				"1K-1M         2 " + strings.Repeat("#", 20) + "\n" +
+				"1M-1G         0\n" +
+				">1G           1 " + strings.Repeat("#", 10) + "\n",
+		},
+	}
+	for _, tt := range tests {
+		h := &sizeHistogram{}
+		h.add(tt.files)
+		var buf bytes.Buffer
+		h.display(&buf)
+		if buf.String() != tt.want {
+			t.Errorf("histogram of %d files =\n%s\nwant\n%s", len(tt.files), buf.String(), tt.want)
+		}
+	}
+}
+
+func TestHistogramRecursive(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", "tiny"),
+		fakeReg("/d/b", strings.Repeat("k", 2048)),
+		fakeDir("/d/sub"),
+		fakeReg("/d/sub/c", ""),
+		fakeReg("/d/sub/d", strings.Repeat("k", 1024)),
+		fakeReg("/f", "x"),
+	)
+
+	tests := []struct {
+		args   []string
+		counts [len(histogramBuckets)]int
+	}{
+		{[]string{"/d"}, [len(histogramBuckets)]int{1, 1, 0, 0}},
+		{[]string{"-R", "/d"}, [len(histogramBuckets)]int{2, 2, 0, 0}},
+		{[]string{"-R", "/d", "/f"}, [len(histogramBuckets)]int{3, 2, 0, 0}},
+	}
+	saved := histogram
+	defer func() { histogram = saved }()
+	for _, tt := range tests {
+		histogram = &sizeHistogram{}
+		runLs(t, fake, tt.args...)
+		if histogram.counts != tt.counts {
+			t.Errorf("ls --histogram %v counted %v, want %v", tt.args, histogram.counts, tt.counts)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Nerd Font glyphs for --icons
+const (
+	iconDirectory  = "\uf115"
+	iconSymlink    = "\uf481"
+	iconExecutable = "\uf489"
+	iconFile       = "\uf15b"
+)
+
+// extensionIcons are the --icons glyphs of common extensions, which take
+// the place of iconFile
+var extensionIcons = map[string]string{
+	".c":    "\ue61e",
+	".cpp":  "\ue61d",
+	".css":  "\ue749",
+	".gif":  "\uf1c5",
+	".go":   "\ue627",
+	".gz":   "\uf410",
+	".h":    "\uf0fd",
+	".html": "\uf13b",
+	".jpg":  "\uf1c5",
+	".js":   "\ue74e",
+	".json": "\ue60b",
+	".md":   "\uf48a",
+	".pdf":  "\uf1c1",
+	".png":  "\uf1c5",
+	".py":   "\ue606",
+	".rs":   "\ue7a8",
+	".sh":   "\uf489",
+	".tar":  "\uf410",
+	".toml": "\ue615",
+	".ts":   "\ue628",
+	".txt":  "\uf15c",
+	".yaml": "\ue615",
+	".yml":  "\ue615",
+	".zip":  "\uf410",
+}
+
+// fileIcon returns the --icons glyph of file: one for its type when it is
+// a directory or symlink, else one for its extension, else one for an
+// executable or a plain file
+func fileIcon(file FileInfo) string {
+	switch {
+	case file.IsDir:
+		return iconDirectory
+	case file.IsSymlink:
+		return iconSymlink
+	}
+	if icon, ok := extensionIcons[strings.ToLower(filepath.Ext(file.Name))]; ok {
+		return icon
+	}
+	if file.Mode&0111 != 0 {
+		return iconExecutable
+	}
+	return iconFile
+}
+
+// iconPrefix returns the glyph and space that --icons puts before a name
+func iconPrefix(file FileInfo) string {
+	if !opts.Icons {
+		return ""
+	}
+	return fileIcon(file) + " "
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileIcon(t *testing.T) {
+	tests := []struct {
+		file FileInfo
+		want string
+	}{
+		{FileInfo{Name: "main.go", Mode: 0644}, extensionIcons[".go"]},
+		{FileInfo{Name: "README.MD", Mode: 0644}, extensionIcons[".md"]},
+		{FileInfo{Name: "data.json", Mode: 0644}, extensionIcons[".json"]},
+		{FileInfo{Name: "src", IsDir: true}, iconDirectory},
+		{FileInfo{Name: "pkg.go", IsDir: true}, iconDirectory},
+		{FileInfo{Name: "link.go", IsSymlink: true}, iconSymlink},
+		{FileInfo{Name: "tool", Mode: 0755}, iconExecutable},
+		{FileInfo{Name: "tool.py", Mode: 0755}, extensionIcons[".py"]},
+		{FileInfo{Name: "notes.xyz", Mode: 0644}, iconFile},
+		{FileInfo{Name: "Makefile", Mode: 0644}, iconFile},
+	}
+	for _, tt := range tests {
+		if got := fileIcon(tt.file); got != tt.want {
+			t.Errorf("fileIcon(%s) = %q, want %q", tt.file.Name, got, tt.want)
+		}
+	}
+}
+
+func TestIconsListing(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/main.go", ""), fakeDir("/d/src"), fakeReg("/d/x.zzz", ""))
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	goIcon := extensionIcons[".go"]
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1"}, "main.go\nsrc\nx.zzz\n"},
+		{[]string{"-1", "--icons"}, goIcon + " main.go\n" + iconDirectory + " src\n" + iconFile + " x.zzz\n"},
+		{[]string{"-C", "--icons"}, goIcon + " main.go  " + iconDirectory + " src      " + iconFile + " x.zzz\n"},
+		{[]string{"-lgn", "--icons"}, "total 0\n" +
+			"-rw-r--r-- 1 0 0 May  1  2024 " + goIcon + " main.go\n" +
+			"drwxr-xr-x 1 0 0 May  1  2024 " + iconDirectory + " src\n" +
+			"-rw-r--r-- 1 0 0 May  1  2024 " + iconFile + " x.zzz\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// jsonEntry is one file in --json output. Directories that were listed
+// carry their entries in Children, nested all the way down with -R; it is
+// a pointer so that an empty directory still shows "children": [].
+type jsonEntry struct {
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Size       int64         `json:"size"`
+	Mode       string        `json:"mode"`
+	ModeOctal  string        `json:"modeOctal"`
+	ModTime    string        `json:"modTime"`
+	Uid        uint32        `json:"uid"`
+	Gid        uint32        `json:"gid"`
+	Owner      string        `json:"owner"`
+	Group      string        `json:"group"`
+	Inode      uint64        `json:"inode"`
+	IsDir      bool          `json:"isDir"`
+	IsSymlink  bool          `json:"isSymlink"`
+	LinkTarget string        `json:"linkTarget,omitempty"`
+	Cycle      bool          `json:"cycle,omitempty"`
+	Children   *[]*jsonEntry `json:"children,omitempty"`
+}
+
+// jsonError is an operand or directory that could not be read, collected
+// for the errors array of --emit-errors-json
+type jsonError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// jsonDocument is the --json output under --emit-errors-json, which pairs
+// the listing with the failures met along the way
+type jsonDocument struct {
+	Files  []*jsonEntry `json:"files"`
+	Errors []jsonError  `json:"errors"`
+}
+
+// jsonErrors collects errors for --emit-errors-json. The JSON listing is
+// built by a single goroutine, so it needs no locking.
+var jsonErrors = []jsonError{}
+
+// Exit statuses, as GNU ls uses them: a file or directory met along the
+// way that could not be read is a minor problem, an operand that could not
+// be accessed a serious one
+const (
+	exitMinor   = 1
+	exitSerious = 2
+)
+
+// exitStatus is the status ls exits with once the listing is written.
+// Directories are listed concurrently, so it is only raised atomically.
+var exitStatus atomic.Int32
+
+// raiseExitStatus sets the exit status to status unless it is already higher
+func raiseExitStatus(status int32) {
+	for {
+		current := exitStatus.Load()
+		if current >= status || exitStatus.CompareAndSwap(current, status) {
+			return
+		}
+	}
+}
+
+// reportError reports that path could not be read: on stderr, or in the
+// errors array when --emit-errors-json is active. Either way ls will exit
+// with at least exitMinor.
+func reportError(path string, err error) {
+	raiseExitStatus(exitMinor)
+	if opts.JSON && opts.EmitErrorsJSON {
+		jsonErrors = append(jsonErrors, jsonError{Path: path, Message: err.Error()})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "ls: %s: %v\n", path, err)
+}
+
+// displayJSON writes the operands as a JSON array, listing directories
+// (recursively with -R) inside their entries. Under --emit-errors-json the
+// array is wrapped in an object alongside the errors.
+func displayJSON(w io.Writer, nonDirs, dirs []FileInfo) {
+	sortFiles(nonDirs)
+	if !opts.PreserveArgs {
+		sortFiles(dirs)
+	}
+
+	entries := make([]*jsonEntry, 0, len(nonDirs)+len(dirs))
+	for _, file := range nonDirs {
+		entries = append(entries, newJSONEntry(file, file.Name))
+	}
+	for _, dir := range dirs {
+		entry := newJSONEntry(dir, dir.Name)
+		visited := map[fileID]bool{{dir.Dev, dir.Inode}: true}
+		children := listJSONChildren(dir.Name, visited)
+		entry.Children = &children
+		entries = append(entries, entry)
+	}
+
+	var document any = entries
+	if opts.EmitErrorsJSON {
+		document = jsonDocument{Files: entries, Errors: jsonErrors}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		fmt.Fprintf(os.Stderr, "ls: %v\n", err)
+	}
+}
+
+// listJSONChildren lists dirPath, descending into subdirectories with -R.
+// visited holds the directories on the current path so that a directory
+// containing itself, through a bind mount or -L, is marked as a cycle
+// instead of being walked forever.
+func listJSONChildren(dirPath string, visited map[fileID]bool) []*jsonEntry {
+	entries, err := readDirFast(dirPath)
+	if err != nil {
+		reportError(dirPath, err)
+		return []*jsonEntry{}
+	}
+
+	var filtered []FileInfo
+	for _, entry := range entries {
+		if shouldSkipEntry(entry) || !matchesFilters(entry) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	sortFiles(filtered)
+
+	children := make([]*jsonEntry, 0, len(filtered))
+	for _, file := range filtered {
+		path := filepath.Join(dirPath, file.Name)
+		child := newJSONEntry(file, path)
+		children = append(children, child)
+
+		if !opts.Recursive || !file.IsDir || file.Name == "." || file.Name == ".." || isExcludedDir(file.Name) {
+			continue
+		}
+
+		id := fileID{file.Dev, file.Inode}
+		if visited[id] {
+			child.Cycle = true
+			continue
+		}
+		visited[id] = true
+		grandchildren := listJSONChildren(path, visited)
+		child.Children = &grandchildren
+		delete(visited, id)
+	}
+	return children
+}
+
+func newJSONEntry(file FileInfo, path string) *jsonEntry {
+	return &jsonEntry{
+		Name:       filepath.Base(file.Name),
+		Path:       path,
+		Size:       file.Size,
+		Mode:       formatMode(file.Mode, file.IsSymlink),
+		ModeOctal:  octalMode(file.Mode),
+		ModTime:    file.ModTime.Format(time.RFC3339),
+		Uid:        file.Uid,
+		Gid:        file.Gid,
+		Owner:      getUserName(file.Uid),
+		Group:      getGroupName(file.Gid),
+		Inode:      file.Inode,
+		IsDir:      file.IsDir,
+		IsSymlink:  file.IsSymlink,
+		LinkTarget: file.LinkTarget,
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// jsonOutline flattens a --json listing to one line per entry, indented by
+// depth, with directories marked by their children or their cycle
+func jsonOutline(entries []*jsonEntry, depth int) []string {
+	var lines []string
+	for _, entry := range entries {
+		line := fmt.Sprintf("%*s%s", 2*depth, "", entry.Path)
+		switch {
+		case entry.Cycle:
+			line += " (cycle)"
+		case entry.Children != nil:
+			line += fmt.Sprintf(" [%d]", len(*entry.Children))
+		}
+		lines = append(lines, line)
+		if entry.Children != nil {
+			lines = append(lines, jsonOutline(*entry.Children, depth+1)...)
+		}
+	}
+	return lines
+}
+
+func TestJSONNesting(t *testing.T) {
+	fake := newFakeFS(
+		&fakeFile{path: "/d", mode: syscall.S_IFDIR | 0755, ino: 100},
+		fakeReg("/d/a", "hello"),
+		fakeDir("/d/empty"),
+		fakeDir("/d/sub"),
+		fakeReg("/d/sub/b", ""),
+		&fakeFile{path: "/d/sub/loop", mode: syscall.S_IFDIR | 0755, ino: 100},
+		fakeReg("/f", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"--json", "/d"},
+			[]string{
+				"/d [3]",
+				"  /d/a",
+				"  /d/empty",
+				"  /d/sub",
+			},
+		},
+		{
+			[]string{"--json", "-R", "/d", "/f"},
+			[]string{
+				"/f",
+				"/d [3]",
+				"  /d/a",
+				"  /d/empty [0]",
+				"  /d/sub [2]",
+				"    /d/sub/b",
+				"    /d/sub/loop (cycle)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		var entries []*jsonEntry
+		got := runLs(t, fake, tt.args...)
+		if err := json.Unmarshal([]byte(got), &entries); err != nil {
+			t.Fatalf("ls %v printed invalid JSON: %v\n%s", tt.args, err, got)
+		}
+		outline := jsonOutline(entries, 0)
+		if fmt.Sprint(outline) != fmt.Sprint(tt.want) {
+			t.Errorf("ls %v outline = %q, want %q", tt.args, outline, tt.want)
+		}
+	}
+}
+
+func TestJSONEntry(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{
+			path: "/d/x", mode: syscall.S_IFREG | 0640, ino: 4242, uid: 1234567, gid: 7654321, content: "abc",
+			mtime: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		},
+		fakeLink("/d/l", "x"),
+	)
+
+	var entries []*jsonEntry
+	got := runLs(t, fake, "--json", "/d")
+	if err := json.Unmarshal([]byte(got), &entries); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, got)
+	}
+	if len(entries) != 1 || entries[0].Children == nil || len(*entries[0].Children) != 2 {
+		t.Fatalf("unexpected listing %s", got)
+	}
+
+	children := *entries[0].Children
+	tests := []struct {
+		field     string
+		got, want any
+	}{
+		{"l.isSymlink", children[0].IsSymlink, true},
+		{"l.linkTarget", children[0].LinkTarget, "x"},
+		{"x.name", children[1].Name, "x"},
+		{"x.path", children[1].Path, "/d/x"},
+		{"x.size", children[1].Size, int64(3)},
+		{"x.mode", children[1].Mode, "-rw-r-----"},
+		{"x.modeOctal", children[1].ModeOctal, "0640"},
+		{"x.uid", children[1].Uid, uint32(1234567)},
+		{"x.owner", children[1].Owner, "1234567"},
+		{"x.isDir", children[1].IsDir, false},
+		{"x.isSymlink", children[1].IsSymlink, false},
+		{"x.linkTarget", children[1].LinkTarget, ""},
+		{"x.gid", children[1].Gid, uint32(7654321)},
+		{"x.group", children[1].Group, "7654321"},
+		{"x.inode", children[1].Inode, uint64(4242)},
+		{"x.modTime", children[1].ModTime, "2024-05-01T12:30:00Z"},
+		{"d.isDir", entries[0].IsDir, true},
+		{"d.mode", entries[0].Mode, "drwxr-xr-x"},
+		{"d.modeOctal", entries[0].ModeOctal, "0755"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.field, tt.got, tt.want)
+		}
+	}
+
+	// Consumers see these keys; linkTarget only on symlinks
+	var raw []map[string]any
+	if err := json.Unmarshal([]byte(runLs(t, fake, "--json", "/d/x", "/d/l")), &raw); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"gid", "group", "inode", "isDir", "isSymlink", "mode", "modeOctal", "modTime", "name", "owner", "path", "size", "uid"}
+	for i, want := range [][]string{append(slices.Clone(keys), "linkTarget"), keys} {
+		got := slices.Collect(maps.Keys(raw[i]))
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%v has keys %q, want %q", raw[i]["path"], got, want)
+		}
+	}
+}
+
+func TestEmitErrorsJSON(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", ""),
+		&fakeFile{path: "/d/locked", mode: syscall.S_IFDIR},
+		fakeDir("/d/sub"),
+		&fakeFile{path: "/d/sub/locked", mode: syscall.S_IFDIR},
+		fakeReg("/f", ""),
+	)
+	tests := []struct {
+		args   []string
+		files  []string
+		errors []jsonError
+		status int32
+	}{
+		{[]string{"/f"}, []string{"/f"}, []jsonError{}, 0},
+		{
+			[]string{"/f", "/missing"},
+			[]string{"/f"},
+			[]jsonError{{"/missing", "no such file or directory"}},
+			exitSerious,
+		},
+		{
+			[]string{"/d/locked", "/f"},
+			[]string{"/f", "/d/locked [0]"},
+			[]jsonError{{"/d/locked", "permission denied"}},
+			exitMinor,
+		},
+		{
+			[]string{"-R", "/d"},
+			[]string{"/d [3]", "  /d/a", "  /d/locked [0]", "  /d/sub [1]", "    /d/sub/locked [0]"},
+			[]jsonError{{"/d/locked", "permission denied"}, {"/d/sub/locked", "permission denied"}},
+			exitMinor,
+		},
+	}
+	for _, tt := range tests {
+		jsonErrors = []jsonError{}
+		exitStatus.Store(0)
+		args := append([]string{"--json", "--emit-errors-json"}, tt.args...)
+		got := runLs(t, fake, args...)
+		if status := exitStatus.Load(); status != tt.status {
+			t.Errorf("ls %v exit status = %d, want %d", args, status, tt.status)
+		}
+
+		var document jsonDocument
+		if err := json.Unmarshal([]byte(got), &document); err != nil {
+			t.Fatalf("ls %v printed invalid JSON: %v\n%s", args, err, got)
+		}
+		if outline := jsonOutline(document.Files, 0); fmt.Sprint(outline) != fmt.Sprint(tt.files) {
+			t.Errorf("ls %v files = %q, want %q", args, outline, tt.files)
+		}
+		if !reflect.DeepEqual(document.Errors, tt.errors) {
+			t.Errorf("ls %v errors = %+v, want %+v", args, document.Errors, tt.errors)
+		}
+	}
+	jsonErrors = []jsonError{}
+	exitStatus.Store(0)
+
+	// Without the option the document stays a bare array
+	var entries []*jsonEntry
+	if got := runLs(t, fake, "--json", "/f"); json.Unmarshal([]byte(got), &entries) != nil {
+		t.Errorf("ls --json /f = %q, want a JSON array", got)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	binaryTests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{os.DevNull}, 0},
+		{[]string{missing}, exitSerious},
+		{[]string{os.DevNull, missing}, exitSerious},
+		{[]string{"-R", "--json", "--emit-errors-json", missing}, exitSerious},
+	}
+	for _, tt := range binaryTests {
+		if status, _ := lsStatus(t, tt.args...); status != tt.status {
+			t.Errorf("ls %q exited %d, want %d", tt.args, status, tt.status)
+		}
+	}
+
+	// A directory that cannot be read below an operand is reported in
+	// every layout and makes ls exit with exitMinor
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", ""),
+		fakeDir("/d/sub"),
+		&fakeFile{path: "/d/sub/locked", mode: syscall.S_IFDIR},
+	)
+	tests := []struct {
+		args   []string
+		status int32
+	}{
+		{[]string{"/d"}, 0},
+		{[]string{"-R", "/d"}, exitMinor},
+		{[]string{"--tree", "/d"}, exitMinor},
+		{[]string{"--flatten", "/d"}, exitMinor},
+		{[]string{"/d/sub/locked"}, exitMinor},
+		{[]string{"-R", "/d", "/missing"}, exitSerious},
+	}
+	for _, tt := range tests {
+		exitStatus.Store(0)
+		stderr := captureStderr(t)
+		runLs(t, fake, tt.args...)
+		if status := exitStatus.Load(); status != tt.status {
+			t.Errorf("ls %v exit status = %d, want %d", tt.args, status, tt.status)
+		}
+		if got := stderr(); (tt.status == 0) != (got == "") {
+			t.Errorf("ls %v wrote %q to stderr with exit status %d", tt.args, got, tt.status)
+		}
+	}
+	exitStatus.Store(0)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultLSColors colors names by type when LS_COLORS is unset, following
+// the GNU defaults
+const defaultLSColors = "di=01;34:ln=01;36:pi=40;33:so=01;35:bd=40;33;01:cd=40;33;01:ex=01;32"
+
+// lsColors maps LS_COLORS keys to SGR parameters. Keys are two-letter type
+// codes such as "di", or extension patterns such as "*.tar".
+var lsColors map[string]string
+
+// loadLSColors reads $LS_COLORS, falling back to defaultLSColors
+func loadLSColors() {
+	spec := os.Getenv("LS_COLORS")
+	if spec == "" {
+		spec = defaultLSColors
+	}
+	lsColors = parseLSColors(spec)
+}
+
+// parseLSColors parses the colon-separated KEY=SGR pairs of LS_COLORS,
+// skipping malformed entries
+func parseLSColors(spec string) map[string]string {
+	colors := make(map[string]string)
+	for _, entry := range strings.Split(spec, ":") {
+		key, code, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			continue
+		}
+		colors[key] = code
+	}
+	return colors
+}
+
+// colorName wraps name, the displayed form of file's name, in the color
+// LS_COLORS gives its type when -G or --color is active
+func colorName(file FileInfo, name string) string {
+	if !opts.Color {
+		return name
+	}
+	code := fileColor(file)
+	if code == "" || strings.Trim(code, "0") == "" {
+		return name
+	}
+	return "\033[" + code + "m" + name + colorReset
+}
+
+// fileColor picks the LS_COLORS entry for file: its type for anything but
+// a regular file, then "ex" for executables, then its extension
+func fileColor(file FileInfo) string {
+	switch {
+	case file.IsSymlink:
+		return lsColors["ln"]
+	case file.IsDir:
+		return lsColors["di"]
+	case file.Mode&fs.ModeNamedPipe != 0:
+		return lsColors["pi"]
+	case file.Mode&fs.ModeSocket != 0:
+		return lsColors["so"]
+	case file.Mode&fs.ModeCharDevice != 0:
+		return lsColors["cd"]
+	case file.Mode&fs.ModeDevice != 0:
+		return lsColors["bd"]
+	}
+
+	if code, ok := lsColors["ex"]; ok && file.Mode.Perm()&0111 != 0 {
+		return code
+	}
+	if ext := fileExtension(filepath.Base(file.Name)); ext != "" {
+		if code, ok := lsColors["*"+ext]; ok {
+			return code
+		}
+		if code, ok := lsColors["*"+strings.ToLower(ext)]; ok {
+			return code
+		}
+	}
+	return lsColors["fi"]
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseLSColors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"di=01;34", map[string]string{"di": "01;34"}},
+		{"di=01;34:ln=01;36:*.tar=31", map[string]string{"di": "01;34", "ln": "01;36", "*.tar": "31"}},
+		{"di=1:di=2", map[string]string{"di": "2"}},
+		{"bogus:=5:ex=:fi=0", map[string]string{"ex": "", "fi": "0"}},
+		{"rs=0:mh=00:", map[string]string{"rs": "0", "mh": "00"}},
+	}
+	for _, tt := range tests {
+		if got := parseLSColors(tt.spec); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseLSColors(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestFileColor(t *testing.T) {
+	lsColorsWas := lsColors
+	defer func() { lsColors = lsColorsWas }()
+	lsColors = parseLSColors("di=01;34:ln=01;36:pi=33:so=35:bd=33;01:cd=33;01:ex=01;32:*.tar=31:*.JPG=35:fi=37")
+
+	tests := []struct {
+		file FileInfo
+		want string
+	}{
+		{FileInfo{Name: "dir", IsDir: true, Mode: fs.ModeDir | 0755}, "01;34"},
+		{FileInfo{Name: "link", IsSymlink: true, Mode: fs.ModeSymlink | 0777}, "01;36"},
+		{FileInfo{Name: "link.tar", IsSymlink: true, Mode: fs.ModeSymlink | 0777}, "01;36"},
+		{FileInfo{Name: "fifo", Mode: fs.ModeNamedPipe | 0644}, "33"},
+		{FileInfo{Name: "sock", Mode: fs.ModeSocket | 0755}, "35"},
+		{FileInfo{Name: "tty", Mode: fs.ModeDevice | fs.ModeCharDevice | 0620}, "33;01"},
+		{FileInfo{Name: "sda", Mode: fs.ModeDevice | 0660}, "33;01"},
+		{FileInfo{Name: "run.sh", Mode: 0755}, "01;32"},
+		{FileInfo{Name: "run.tar", Mode: 0755}, "01;32"},
+		{FileInfo{Name: "backup.tar", Mode: 0644}, "31"},
+		{FileInfo{Name: "sub/backup.tar", Mode: 0644}, "31"},
+		{FileInfo{Name: "photo.JPG", Mode: 0644}, "35"},
+		{FileInfo{Name: "photo.jpg", Mode: 0644}, "37"},
+		{FileInfo{Name: "notes", Mode: 0644}, "37"},
+	}
+	for _, tt := range tests {
+		if got := fileColor(tt.file); got != tt.want {
+			t.Errorf("fileColor(%s, %v) = %q, want %q", tt.file.Name, tt.file.Mode, got, tt.want)
+		}
+	}
+}
+
+func TestColorListing(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/dir", mode: syscall.S_IFDIR | 0755, mtime: stamp},
+		&fakeFile{path: "/d/link", mode: syscall.S_IFLNK | 0777, target: "prog", mtime: stamp},
+		&fakeFile{path: "/d/plain", mode: syscall.S_IFREG | 0644, mtime: stamp},
+		&fakeFile{path: "/d/prog", mode: syscall.S_IFREG | 0755, mtime: stamp},
+	)
+	env := map[string]string{"LS_COLORS": "di=01;34:ln=01;36:ex=01;32"}
+	const (
+		dir  = "\033[01;34mdir\033[0m"
+		link = "\033[01;36mlink\033[0m"
+		prog = "\033[01;32mprog\033[0m"
+	)
+
+	tests := []struct {
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{env, []string{"-1", "--color", "/d"}, dir + "\n" + link + "\n" + "plain\n" + prog + "\n"},
+		{env, []string{"-1", "--color=always", "/d"}, dir + "\n" + link + "\n" + "plain\n" + prog + "\n"},
+		{env, []string{"-1", "--color=never", "/d"}, "dir\nlink\nplain\nprog\n"},
+		{env, []string{"-1", "--color=auto", "/d"}, "dir\nlink\nplain\nprog\n"},
+		{env, []string{"-1G", "/d"}, "dir\nlink\nplain\nprog\n"},
+		{env, []string{"-C", "--color", "/d"}, dir + "    " + link + "   plain  " + prog + "\n"},
+		{env, []string{"-1F", "--color", "/d"}, dir + "/\n" + link + "@\nplain\n" + prog + "*\n"},
+		{
+			env, []string{"-ln", "--color", "/d/link", "/d/dir"},
+			"total 1\n" +
+				"lrwxrwxrwx 1 0 0 4 Jan  2  2020 \033[01;36m/d/link\033[0m -> prog\n" +
+				"\n/d/dir:\n",
+		},
+		{
+			map[string]string{"LS_COLORS": "di=4"}, []string{"-1", "--color", "/d"},
+			"\033[4mdir\033[0m\nlink\nplain\nprog\n",
+		},
+		{nil, []string{"-1", "--color", "/d"}, dir + "\n" + link + "\n" + "plain\n" + prog + "\n"},
+	}
+	for _, tt := range tests {
+		if got := runLsEnv(t, tt.env, fake, tt.args...); got != tt.want {
+			t.Errorf("LS_COLORS=%q ls %v = %q, want %q", tt.env["LS_COLORS"], tt.args, got, tt.want)
+		}
+	}
+}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/alitto/pond"
+	"golang.org/x/sys/unix"
 )
 
 // FileInfo represents enhanced file information
@@ -24,6 +36,8 @@ type FileInfo struct {
 	ModTime    time.Time
 	AccessTime time.Time
 	ChangeTime time.Time
+	BirthTime  time.Time
+	Dev        uint64
 	Inode      uint64
 	Blocks     int64
 	Links      uint64
@@ -33,8 +47,17 @@ type FileInfo struct {
 	Minor      uint32
 	IsDir      bool
 	IsSymlink  bool
+	IsWhiteout bool
+	StatFailed bool // metadata unavailable; only Name and the file type are set
+	Aliases    int  // other names of this inode collapsed by --unique-hardlinks
 	LinkTarget string
 	Flags      uint32
+
+	Generation    uint32 // inode generation, for --inode-generation
+	HasGeneration bool
+
+	HasXattr bool // extended attributes, shown as '@' in long format
+	HasACL   bool // access control list, shown as '+' in long format
 }
 
 // Options represents command line options
@@ -55,23 +78,136 @@ type Options struct {
 	Inode         bool // -i
 	Kilobytes     bool // -k
 	Follow        bool // -L
-	NoFollow      bool // -H
+	FollowArgs    bool // -H
 	Flags         bool // -o
 	Slash         bool // -p
 	Quote         bool // -q
 	Recursive     bool // -R
 	Reverse       bool // -r
 	SizeSort      bool // -S
+	VersionSort   bool // -v
 	Blocks        bool // -s
 	TimeSort      bool // -t
 	AccessTime    bool // -u
 	ChangeTime    bool // -c
+	BirthTime     bool // -U
 	FullTime      bool // -T
+
+	ExcludeDirs []string // --exclude-dir
+	ModeColor   bool     // --mode-color
+	BothSizes   bool     // --both-sizes
+	Sort        []string // --sort, a chain of sort keys
+	ExtSummary  bool     // --ext-summary
+
+	StatCacheSize int    // --stat-cache-size
+	QuotingStyle  string // --quoting-style
+	ShowControl   bool   // --show-control-chars
+	Wrap          string // --wrap
+	PrintRealpath bool   // --print-realpath
+	FastSymlinks  bool   // --fast-symlinks
+	ASCII         bool   // --ascii
+	Progress      bool   // --progress
+	ReverseNames  bool   // --sort-reverse-only-names
+	Markdown      bool   // --format=markdown
+	Fields        bool   // --format=fields
+	Separator     string // --separator
+	Width         int    // output width in columns
+
+	OwnerUid *uint32 // --user
+	OwnerGid *uint32 // --group
+
+	Perm      *permFilter // --perm
+	NewerThan time.Time   // --since
+
+	ColorDepth  colorDepth    // --color-depth
+	StatTimeout time.Duration // --stat-timeout
+
+	UniqueHardlinks bool     // --unique-hardlinks
+	Match           []string // --match
+	IMatch          []string // --imatch, lowercased
+	LinkColor       uint64   // --link-color threshold, 0 when off
+	StrictWidth     bool     // --strict-width
+	JSON            bool     // --json
+
+	RelativeTime time.Duration // --relative-time-threshold
+	NullsLast    bool          // --nulls-last
+
+	XattrValues      bool // --xattr-values
+	SkipEmptyHeaders bool // --skip-empty-headers
+	Histogram        bool // --histogram
+
+	TimeResolution time.Duration // --time-resolution, 0 for full precision
+	PreserveArgs   bool          // --preserve-arg-order
+	PermStyle      string        // --perm-style
+	TimeColor      bool          // --time-color
+	GitRoot        bool          // --git-root
+	Page           int           // --page, 0 when off
+	Flatten        bool          // --flatten
+	Precision      *int          // --precision
+	Color          bool          // -G, --color
+	Indicators     string        // --indicators letters, empty for all
+	AlignRight     bool          // --align-right
+
+	HardlinkSummary bool // --hardlink-summary
+	InodeGeneration bool // --inode-generation
+	DirsFirst       bool // --group-directories-first
+	PortableDates   bool // --portable-dates
+
+	RecurseSymlinkArgs bool // --recurse-symlink-args
+
+	DirectoryBase string // --directory-base
+
+	Tree      bool // --tree
+	Collapse  bool // --collapse
+	TreeDepth int  // --tree-depth, 0 for no limit
+
+	Head      int   // --head byte count, 0 when off
+	BlockSize int64 // --block-size in bytes, 0 when unset
+
+	NoSymlinkArrow bool // --no-symlink-arrow
+	LogSort        bool // --log-sort
+	SI             bool // --si
+	EmitErrorsJSON bool // --emit-errors-json
+	Jobs           int  // -j, --jobs, 0 for the default
+	NoConcurrency  bool // --no-concurrency
+	Zero           bool // --zero
+	StatRetry      int  // --stat-retry, 0 for no retries
+	Icons          bool // --icons
+	XattrNames     bool // -@
+
+	TimeStyle string // --time-style, empty for locale
+}
+
+// permFilter is a parsed --perm=MODE argument
+type permFilter struct {
+	bits uint32
+	kind byte // '=' exact match, '-' all bits set, '/' any bit set
 }
 
 var opts Options
 var pool *pond.WorkerPool
 
+// decorations are the characters used for ornaments around file names
+type decorations struct {
+	ellipsis   string // marks truncated text
+	arrow      string // points from a symlink to its target
+	treeBranch string // connects an entry that has later siblings
+	treeLast   string // connects the last entry of a directory
+	treeIndent string // continues a branch past a nested entry
+	treeBlank  string // indents below the last entry of a directory
+}
+
+var (
+	unicodeDecorations = decorations{"…", "->", "├── ", "└── ", "│   ", "    "}
+	asciiDecorations   = decorations{"...", "->", "|-- ", "`-- ", "|   ", "    "}
+)
+
+// deco is the decoration set in use; --ascii selects asciiDecorations
+var deco = unicodeDecorations
+
+// out buffers standard output; it must be flushed before exiting
+var out = bufio.NewWriter(stdoutWriter{})
+
 const (
 	BLOCKSIZE   = 512
 	MAX_WORKERS = 64
@@ -82,33 +218,95 @@ func main() {
 
 	// Check for --help flag
 	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
 		if arg == "--help" {
 			printHelp()
 			return
 		}
 	}
 
+	// Report EPIPE as a write error instead of dying from SIGPIPE
+	signal.Ignore(syscall.SIGPIPE)
+
+	files := parseArgs(args)
+
 	// Initialize worker pool
-	maxWorkers := min(MAX_WORKERS, runtime.NumCPU()*4)
+	maxWorkers := workerCount()
 	pool = pond.New(maxWorkers, maxWorkers*2)
 	defer pool.StopAndWait()
 
-	files := parseArgs(args)
+	// -k and --block-size take precedence over the environment
+	if opts.BlockSize == 0 && !opts.Kilobytes {
+		opts.BlockSize = envBlockSize()
+	}
+
+	if opts.GitRoot {
+		root, err := findGitRoot()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: --git-root: %v\n", err)
+			os.Exit(2)
+		}
+		files = []string{root}
+	}
 
 	if len(files) == 0 {
 		files = []string{"."}
 	}
 
+	// Paging needs a terminal to show pages on and one to read keys from
+	if opts.Page > 0 && isTerminal(os.Stdout) {
+		if tty, err := os.Open("/dev/tty"); err == nil {
+			defer tty.Close()
+			out = bufio.NewWriter(&pager{w: stdoutWriter{}, tty: tty})
+			opts.Progress = false
+		}
+	}
+
+	// Progress goes to stderr, and only when someone is watching it
+	if opts.Progress && isTerminal(os.Stderr) {
+		progress = startProgress()
+	}
+
+	if opts.Histogram && !opts.JSON {
+		histogram = &sizeHistogram{}
+	}
+
 	// Process files concurrently
 	processFiles(files)
+	progress.stop()
+	histogram.display(out)
+
+	if err := out.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "ls: write error: %v\n", err)
+		os.Exit(1)
+	}
+	if status := exitStatus.Load(); status != 0 {
+		os.Exit(int(status))
+	}
+}
+
+// stdoutWriter writes to standard output and exits quietly once the reading
+// end of a pipe has gone away, as in "ls | head".
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (n int, err error) {
+	progress.hidden(func() {
+		n, err = os.Stdout.Write(p)
+	})
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(0)
+	}
+	return n, err
 }
 
 func printHelp() {
-	fmt.Println(`NAME
+	fmt.Print(`NAME
      ls -- list directory contents
 
 SYNOPSIS
-     ls [-1AaCcdFfgHhikLlmnopqRrSsTtux] [file ...]
+     ls [-@1AabCcdFfGgHhikLlmnopQqRrSsTtUuvx] [-j N] [file ...]
 
 DESCRIPTION
      The ls utility lists information about files and directories. By default, it lists one entry per line to standard output.
@@ -116,18 +314,23 @@ DESCRIPTION
 OPTIONS
      The following options are available:
 
+     -@      In long format, list each extended attribute name and its size in bytes beneath its entry.
      -1      (The numeric digit "one".) Force output to be one entry per line.
      -A      List all entries except for '.' and '..'. Always set for the superuser.
      -a      Include directory entries whose names begin with a dot ('.').
+     -b      Write names with C escapes such as \n and \ooo, and spaces as '\ '.
      -C      Force multi-column output; this is the default when output is to a terminal.
      -c      Use time file's status was last changed instead of last modification time.
      -d      Directories are listed as plain files (not searched recursively).
-     -F      Display indicators after certain file types (*/=>@|).
+     -F      Display indicators after certain file types (*/=>@|%).
      -f      Output is not sorted. This option implies -a.
+     -G      Colorize names by file type when output is to a terminal; same as --color=auto.
      -g      List in long format as in -l, except that the owner is not printed.
      -H      Follow symbolic links specified on the command line.
      -h      When used with long format, use human-readable sizes.
      -i      For each file, print its inode number.
+     -j N    Use N workers to read file metadata and list directory operands;
+             1 does everything one at a time.
      -k      Modifies the -s option, causing sizes to be reported in kilobytes.
      -L      Follow symbolic links to show information about the linked-to file.
      -l      (The lowercase letter "ell".) List in long format.
@@ -135,6 +338,7 @@ OPTIONS
      -n      List in long format with numeric user and group IDs.
      -o      Include file flags in long format output.
      -p      Display a slash ('/') after each directory name.
+     -Q      Enclose names in double quotes, with C escapes such as \n and \ooo.
      -q      Force printing of non-graphic characters as '?'.
      -R      Recursively list subdirectories encountered.
      -r      Reverse the order of the sort.
@@ -142,9 +346,328 @@ OPTIONS
      -s      Display the number of file system blocks used by each file.
      -T      Display complete time information for the file.
      -t      Sort by time modified (most recent first).
+     -U      Use file's creation time instead of last modification time.
      -u      Use file's last access time instead of last modification time.
+     -v      Sort numbers within names by value, so file2 comes before file10.
      -x      Multi-column output sorted across rather than down.
 
+     --exclude-dir=NAME
+             With -R, do not descend into directories matching NAME (an exact
+             name or glob pattern). May be given more than once.
+
+     --mode-color
+             In long format, colorize the permission string. World-writable
+             permissions are shown in red.
+
+     --both-sizes
+             In long format, show the on-disk size (allocated blocks) next to
+             the apparent size.
+
+     --sort=WORD
+             Sort by WORD instead of name: name, name-length (shortest name
+             first), type (directories, symlinks, files, devices, then pipes
+             and sockets), size (largest first), time (newest first, honoring
+             -u and -c), mtime (newest modification first), depth (fewest
+             directories deep first, for --flatten), extension (the text after
+             the last dot), version (numbers within names compared by value,
+             so file2 comes before file10) or log (as --log-sort). Several
+             words separated by commas break ties in turn, e.g.
+             mtime,size,name. --sort=none leaves entries unsorted, as -f
+             does.
+
+     --ext-summary
+             After each directory listing, print the number of files and their
+             total size per extension, most common first.
+
+     --stat-cache-size=N
+             Remember at most N user and group names, evicting the least
+             recently used. Bounds memory on very large recursive listings.
+
+     --format=WORD
+             Select the output layout: long (-l), single-column (-1), across
+             (-x), commas (-m), vertical (-C), markdown for the long format
+             columns as a Markdown table, or fields for one line per file of
+             name, size, mode and modification time, joined by --separator.
+
+     --separator=STR
+             Join the fields of --format=fields with STR instead of a tab.
+             Where STR appears in a name it is written as \xHH escapes.
+
+     --quoting-style=WORD
+             Quote file names using style WORD: literal, shell (single
+             quotes when needed), shell-always, shell-escape (shell, with
+             $'\n' for control characters), c (as -Q) or escape (as -b).
+             The default is shell-escape on a terminal and literal
+             otherwise.
+
+     --user=NAME
+             List only entries owned by user NAME (a name or numeric uid).
+
+     --group=NAME
+             List only entries whose group is NAME (a name or numeric gid).
+
+     --perm=MODE
+             List only entries whose permission bits are exactly the octal
+             MODE. With -MODE all of the bits must be set, with /MODE any of
+             them, as in find -perm.
+
+     --show-control-chars
+             Print file names as-is, even on a terminal, overriding -q and
+             --quoting-style.
+
+     --wrap[=HOW]
+             In one-per-line output, fit names wider than the terminal by
+             wrapping them onto indented continuation lines (HOW=wrap, the
+             default) or cutting them short with an ellipsis (HOW=truncate).
+             In long format, a row that would overflow has its name moved to
+             an indented line below the metadata, or is cut short.
+
+     --print-realpath
+             Before listing, print each operand's fully resolved path to
+             standard error.
+
+     --fast-symlinks
+             Do not read symbolic link targets, so no "-> target" is shown.
+             Speeds up directories holding many links.
+
+     --ascii
+             Use only ASCII characters for decorations such as ellipses and
+             tree connectors.
+
+     --progress
+             While listing, show a running count of directories and files
+             scanned on standard error, if it is a terminal.
+
+     --sort-reverse-only-names
+             Reverse only the name order used to break ties, leaving the
+             primary sort key's direction as it is.
+
+     --color-depth=DEPTH
+             Assume the terminal shows DEPTH colors: 16, 256 or truecolor.
+             By default this is guessed from $COLORTERM and $TERM, and color
+             gradients are reduced to the closest available colors.
+
+     --since=DURATION
+             List only entries changed within DURATION (e.g. 90m, 36h, 2d,
+             1w), newest first. Honors -u and -c.
+
+     --stat-timeout=DURATION
+             Give up on reading an entry's metadata after DURATION (e.g.
+             500ms) and show '?' for its fields, so a stuck file cannot hang
+             the listing. Off by default.
+
+     --stat-retry=N
+             Try a failed stat up to N more times, pausing briefly before
+             each attempt, before reporting the error. Helps with transient
+             failures on network filesystems. Off (0) by default.
+
+     --unique-hardlinks
+             Show each hardlinked file once, under the first of its names,
+             noting how many names it has.
+
+     --match=TEXT, --imatch=TEXT
+             List only entries whose names contain TEXT, ignoring case with
+             --imatch. Entries matching any of several patterns are listed.
+
+     --link-color[=N]
+             In long format, highlight the link count of files with more than
+             N hard links (default 1). Directories are not highlighted.
+
+     --strict-width
+             In -C and -m output, never let a line exceed the terminal width,
+             shortening over-wide names with an ellipsis.
+
+     --json  Print the listing as a JSON array with an object per operand,
+             giving its name, path, size, mode (as rwx letters and in
+             octal), modification time, owner and group (as ids and names),
+             inode, file type and any symlink target. Directories hold
+             their entries in a "children" array, nested through every
+             level with -R; a directory that contains itself is marked with
+             "cycle": true instead of being descended.
+
+     --jobs=N
+             Same as -j N.
+
+     --zero  End each line of one-per-line and long format output with a
+             NUL byte instead of a newline, and print names unquoted. Implies
+             -1.
+
+     --no-concurrency
+             Read file metadata, directory operands and --head previews one
+             at a time without the worker pool or extra goroutines, for
+             debugging and profiling.
+
+     --emit-errors-json
+             With --json, report operands and directories that could not be
+             read in the output instead of on stderr: the listing becomes
+             an object with the usual array under "files" and an "errors"
+             array of objects holding each "path" and "message".
+
+     --relative-time-threshold=DURATION
+             In long format, show times within DURATION (e.g. 12h, 2d) as
+             relative ages such as "3h ago", and older times as dates.
+
+     --nulls-last
+             Sort entries whose metadata could not be read after all others,
+             regardless of -r.
+
+     --xattr-values
+             In long format, list each extended attribute beneath its entry
+             with a preview of the value; binary bytes are shown as \xHH and
+             long values are cut short with an ellipsis.
+
+     --log-sort
+             Sort rotated logs after the file they were rotated from and in
+             numeric order, so app.log comes before app.log.1, app.log.2 and
+             app.log.10.
+
+     --no-symlink-arrow
+             Leave out the "-> target" that follows symbolic links; they
+             are still marked by the l file type and the @ indicator.
+
+     --block-size=SIZE
+             Count blocks for -s and the long format "total" line in units
+             of SIZE bytes, such as 1024, 1K, M or 1MB; K, M and G are
+             powers of 1024 and KB, MB and GB powers of 1000. Overrides -k.
+             Without it the BLOCK_SIZE and BLOCKSIZE environment variables
+             are consulted.
+
+     --head=N
+             In long format, show the first N bytes of each regular file
+             beneath its entry; bytes that are not printable text are shown
+             as \xHH and longer files end in an ellipsis.
+
+     --skip-empty-headers
+             With -R, print a subdirectory's "DIR:" header only when it has
+             entries to show. Empty directories are still descended into.
+
+     --histogram
+             After the listing, print a bar chart counting files by size:
+             under 1K, 1K-1M, 1M-1G and over 1G. With -R the counts cover
+             the whole tree.
+
+     --time-resolution=UNIT
+             Compare timestamps only to the given UNIT (ns, us, ms or s) when
+             sorting by time, so files modified within the same UNIT are
+             ordered by name. Timestamps keep the full precision the
+             filesystem records by default.
+
+     --preserve-arg-order
+             List directory operands in the order they were given on the
+             command line instead of sorting them.
+
+     --perm-style=STYLE
+             Show permissions in long format as STYLE: symbolic (rwxr-xr-x,
+             the default), octal (0755, including setuid, setgid and sticky
+             bits) or both (0755 (rwxr-xr-x)).
+
+     --time-color
+             In long format, color each time by its age, from bright for
+             files changed in the last minutes to dim for those untouched
+             for a year or more. Colors follow --color-depth.
+
+     --git-root
+             List the top directory of the git work tree containing the
+             current directory, in place of any operands.
+
+     --page=N
+             When output is a terminal, pause after every N lines until a key
+             is pressed: space for the next page, return for the next line,
+             q to stop. Ignored when output is piped.
+
+     --flatten
+             List everything beneath each directory operand as a single list
+             of relative paths, descending as -R does. Combine with
+             --sort=depth to show shallow entries before nested ones.
+
+     --si    Like -h, but in powers of 1000 with the suffixes kB, MB, GB and
+             so on. Takes precedence over -h.
+
+     --precision=N
+             With -h or --si, show sizes with N decimal places (0 for 2K, 2
+             for 1.50K) instead of one decimal for single-digit values only.
+
+     --color[=WHEN]
+             Colorize names by file type: always (the default without WHEN),
+             auto (only when output is to a terminal) or never. Colors are
+             taken from LS_COLORS when it is set. A non-empty NO_COLOR
+             turns off this and every other kind of coloring.
+
+     --full-time
+             List in long format with times to the nanosecond and with
+             their UTC offset, as 2006-01-02 15:04:05.123456789 -0700.
+
+     --time-style=STYLE
+             Show long format times in STYLE: full-iso (as --full-time),
+             long-iso (2006-01-02 15:04), iso (01-02 15:04 for recent
+             files, 2006-01-02 for older ones), locale (the default, Jan 2
+             15:04 or Jan 2 2006) or +FORMAT. FORMAT is either strftime(3)
+             directives such as %Y %H:%M:%S.%N or, without any %, a Go time
+             layout such as 2006-01-02.
+
+     --time=WORD
+             Show and sort by another time than the modification time (mtime
+             or modification): atime, access or use (as -u), ctime or status
+             (as -c), or birth or creation (as -U). Files whose creation
+             time the system does not record show '-' and sort as oldest.
+
+     --icons Put a file type or extension icon before each name in the
+             one-per-line, column and long formats. The icons are Nerd Font
+             glyphs, so the terminal needs a Nerd Font to show them.
+
+     --indicators=LIST
+             Like -F, but mark only the categories in the comma-separated
+             LIST: d (directories, /), l (symlinks, @), x (executables, *),
+             p (pipes, |), s (sockets, =) and w (whiteouts, %).
+
+     --align-right
+             In long format, right-align names to the widest one. Symlink
+             targets follow the name unpadded.
+
+     --hardlink-summary
+             After each directory listing, print how many files are listed
+             under more than one name and the space saved by sharing them.
+
+     --portable-dates
+             In long format, show dates with numeric months, as MM-DD HH:MM
+             for recent files and MM-DD YYYY for older ones, instead of month
+             names.
+
+     --tree  Show each directory operand and everything beneath it as an
+             indented tree. Directories stay in the tree even when filters
+             such as --match leave them out, so matches keep their place.
+
+     --tree-depth=N
+             In --tree output, show at most N levels below each operand.
+
+     --collapse
+             In --tree output, draw a chain of directories that each contain
+             only one subdirectory on a single line, as a/b/c.
+
+     --directory-base=PATH
+             Resolve relative operands, including the default ".", against
+             PATH instead of the current directory.
+
+     --group-directories-first
+             List directories before other files. Each group is still sorted
+             by the selected key, and -r does not move directories last.
+
+     --inode-generation
+             With -i, show each inode number as INODE.GEN, where GEN is the
+             inode generation number on filesystems that expose it (such as
+             ext4 on Linux). Other files show the inode number alone.
+
+     --recurse-symlink-args
+             With -R, descend into directories named through symlinks on the
+             command line. Symlinks met during the walk are not followed
+             unless -L is given.
+
+     --all, --almost-all, --directory, --classify, --human-readable,
+     --inode, --kibibytes, --dereference, --dereference-command-line,
+     --numeric-uid-gid, --hide-control-chars, --recursive, --reverse, --size
+             Long forms of -a, -A, -d, -F, -h, -i, -k, -L, -H, -n, -q, -R, -r
+             and -s.
+
      --help  Display this help message and exit.
 
 EXAMPLES
@@ -167,83 +690,100 @@ func parseArgs(args []string) []string {
 
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
-		if !strings.HasPrefix(arg, "-") {
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
 			files = append(files, arg)
 			continue
 		}
 
-		// Handle combined flags like -la
-		flags := arg[1:]
-		for _, flag := range flags {
-			switch flag {
-			case '1':
-				opts.One = true
-			case 'a':
-				opts.All = true
-			case 'A':
-				opts.AlmostAll = true
-			case 'C':
-				opts.Columns = true
-			case 'c':
-				opts.ChangeTime = true
-			case 'd':
-				opts.Directory = true
-			case 'F':
-				opts.Classify = true
-			case 'f':
-				opts.NoSort = true
-				opts.All = true // -f implies -a
-			case 'g':
-				opts.GroupFormat = true
-				opts.LongFormat = true
-			case 'H':
-				opts.NoFollow = true
-			case 'h':
-				opts.Human = true
-			case 'i':
-				opts.Inode = true
-			case 'k':
-				opts.Kilobytes = true
-			case 'L':
-				opts.Follow = true
-			case 'l':
-				opts.LongFormat = true
-			case 'm':
-				opts.Stream = true
-			case 'n':
-				opts.NumericFormat = true
-				opts.LongFormat = true
-			case 'o':
-				opts.Flags = true
-			case 'p':
-				opts.Slash = true
-			case 'q':
-				opts.Quote = true
-			case 'R':
-				opts.Recursive = true
-			case 'r':
-				opts.Reverse = true
-			case 'S':
-				opts.SizeSort = true
-			case 's':
-				opts.Blocks = true
-			case 'T':
-				opts.FullTime = true
-			case 't':
-				opts.TimeSort = true
-			case 'u':
-				opts.AccessTime = true
-			case 'x':
-				opts.Comma = true
+		// Everything after "--" is a file, even if it starts with a dash
+		if arg == "--" {
+			files = append(files, args[i+1:]...)
+			break
+		}
+
+		if strings.HasPrefix(arg, "--") {
+			option := arg[2:]
+			if valueOptions[option] {
+				if i+1 == len(args) {
+					fmt.Fprintf(os.Stderr, "ls: option '--%s' requires an argument\n", option)
+					fmt.Fprintln(os.Stderr, "Try 'ls --help' for more information.")
+					os.Exit(2)
+				}
+				i++
+				option += "=" + args[i]
+			}
+			parseLongOption(option)
+			continue
+		}
+
+		// Handle combined flags like -la. -j takes the rest of the
+		// argument, or the next one, as its count.
+		for j, flag := range arg[1:] {
+			if flag != 'j' {
+				parseShortFlag(flag)
+				continue
+			}
+			value := arg[j+2:]
+			if value == "" {
+				if i+1 == len(args) {
+					fmt.Fprintln(os.Stderr, "ls: option requires an argument -- 'j'")
+					fmt.Fprintln(os.Stderr, "Try 'ls --help' for more information.")
+					os.Exit(2)
+				}
+				i++
+				value = args[i]
 			}
+			setJobs(value)
+			break
 		}
 	}
 
-	// Handle conflicting options
-	if opts.LongFormat {
-		opts.GroupFormat = opts.GroupFormat // -l overrides -g
+	// -d lists directories as themselves, so there is nothing for -R to
+	// descend into
+	if opts.Directory {
+		opts.Recursive = false
+	}
+
+	// NO_COLOR (https://no-color.org) turns every kind of coloring off,
+	// whatever the options asked for
+	if os.Getenv("NO_COLOR") != "" {
+		opts.Color = false
+		opts.ModeColor = false
+		opts.TimeColor = false
+		opts.LinkColor = 0
+	}
+
+	if opts.Color {
+		loadLSColors()
+	}
+
+	if opts.Separator == "" {
+		opts.Separator = "\t"
+	}
+
+	// --zero writes names for programs, one per NUL-terminated line
+	if opts.Zero {
+		opts.One = true
+		opts.Stream = false
+		opts.Wrap = ""
+		opts.QuotingStyle = QuoteLiteral
+	}
+
+	opts.Width = terminalWidth()
+	if opts.ColorDepth == colorDepthAuto {
+		opts.ColorDepth = detectColorDepth()
+	}
+
+	// Like GNU ls, quote names that need it only when a person is reading
+	if opts.QuotingStyle == "" {
+		if isTerminal(os.Stdout) {
+			opts.QuotingStyle = QuoteShellEscape
+		} else {
+			opts.QuotingStyle = QuoteLiteral
+		}
 	}
 
+	// Handle conflicting options
 	if opts.NoSort {
 		opts.TimeSort = false
 		opts.SizeSort = false
@@ -252,17 +792,513 @@ func parseArgs(args []string) []string {
 	return files
 }
 
+// parseShortFlag applies a single-letter option
+func parseShortFlag(flag rune) {
+	switch flag {
+	case '1':
+		opts.One = true
+	case 'a':
+		opts.All = true
+	case 'A':
+		opts.AlmostAll = true
+	case 'C':
+		opts.Columns = true
+	case 'c':
+		opts.ChangeTime = true
+	case 'd':
+		opts.Directory = true
+	case 'F':
+		opts.Classify = true
+	case 'f':
+		opts.NoSort = true
+		opts.All = true // -f implies -a
+	case 'g':
+		opts.GroupFormat = true
+		opts.LongFormat = true
+	case 'G':
+		opts.Color = isTerminal(os.Stdout)
+	case 'H':
+		opts.FollowArgs = true
+	case 'h':
+		opts.Human = true
+	case 'i':
+		opts.Inode = true
+	case 'k':
+		opts.Kilobytes = true
+	case 'L':
+		opts.Follow = true
+	case 'l':
+		opts.LongFormat = true
+	case 'm':
+		opts.Stream = true
+	case 'n':
+		opts.NumericFormat = true
+		opts.LongFormat = true
+	case 'o':
+		opts.Flags = true
+	case 'p':
+		opts.Slash = true
+	case 'b':
+		opts.QuotingStyle = QuoteEscape
+	case 'Q':
+		opts.QuotingStyle = QuoteC
+	case 'q':
+		opts.Quote = true
+	case 'R':
+		opts.Recursive = true
+	case 'r':
+		opts.Reverse = true
+	case 'S':
+		opts.SizeSort = true
+	case 's':
+		opts.Blocks = true
+	case 'T':
+		opts.FullTime = true
+	case 't':
+		opts.TimeSort = true
+	case '@':
+		opts.XattrNames = true
+	case 'U':
+		opts.BirthTime = true
+	case 'u':
+		opts.AccessTime = true
+	case 'v':
+		opts.VersionSort = true
+	case 'x':
+		opts.Comma = true
+	default:
+		fmt.Fprintf(os.Stderr, "ls: invalid option -- '%c'\n", flag)
+		fmt.Fprintln(os.Stderr, "Try 'ls --help' for more information.")
+		os.Exit(2)
+	}
+}
+
+// valueOptions are the long options that cannot go without a value. When
+// none is attached with "=", as in --sort size, the next argument is it.
+var valueOptions = map[string]bool{
+	"block-size":              true,
+	"color-depth":             true,
+	"directory-base":          true,
+	"exclude-dir":             true,
+	"format":                  true,
+	"group":                   true,
+	"head":                    true,
+	"imatch":                  true,
+	"indicators":              true,
+	"jobs":                    true,
+	"match":                   true,
+	"page":                    true,
+	"perm":                    true,
+	"perm-style":              true,
+	"precision":               true,
+	"quoting-style":           true,
+	"relative-time-threshold": true,
+	"separator":               true,
+	"since":                   true,
+	"sort":                    true,
+	"stat-cache-size":         true,
+	"stat-retry":              true,
+	"stat-timeout":            true,
+	"time":                    true,
+	"time-resolution":         true,
+	"time-style":              true,
+	"tree-depth":              true,
+	"user":                    true,
+}
+
+// longFlags maps GNU long options without arguments to the single-letter
+// options they stand for
+var longFlags = map[string]rune{
+	"all":                      'a',
+	"almost-all":               'A',
+	"directory":                'd',
+	"classify":                 'F',
+	"dereference-command-line": 'H',
+	"human-readable":           'h',
+	"inode":                    'i',
+	"kibibytes":                'k',
+	"dereference":              'L',
+	"numeric-uid-gid":          'n',
+	"hide-control-chars":       'q',
+	"quote-name":               'Q',
+	"escape":                   'b',
+	"recursive":                'R',
+	"reverse":                  'r',
+	"size":                     's',
+}
+
+func parseLongOption(option string) {
+	name, value, _ := strings.Cut(option, "=")
+
+	switch name {
+	case "color":
+		switch value {
+		case "", "always":
+			opts.Color = true
+		case "auto":
+			opts.Color = isTerminal(os.Stdout)
+		case "never":
+			opts.Color = false
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--color'\n", value)
+			os.Exit(2)
+		}
+	case "color-depth":
+		depth, ok := parseColorDepth(value)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--color-depth'\n", value)
+			os.Exit(2)
+		}
+		opts.ColorDepth = depth
+	case "exclude-dir":
+		opts.ExcludeDirs = append(opts.ExcludeDirs, value)
+	case "json":
+		opts.JSON = true
+	case "link-color":
+		threshold := uint64(1)
+		if value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || n == 0 {
+				fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--link-color'\n", value)
+				os.Exit(2)
+			}
+			threshold = n
+		}
+		opts.LinkColor = threshold
+	case "match":
+		opts.Match = append(opts.Match, value)
+	case "imatch":
+		opts.IMatch = append(opts.IMatch, strings.ToLower(value))
+	case "mode-color":
+		opts.ModeColor = true
+	case "ascii":
+		opts.ASCII = true
+		deco = asciiDecorations
+	case "both-sizes":
+		opts.BothSizes = true
+	case "ext-summary":
+		opts.ExtSummary = true
+	case "fast-symlinks":
+		opts.FastSymlinks = true
+	case "format":
+		switch value {
+		case "long":
+			opts.LongFormat = true
+		case "single-column":
+			opts.One = true
+		case "across":
+			opts.Comma = true
+		case "commas":
+			opts.Stream = true
+		case "vertical":
+			opts.Columns = true
+		case "markdown":
+			opts.Markdown = true
+		case "fields":
+			opts.Fields = true
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--format'\n", value)
+			os.Exit(2)
+		}
+	case "unique-hardlinks":
+		opts.UniqueHardlinks = true
+	case "user":
+		uid, err := lookupUserId(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: invalid user: '%s'\n", value)
+			os.Exit(2)
+		}
+		opts.OwnerUid = &uid
+	case "group":
+		gid, err := lookupGroupId(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: invalid group: '%s'\n", value)
+			os.Exit(2)
+		}
+		opts.OwnerGid = &gid
+	case "nulls-last":
+		opts.NullsLast = true
+	case "xattr-values":
+		opts.XattrValues = true
+	case "skip-empty-headers":
+		opts.SkipEmptyHeaders = true
+	case "histogram":
+		opts.Histogram = true
+	case "time-resolution":
+		resolution, ok := timeResolutions[value]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--time-resolution'\n", value)
+			os.Exit(2)
+		}
+		opts.TimeResolution = resolution
+	case "preserve-arg-order":
+		opts.PreserveArgs = true
+	case "time-color":
+		opts.TimeColor = true
+	case "git-root":
+		opts.GitRoot = true
+	case "precision":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 9 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--precision'\n", value)
+			os.Exit(2)
+		}
+		opts.Precision = &n
+	case "indicators":
+		var letters strings.Builder
+		for _, category := range strings.Split(value, ",") {
+			if len(category) != 1 || !strings.Contains(indicatorCategories, category) {
+				fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--indicators'\n", value)
+				os.Exit(2)
+			}
+			letters.WriteString(category)
+		}
+		opts.Indicators = letters.String()
+		opts.Classify = true
+	case "align-right":
+		opts.AlignRight = true
+	case "hardlink-summary":
+		opts.HardlinkSummary = true
+	case "portable-dates":
+		opts.PortableDates = true
+	case "recurse-symlink-args":
+		opts.RecurseSymlinkArgs = true
+	case "separator":
+		opts.Separator = value
+	case "inode-generation":
+		opts.InodeGeneration = true
+	case "group-directories-first":
+		opts.DirsFirst = true
+	case "directory-base":
+		opts.DirectoryBase = value
+	case "tree":
+		opts.Tree = true
+	case "tree-depth":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--tree-depth'\n", value)
+			os.Exit(2)
+		}
+		opts.TreeDepth = n
+	case "collapse":
+		opts.Collapse = true
+	case "flatten":
+		opts.Flatten = true
+	case "full-time":
+		opts.TimeStyle = TimeStyleFullISO
+		opts.LongFormat = true
+	case "time-style":
+		if !validTimeStyle(value) {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--time-style'\n", value)
+			os.Exit(2)
+		}
+		opts.TimeStyle = value
+	case "time":
+		opts.AccessTime, opts.ChangeTime, opts.BirthTime = false, false, false
+		switch value {
+		case "mtime", "modification":
+		case "atime", "access", "use":
+			opts.AccessTime = true
+		case "ctime", "status":
+			opts.ChangeTime = true
+		case "birth", "creation":
+			opts.BirthTime = true
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--time'\n", value)
+			os.Exit(2)
+		}
+	case "icons":
+		opts.Icons = true
+	case "zero":
+		opts.Zero = true
+	case "no-concurrency":
+		opts.NoConcurrency = true
+	case "jobs":
+		setJobs(value)
+	case "emit-errors-json":
+		opts.EmitErrorsJSON = true
+	case "si":
+		opts.SI = true
+	case "log-sort":
+		opts.LogSort = true
+	case "no-symlink-arrow":
+		opts.NoSymlinkArrow = true
+	case "block-size":
+		size, ok := parseBlockSize(value)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--block-size'\n", value)
+			os.Exit(2)
+		}
+		opts.BlockSize = size
+	case "head":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--head'\n", value)
+			os.Exit(2)
+		}
+		opts.Head = n
+	case "page":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--page'\n", value)
+			os.Exit(2)
+		}
+		opts.Page = n
+	case "perm-style":
+		switch value {
+		case PermSymbolic, PermOctal, PermBoth:
+			opts.PermStyle = value
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--perm-style'\n", value)
+			os.Exit(2)
+		}
+	case "perm":
+		filter, err := parsePermFilter(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: invalid mode: '%s'\n", value)
+			os.Exit(2)
+		}
+		opts.Perm = filter
+	case "print-realpath":
+		opts.PrintRealpath = true
+	case "progress":
+		opts.Progress = true
+	case "quoting-style":
+		switch value {
+		case QuoteLiteral, QuoteShell, QuoteShellAlways, QuoteShellEscape, QuoteC, QuoteEscape:
+			opts.QuotingStyle = value
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--quoting-style'\n", value)
+			os.Exit(2)
+		}
+	case "strict-width":
+		opts.StrictWidth = true
+	case "relative-time-threshold":
+		threshold, err := parseAge(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--relative-time-threshold'\n", value)
+			os.Exit(2)
+		}
+		opts.RelativeTime = threshold
+	case "show-control-chars":
+		opts.ShowControl = true
+	case "wrap":
+		switch value {
+		case "":
+			opts.Wrap = "wrap"
+		case "wrap", "truncate":
+			opts.Wrap = value
+		default:
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--wrap'\n", value)
+			os.Exit(2)
+		}
+	case "sort-reverse-only-names":
+		opts.ReverseNames = true
+	case "stat-timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--stat-timeout'\n", value)
+			os.Exit(2)
+		}
+		opts.StatTimeout = timeout
+	case "stat-retry":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--stat-retry'\n", value)
+			os.Exit(2)
+		}
+		opts.StatRetry = n
+	case "stat-cache-size":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--stat-cache-size'\n", value)
+			os.Exit(2)
+		}
+		opts.StatCacheSize = n
+		userCache.limit = n
+		groupCache.limit = n
+	case "since":
+		age, err := parseAge(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--since'\n", value)
+			os.Exit(2)
+		}
+		opts.NewerThan = time.Now().Add(-age)
+		opts.TimeSort = true
+	case "sort":
+		if value == "none" {
+			opts.NoSort = true
+			break
+		}
+		keys := strings.Split(value, ",")
+		for _, key := range keys {
+			if _, ok := sortComparators[key]; !ok {
+				fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--sort'\n", value)
+				os.Exit(2)
+			}
+		}
+		opts.Sort = keys
+	default:
+		flag, ok := longFlags[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "ls: unrecognized option '--%s'\n", name)
+			fmt.Fprintln(os.Stderr, "Try 'ls --help' for more information.")
+			os.Exit(2)
+		}
+		if value != "" {
+			fmt.Fprintf(os.Stderr, "ls: option '--%s' doesn't allow an argument\n", name)
+			os.Exit(2)
+		}
+		parseShortFlag(flag)
+	}
+}
+
+// workerCount returns the size of the worker pool: -j N when given, else
+// four workers per CPU up to MAX_WORKERS
+func workerCount() int {
+	if opts.Jobs > 0 {
+		return opts.Jobs
+	}
+	return min(MAX_WORKERS, runtime.NumCPU()*4)
+}
+
+// setJobs sets the worker count of -j and --jobs
+func setJobs(value string) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		fmt.Fprintf(os.Stderr, "ls: invalid argument '%s' for '--jobs'\n", value)
+		os.Exit(2)
+	}
+	opts.Jobs = n
+}
+
 func processFiles(files []string) {
 	var dirs, nonDirs []FileInfo
 
 	// Separate directories from non-directories
 	for _, file := range files {
-		info, err := getFileInfo(file)
+		if opts.DirectoryBase != "" && !filepath.IsAbs(file) {
+			file = filepath.Join(opts.DirectoryBase, file)
+		}
+		if opts.PrintRealpath {
+			printRealpath(file)
+		}
+
+		info, err := getFileInfo(file, opts.Follow || opts.FollowArgs)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ls: %s: %v\n", file, err)
+			reportError(file, err)
+			raiseExitStatus(exitSerious)
 			continue
 		}
 
+		// --recurse-symlink-args lets -R walk a directory reached through a
+		// symlinked operand; links inside it are still left alone
+		if info.IsSymlink && opts.Recursive && opts.RecurseSymlinkArgs {
+			if target, err := getFileInfo(file, true); err == nil && target.IsDir {
+				info = target
+			}
+		}
+
 		if info.IsDir && !opts.Directory {
 			dirs = append(dirs, *info)
 		} else {
@@ -270,51 +1306,289 @@ func processFiles(files []string) {
 		}
 	}
 
+	if opts.JSON {
+		displayJSON(out, nonDirs, dirs)
+		return
+	}
+
 	// Sort and display non-directories first
 	if len(nonDirs) > 0 {
 		sortFiles(nonDirs)
-		displayFiles(nonDirs, "")
+		if opts.UniqueHardlinks {
+			nonDirs = collapseHardlinks(nonDirs)
+		}
+		displayFiles(out, nonDirs, "")
+		if opts.HardlinkSummary {
+			displayHardlinkSummary(out, nonDirs)
+		}
+		histogram.add(nonDirs)
+	}
+
+	// Process directories concurrently, at most workerCount at a time. The
+	// coordinator lets the operand at the head of the queue write straight
+	// through to out and buffers the ones behind it until their turn.
+	// Nothing written to standard output depends on scheduling: sequence
+	// numbers are reserved in operand order, and readDirFast keeps each
+	// stat result at its entry's index, so repeated runs over an unchanged
+	// tree produce identical bytes.
+	if !opts.PreserveArgs {
+		sortFiles(dirs)
+	}
+	// With a single worker, or under --no-concurrency, each operand is
+	// listed in turn on this goroutine
+	if opts.NoConcurrency || workerCount() == 1 {
+		for i, dir := range dirs {
+			listOperand(out, dir, i > 0 || len(nonDirs) > 0, len(files) > 1)
+		}
+		return
 	}
 
-	// Process directories
-	sortFiles(dirs)
+	coordinator := newOutputCoordinator(out)
+	slots := make(chan struct{}, workerCount())
+	var wg sync.WaitGroup
 	for i, dir := range dirs {
-		if len(files) > 1 || opts.Recursive {
-			if i > 0 || len(nonDirs) > 0 {
-				fmt.Println()
-			}
-			fmt.Printf("%s:\n", dir.Name)
+		w := coordinator.reserve()
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, dir FileInfo) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			listOperand(w, dir, i > 0 || len(nonDirs) > 0, len(files) > 1)
+			coordinator.complete(w)
+		}(i, dir)
+	}
+	wg.Wait()
+}
+
+// listOperand lists the directory operand dir to w, preceded by a blank
+// line when separate is set and by a "dir:" header when there are several
+// operands or -R is on
+func listOperand(w io.Writer, dir FileInfo, separate, several bool) {
+	if opts.Tree {
+		// The tree's root line names the operand
+		if separate {
+			fmt.Fprintln(w)
+		}
+	} else if several || opts.Recursive {
+		if separate {
+			writeLine(w, "")
+		}
+		writeLine(w, dir.Name+":")
+	}
+	if opts.Tree {
+		processTree(w, dir)
+	} else if opts.Flatten {
+		processFlat(w, dir)
+	} else {
+		visited := map[fileID]bool{{dir.Dev, dir.Inode}: true}
+		processRecursive(w, processDirectory(w, dir.Name), visited)
+	}
+}
+
+// printRealpath reports on stderr what an operand resolves to once every
+// symlink and relative component has been followed. Operands that cannot be
+// resolved are left for the listing itself to report.
+func printRealpath(path string) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s -> %s\n", path, resolved)
+}
+
+// findGitRoot walks up from the current directory to the nearest one
+// holding a .git entry, which is a directory in a plain clone and a file in
+// worktrees and submodules
+func findGitRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		var stat syscall.Stat_t
+		if err := fsys.Lstat(filepath.Join(dir, ".git"), &stat); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("not inside a git work tree")
 		}
-		processDirectory(dir.Name)
+		dir = parent
+	}
+}
+
+// outputCoordinator keeps the output of concurrently processed directories
+// in order. Each directory reserves an orderedWriter up front. The writer
+// at the head of the queue writes straight to w; the others buffer until
+// every earlier writer has completed, so output never interleaves and only
+// directories still waiting their turn are held in memory.
+type outputCoordinator struct {
+	mu      sync.Mutex
+	w       io.Writer
+	seq     int // next sequence number to hand out
+	next    int // sequence number of the writer at the head
+	waiting map[int]*orderedWriter
+}
+
+// orderedWriter is one directory's share of an outputCoordinator
+type orderedWriter struct {
+	c    *outputCoordinator
+	seq  int
+	buf  bytes.Buffer
+	done bool
+}
 
-		if opts.Recursive {
-			processRecursive(dir.Name)
+func newOutputCoordinator(w io.Writer) *outputCoordinator {
+	return &outputCoordinator{
+		w:       w,
+		waiting: make(map[int]*orderedWriter),
+	}
+}
+
+// reserve returns the writer for the next piece of output
+func (c *outputCoordinator) reserve() *orderedWriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ow := &orderedWriter{c: c, seq: c.seq}
+	c.waiting[ow.seq] = ow
+	c.seq++
+	return ow
+}
+
+// Write passes p through to the coordinator's writer when ow is at the
+// head of the queue, and buffers it otherwise
+func (ow *orderedWriter) Write(p []byte) (int, error) {
+	c := ow.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ow.seq == c.next {
+		return c.w.Write(p)
+	}
+	return ow.buf.Write(p)
+}
+
+// complete marks the output of ow finished. When ow is at the head, the
+// head moves on: completed writers behind it are written out, and the
+// first one still running has what it buffered so far written and then
+// writes straight through.
+func (c *outputCoordinator) complete(ow *orderedWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ow.done = true
+	for {
+		head, ok := c.waiting[c.next]
+		if !ok {
+			return
+		}
+		head.buf.WriteTo(c.w)
+		if !head.done {
+			return
 		}
+		delete(c.waiting, c.next)
+		c.next++
 	}
 }
 
-func processDirectory(dirPath string) {
+// processDirectory lists dirPath and, with -R, returns the subdirectories to
+// descend into, named by their full paths and keeping the device and inode
+// that -R uses to spot loops. The directory's other entries are released
+// before recursing, keeping one directory resident at a time.
+func processDirectory(w io.Writer, dirPath string) []FileInfo {
+	filtered, subdirs := readDirectory(dirPath)
+	listDirectory(w, dirPath, filtered)
+	return subdirs
+}
+
+// readDirectory reads dirPath and returns the entries its listing shows and,
+// with -R, the subdirectories to descend into as processDirectory does
+func readDirectory(dirPath string) (filtered, subdirs []FileInfo) {
 	entries, err := readDirFast(dirPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ls: %s: %v\n", dirPath, err)
-		return
+		reportError(dirPath, err)
+		return nil, nil
 	}
+	progress.addDirectory(len(entries))
+
+	sortFiles(entries)
 
 	// Filter entries
-	var filtered []FileInfo
 	for _, entry := range entries {
-		if shouldSkipEntry(entry.Name) {
+		if shouldSkipEntry(entry) || !matchesFilters(entry) {
 			continue
 		}
 		filtered = append(filtered, entry)
 	}
 
-	sortFiles(filtered)
-	displayFiles(filtered, dirPath)
+	if opts.UniqueHardlinks {
+		filtered = collapseHardlinks(filtered)
+	}
+
+	if !opts.Recursive {
+		return filtered, nil
+	}
+
+	// Descend into every visible directory, even those hidden by the
+	// ownership filter, since their contents may still match
+	for _, entry := range entries {
+		if !entry.IsDir || entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		if shouldSkipEntry(entry) {
+			continue
+		}
+		if isExcludedDir(entry.Name) {
+			continue
+		}
+		entry.Name = filepath.Join(dirPath, entry.Name)
+		subdirs = append(subdirs, entry)
+	}
+	return filtered, subdirs
+}
+
+// listDirectory writes the listing of the entries read from dirPath,
+// followed by the footers that summarize them
+func listDirectory(w io.Writer, dirPath string, files []FileInfo) {
+	displayFiles(w, files, dirPath)
+
+	if opts.ExtSummary {
+		displayExtSummary(w, files)
+	}
+	if opts.HardlinkSummary {
+		displayHardlinkSummary(w, files)
+	}
+	histogram.add(files)
+}
+
+// forEach calls fn with each index below n, concurrently through the pool
+// or, under --no-concurrency or -j 1, one after another, and returns once
+// every call has finished
+func forEach(n int, fn func(i int)) {
+	if opts.NoConcurrency || workerCount() == 1 {
+		for i := range n {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		pool.Submit(func() {
+			defer wg.Done()
+			fn(i)
+		})
+	}
+	wg.Wait()
 }
 
 func readDirFast(dirPath string) ([]FileInfo, error) {
-	file, err := os.Open(dirPath)
+	file, err := fsys.OpenDir(dirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -325,64 +1599,153 @@ func readDirFast(dirPath string) ([]FileInfo, error) {
 	var allEntries []FileInfo
 
 	for {
-		entries, err := file.Readdir(batchSize)
-		if err != nil {
-			if len(entries) == 0 {
-				break
-			}
+		entries, err := file.ReadDir(batchSize)
+		if err != nil && err != io.EOF {
+			return nil, err
 		}
-
 		if len(entries) == 0 {
 			break
 		}
 
-		// Process entries concurrently
-		infoChan := make(chan FileInfo, len(entries))
+		// Process entries concurrently, each into its own slot so the
+		// directory's own order survives for -f and the result never
+		// depends on which stat finishes first
+		infos := make([]*FileInfo, len(entries))
+		forEach(len(entries), func(i int) {
+			infos[i] = statEntry(dirPath, entries[i])
+		})
+
+		// Collect results, dropping entries removed since the directory was read
+		for _, info := range infos {
+			if info != nil {
+				allEntries = append(allEntries, *info)
+			}
+		}
 
-		for _, entry := range entries {
-			pool.Submit(func(entry fs.FileInfo) func() {
-				return func() {
-					fullPath := filepath.Join(dirPath, entry.Name())
-					info := convertFileInfo(entry, fullPath)
-					infoChan <- *info
-				}
-			}(entry))
+		if err == io.EOF {
+			break
 		}
+	}
 
-		// Collect results
-		for i := 0; i < len(entries); i++ {
-			allEntries = append(allEntries, <-infoChan)
+	return allEntries, nil
+}
+
+// timedStats tracks the stats started under --stat-timeout, which keep
+// running after statEntry gives up on them
+var timedStats sync.WaitGroup
+
+// statEntry gathers the metadata of a directory entry. With --stat-timeout
+// it gives up on a stat that takes too long, as can happen with magic files
+// under /proc or on a hung mount, and returns a placeholder entry so the
+// rest of the listing isn't held up. It returns nil if the entry is gone.
+func statEntry(dirPath string, entry fs.DirEntry) *FileInfo {
+	fullPath := filepath.Join(dirPath, entry.Name())
+	stat := func() (info *FileInfo) {
+		// A panic while describing one entry, such as over an unexpected
+		// Sys() type, leaves that entry unknown instead of ending the
+		// whole listing
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Fprintf(os.Stderr, "ls: %s: %v\n", fullPath, r)
+				info = unknownFileInfo(entry)
+			}
+		}()
+
+		// -L describes what a link points to; dangling links are shown
+		// as themselves
+		if opts.Follow && entry.Type()&fs.ModeSymlink != 0 {
+			if info, err := getFileInfo(fullPath, true); err == nil {
+				info.Name = entry.Name()
+				return info
+			}
 		}
 
+		fi, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
 		if err != nil {
-			break
+			return unknownFileInfo(entry)
 		}
+		return convertFileInfo(fi, fullPath)
 	}
 
-	return allEntries, nil
+	if opts.StatTimeout <= 0 {
+		return stat()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.StatTimeout)
+	defer cancel()
+
+	result := make(chan *FileInfo, 1)
+	timedStats.Add(1)
+	go func() {
+		defer timedStats.Done()
+		result <- stat()
+	}()
+
+	select {
+	case info := <-result:
+		return info
+	case <-ctx.Done():
+		fmt.Fprintf(os.Stderr, "ls: %s: stat timed out\n", fullPath)
+		return unknownFileInfo(entry)
+	}
 }
 
-func getFileInfo(path string) (*FileInfo, error) {
-	var stat syscall.Stat_t
-	var err error
+// unknownFileInfo describes an entry whose metadata could not be read
+func unknownFileInfo(entry fs.DirEntry) *FileInfo {
+	return &FileInfo{
+		Name:       entry.Name(),
+		Mode:       entry.Type(),
+		IsDir:      entry.IsDir(),
+		IsSymlink:  entry.Type()&fs.ModeSymlink != 0,
+		StatFailed: true,
+	}
+}
 
-	if opts.Follow {
-		err = syscall.Stat(path, &stat)
-	} else {
-		err = syscall.Lstat(path, &stat)
+// statRetryBackoff is the pause before the first --stat-retry attempt; it
+// doubles with each further attempt
+const statRetryBackoff = 10 * time.Millisecond
+
+// statPath stats path, following a final symlink when follow is set. A
+// failed call is tried again up to --stat-retry times, since stats on
+// network filesystems can fail transiently.
+func statPath(path string, follow bool, stat *syscall.Stat_t) error {
+	backoff := statRetryBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		if follow {
+			err = fsys.Stat(path, stat)
+		} else {
+			err = fsys.Lstat(path, stat)
+		}
+		if err == nil || attempt >= opts.StatRetry {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	if err != nil {
+// getFileInfo describes the file at path, or with follow, the file a
+// symlink at path points to
+func getFileInfo(path string, follow bool) (*FileInfo, error) {
+	var stat syscall.Stat_t
+	if err := statPath(path, follow, &stat); err != nil {
 		return nil, err
 	}
 
+	modTime, accessTime, changeTime := statTimes(&stat)
+
 	info := &FileInfo{
-		Name:       filepath.Base(path),
-		Mode:       fs.FileMode(stat.Mode),
+		Name:       path,
+		Mode:       fileModeFromStat(uint32(stat.Mode)),
 		Size:       stat.Size,
-		ModTime:    time.Unix(stat.Mtimespec.Sec, stat.Mtimespec.Nsec),
-		AccessTime: time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec),
-		ChangeTime: time.Unix(stat.Ctimespec.Sec, stat.Ctimespec.Nsec),
+		ModTime:    modTime,
+		AccessTime: accessTime,
+		ChangeTime: changeTime,
+		Dev:        uint64(stat.Dev),
 		Inode:      stat.Ino,
 		Blocks:     stat.Blocks,
 		Links:      uint64(stat.Nlink),
@@ -390,24 +1753,77 @@ func getFileInfo(path string) (*FileInfo, error) {
 		Gid:        stat.Gid,
 		IsDir:      (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR,
 		IsSymlink:  (stat.Mode & syscall.S_IFMT) == syscall.S_IFLNK,
+		IsWhiteout: isWhiteout(path, &stat),
 	}
 
 	// Handle device files
 	if (stat.Mode&syscall.S_IFMT) == syscall.S_IFCHR || (stat.Mode&syscall.S_IFMT) == syscall.S_IFBLK {
-		info.Major = uint32(stat.Rdev >> 8)
-		info.Minor = uint32(stat.Rdev & 0xff)
+		info.Major, info.Minor = deviceNumbers(&stat)
+	}
+
+	// Birth times cost a statx on Linux, so only fetch them for -U
+	if opts.BirthTime {
+		info.BirthTime = statBirthTime(path, &stat, follow)
 	}
 
 	// Read symlink target
-	if info.IsSymlink {
-		if target, err := os.Readlink(path); err == nil {
+	if info.IsSymlink && !opts.FastSymlinks {
+		if target, err := fsys.Readlink(path); err == nil {
 			info.LinkTarget = target
 		}
 	}
+	setGeneration(info, path)
+	setAttributes(info, path)
 
 	return info, nil
 }
 
+// S_IFWHT is the BSD whiteout file type, which syscall only defines on BSDs
+const S_IFWHT = 0160000
+
+// isWhiteout reports whether stat describes a union mount whiteout: an
+// S_IFWHT entry on BSD, or a 0/0 character device on an overlayfs mount.
+// Elsewhere a 0/0 character device is an ordinary device node.
+func isWhiteout(path string, stat *syscall.Stat_t) bool {
+	fileType := uint32(stat.Mode) & syscall.S_IFMT
+	if fileType == S_IFWHT {
+		return true
+	}
+	return fileType == syscall.S_IFCHR && stat.Rdev == 0 && onOverlayfs(path)
+}
+
+// fileModeFromStat converts a raw st_mode into an fs.FileMode the way os.Stat
+// does, so operands and directory entries share the same mode bits
+func fileModeFromStat(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		m |= fs.ModeDevice
+	case syscall.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFDIR:
+		m |= fs.ModeDir
+	case syscall.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case syscall.S_IFLNK:
+		m |= fs.ModeSymlink
+	case syscall.S_IFSOCK:
+		m |= fs.ModeSocket
+	}
+
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
 func convertFileInfo(entry fs.FileInfo, fullPath string) *FileInfo {
 	info := &FileInfo{
 		Name:    entry.Name(),
@@ -425,9 +1841,11 @@ func convertFileInfo(entry fs.FileInfo, fullPath string) *FileInfo {
 		if !sysInfo.ChangeTime.IsZero() {
 			info.ChangeTime = sysInfo.ChangeTime
 		}
+		info.BirthTime = sysInfo.BirthTime
 		if sysInfo.Inode > 0 {
 			info.Inode = sysInfo.Inode
 		}
+		info.Dev = sysInfo.Dev
 		if sysInfo.Blocks > 0 {
 			info.Blocks = sysInfo.Blocks
 		}
@@ -439,37 +1857,67 @@ func convertFileInfo(entry fs.FileInfo, fullPath string) *FileInfo {
 		info.Major = sysInfo.Major
 		info.Minor = sysInfo.Minor
 		info.IsSymlink = sysInfo.IsSymlink
+		info.IsWhiteout = sysInfo.IsWhiteout
 		info.LinkTarget = sysInfo.LinkTarget
 		info.Flags = sysInfo.Flags
 	}
+	setGeneration(info, fullPath)
+	setAttributes(info, fullPath)
 
 	return info
 }
 
-func getSysInfo(path string) *FileInfo {
-	var stat syscall.Stat_t
-	if err := syscall.Lstat(path, &stat); err != nil {
-		return nil
+// setGeneration records the inode generation of the file at path for
+// --inode-generation, which only shows with -i. Only regular files and
+// directories are opened, since opening a device can have side effects.
+func setGeneration(info *FileInfo, path string) {
+	if !opts.InodeGeneration || !opts.Inode || !(info.Mode.IsRegular() || info.Mode.IsDir()) {
+		return
 	}
+	info.Generation, info.HasGeneration = inodeGeneration(path)
+}
 
-	info := &FileInfo{
-		AccessTime: time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec),
-		ChangeTime: time.Unix(stat.Ctimespec.Sec, stat.Ctimespec.Nsec),
+// formatInode renders the inode number, as INODE.GEN when
+// --inode-generation found a generation
+func formatInode(file FileInfo) string {
+	if file.HasGeneration {
+		return fmt.Sprintf("%d.%d", file.Inode, file.Generation)
+	}
+	return strconv.FormatUint(file.Inode, 10)
+}
+
+func getSysInfo(path string) *FileInfo {
+	var stat syscall.Stat_t
+	if err := statPath(path, false, &stat); err != nil {
+		return nil
+	}
+
+	_, accessTime, changeTime := statTimes(&stat)
+
+	info := &FileInfo{
+		AccessTime: accessTime,
+		ChangeTime: changeTime,
+		Dev:        uint64(stat.Dev),
 		Inode:      stat.Ino,
 		Blocks:     stat.Blocks,
 		Links:      uint64(stat.Nlink),
 		Uid:        stat.Uid,
 		Gid:        stat.Gid,
 		IsSymlink:  (stat.Mode & syscall.S_IFMT) == syscall.S_IFLNK,
+		IsWhiteout: isWhiteout(path, &stat),
 	}
 
 	if (stat.Mode&syscall.S_IFMT) == syscall.S_IFCHR || (stat.Mode&syscall.S_IFMT) == syscall.S_IFBLK {
-		info.Major = uint32(stat.Rdev >> 8)
-		info.Minor = uint32(stat.Rdev & 0xff)
+		info.Major, info.Minor = deviceNumbers(&stat)
+	}
+
+	if opts.BirthTime {
+		info.BirthTime = statBirthTime(path, &stat, false)
 	}
 
-	if info.IsSymlink {
-		if target, err := os.Readlink(path); err == nil {
+	// --fast-symlinks skips the extra readlink per link
+	if info.IsSymlink && !opts.FastSymlinks {
+		if target, err := fsys.Readlink(path); err == nil {
 			info.LinkTarget = target
 		}
 	}
@@ -477,11 +1925,17 @@ func getSysInfo(path string) *FileInfo {
 	return info
 }
 
-func shouldSkipEntry(name string) bool {
+func shouldSkipEntry(entry FileInfo) bool {
 	if opts.All {
 		return false
 	}
 
+	// Whiteouts mark deleted files in union mounts; only -a shows them
+	if entry.IsWhiteout {
+		return true
+	}
+
+	name := entry.Name
 	if opts.AlmostAll {
 		return name == "." || name == ".."
 	}
@@ -489,111 +1943,537 @@ func shouldSkipEntry(name string) bool {
 	return strings.HasPrefix(name, ".")
 }
 
+// matchesFilters reports whether file passes the entry filters
+func matchesFilters(file FileInfo) bool {
+	return matchesOwner(file) && matchesPerm(file) && matchesAge(file) && matchesName(file)
+}
+
+// matchesName reports whether file's name contains any of the --match or
+// --imatch substrings
+func matchesName(file FileInfo) bool {
+	if len(opts.Match) == 0 && len(opts.IMatch) == 0 {
+		return true
+	}
+
+	for _, substr := range opts.Match {
+		if strings.Contains(file.Name, substr) {
+			return true
+		}
+	}
+
+	lower := strings.ToLower(file.Name)
+	for _, substr := range opts.IMatch {
+		if strings.Contains(lower, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAge reports whether file's selected time is after the --since cutoff
+func matchesAge(file FileInfo) bool {
+	return opts.NewerThan.IsZero() || selectedTime(file).After(opts.NewerThan)
+}
+
+// parseAge parses a duration such as "90m" or "36h", also accepting days
+// ("2d") and weeks ("1w")
+func parseAge(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.ParseFloat(n, 64)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+
+	age, err := time.ParseDuration(value)
+	if err == nil && age < 0 {
+		err = fmt.Errorf("invalid duration %q", value)
+	}
+	return age, err
+}
+
+// matchesOwner reports whether file passes the --user and --group filters
+func matchesOwner(file FileInfo) bool {
+	if opts.OwnerUid != nil && file.Uid != *opts.OwnerUid {
+		return false
+	}
+	if opts.OwnerGid != nil && file.Gid != *opts.OwnerGid {
+		return false
+	}
+	return true
+}
+
+// matchesPerm reports whether file passes the --perm filter, following the
+// semantics of find -perm
+func matchesPerm(file FileInfo) bool {
+	if opts.Perm == nil {
+		return true
+	}
+
+	bits := permBits(file.Mode)
+	switch opts.Perm.kind {
+	case '-':
+		return bits&opts.Perm.bits == opts.Perm.bits
+	case '/':
+		return opts.Perm.bits == 0 || bits&opts.Perm.bits != 0
+	default:
+		return bits == opts.Perm.bits
+	}
+}
+
+func parsePermFilter(value string) (*permFilter, error) {
+	filter := &permFilter{kind: '='}
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "/") {
+		filter.kind = value[0]
+		value = value[1:]
+	}
+
+	bits, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || bits > 07777 {
+		return nil, fmt.Errorf("invalid mode %q", value)
+	}
+	filter.bits = uint32(bits)
+	return filter, nil
+}
+
+// permBits returns the Unix permission bits of mode, including the setuid,
+// setgid and sticky bits
+func permBits(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
 func sortFiles(files []FileInfo) {
 	if opts.NoSort {
 		return
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		a, b := files[i], files[j]
+	chain := sortChain()
+	sort.SliceStable(files, func(i, j int) bool {
+		// Entries whose metadata could not be read have no real sort key;
+		// --nulls-last keeps them at the end whichever way the sort goes
+		if opts.NullsLast && files[i].StatFailed != files[j].StatFailed {
+			return files[j].StatFailed
+		}
 
-		var result bool
+		// Directories lead regardless of the sort key and -r
+		if opts.DirsFirst && files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
 
-		if opts.TimeSort {
-			var timeA, timeB time.Time
-			if opts.AccessTime {
-				timeA, timeB = a.AccessTime, b.AccessTime
-			} else if opts.ChangeTime {
-				timeA, timeB = a.ChangeTime, b.ChangeTime
-			} else {
-				timeA, timeB = a.ModTime, b.ModTime
+		for _, key := range chain {
+			result := key.compare(files[i], files[j])
+			if key.reverse {
+				result = -result
+			}
+			if result != 0 {
+				return result < 0
 			}
-			result = timeA.After(timeB)
-		} else if opts.SizeSort {
-			result = a.Size > b.Size
-		} else {
-			result = strings.ToLower(a.Name) < strings.ToLower(b.Name)
 		}
+		return false
+	})
+}
+
+// compareFunc orders two entries, returning a negative number when a sorts
+// before b, a positive number when it sorts after, and zero on a tie
+type compareFunc func(a, b FileInfo) int
+
+// sortComparators maps --sort keys to their comparators
+var sortComparators = map[string]compareFunc{
+	"name":        compareName,
+	"name-length": compareNameLength,
+	"type":        compareType,
+	"size":        compareSize,
+	"time":        compareTime,
+	"mtime":       compareModTime,
+	"depth":       compareDepth,
+	"extension":   compareExtension,
+	"version":     compareVersion,
+	"log":         compareLogRotation,
+}
+
+// sortKey is one comparator of the sort chain, with its own direction
+type sortKey struct {
+	compare compareFunc
+	reverse bool
+}
 
-		if opts.Reverse {
-			result = !result
+// sortChain returns the comparators to apply in order. Later comparators
+// only break ties left by earlier ones, and the name always comes last so
+// the order is fully determined. -r reverses every key, while
+// --sort-reverse-only-names flips just the name tie-breaks.
+func sortChain() []sortKey {
+	var keys []string
+	switch {
+	case len(opts.Sort) > 0:
+		keys = append(keys, opts.Sort...)
+	case opts.TimeSort:
+		keys = append(keys, "time")
+	case opts.SizeSort:
+		keys = append(keys, "size")
+	case opts.VersionSort:
+		keys = append(keys, "version")
+	case opts.LogSort:
+		keys = append(keys, "log")
+	}
+	keys = append(keys, "name")
+
+	chain := make([]sortKey, len(keys))
+	for i, key := range keys {
+		chain[i] = sortKey{compare: sortComparators[key], reverse: opts.Reverse}
+		if key == "name" && i > 0 && opts.ReverseNames {
+			chain[i].reverse = !chain[i].reverse
 		}
+	}
+	return chain
+}
 
-		return result
-	})
+func compareName(a, b FileInfo) int {
+	if c := strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+func compareNameLength(a, b FileInfo) int {
+	return displayWidth(a.Name) - displayWidth(b.Name)
+}
+
+// compareDepth puts the paths of --flatten with the fewest directories
+// first
+func compareDepth(a, b FileInfo) int {
+	return strings.Count(a.Name, string(filepath.Separator)) -
+		strings.Count(b.Name, string(filepath.Separator))
+}
+
+// compareExtension orders by the text after the last dot, so names without
+// an extension come first
+func compareExtension(a, b FileInfo) int {
+	return strings.Compare(fileExtension(filepath.Base(a.Name)), fileExtension(filepath.Base(b.Name)))
+}
+
+// compareVersion orders names naturally, for --sort=version and -v
+func compareVersion(a, b FileInfo) int {
+	return naturalCompare(a.Name, b.Name)
+}
+
+// compareLogRotation orders rotated logs, for --log-sort: a name ending in
+// a numeric suffix such as app.log.2 sorts right after its base name,
+// app.log, by the value of the suffix
+func compareLogRotation(a, b FileInfo) int {
+	baseA, numA := rotationSuffix(a.Name)
+	baseB, numB := rotationSuffix(b.Name)
+	if c := compareName(FileInfo{Name: baseA}, FileInfo{Name: baseB}); c != 0 {
+		return c
+	}
+	// The unrotated file has no suffix and comes first
+	return naturalCompare(numA, numB)
+}
+
+// rotationSuffix splits a numeric rotation suffix such as ".10" from name,
+// returning the digits without the dot, or "" when there is none
+func rotationSuffix(name string) (base, num string) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 || dot == len(name)-1 || digitRun(name[dot+1:]) != len(name)-dot-1 {
+		return name, ""
+	}
+	return name[:dot], name[dot+1:]
+}
+
+// naturalCompare compares strings as version strings: runs of digits are
+// compared by numeric value, ignoring leading zeros, and everything else
+// byte by byte, so file2 sorts before file10
+func naturalCompare(x, y string) int {
+	for x != "" && y != "" {
+		if isDigit(x[0]) && isDigit(y[0]) {
+			nx, ny := digitRun(x), digitRun(y)
+			// Without leading zeros, the longer number is the larger
+			vx, vy := strings.TrimLeft(x[:nx], "0"), strings.TrimLeft(y[:ny], "0")
+			if len(vx) != len(vy) {
+				return len(vx) - len(vy)
+			}
+			if c := strings.Compare(vx, vy); c != 0 {
+				return c
+			}
+			x, y = x[nx:], y[ny:]
+			continue
+		}
+		if x[0] != y[0] {
+			return int(x[0]) - int(y[0])
+		}
+		x, y = x[1:], y[1:]
+	}
+	return len(x) - len(y)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// digitRun returns the length of the run of digits s starts with
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	return n
+}
+
+func compareType(a, b FileInfo) int {
+	return fileTypeRank(a) - fileTypeRank(b)
+}
+
+// compareSize puts the largest file first
+func compareSize(a, b FileInfo) int {
+	switch {
+	case a.Size > b.Size:
+		return -1
+	case a.Size < b.Size:
+		return 1
+	}
+	return 0
+}
+
+// compareTime puts the most recent file first, using the time selected by
+// -u, -c or -U
+func compareTime(a, b FileInfo) int {
+	return sortTime(selectedTime(b)).Compare(sortTime(selectedTime(a)))
+}
+
+// compareModTime puts the most recently modified file first
+func compareModTime(a, b FileInfo) int {
+	return sortTime(b.ModTime).Compare(sortTime(a.ModTime))
+}
+
+// timeResolutions are the units accepted by --time-resolution
+var timeResolutions = map[string]time.Duration{
+	"ns": 0,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// sortTime truncates t to --time-resolution for comparison. Stat times
+// carry nanoseconds wherever the OS reports them, so by default nothing is
+// dropped.
+func sortTime(t time.Time) time.Time {
+	if opts.TimeResolution <= 0 {
+		return t
+	}
+	return t.Truncate(opts.TimeResolution)
+}
+
+// selectedTime returns the timestamp chosen by -u, -c or -U, defaulting to
+// the modification time. The birth time is zero where the system does not
+// record it.
+func selectedTime(file FileInfo) time.Time {
+	if opts.AccessTime {
+		return file.AccessTime
+	} else if opts.ChangeTime {
+		return file.ChangeTime
+	} else if opts.BirthTime {
+		return file.BirthTime
+	}
+	return file.ModTime
+}
+
+// fileTypeRank orders file types for --sort=type: directories, symlinks,
+// regular files, devices, then pipes and sockets
+func fileTypeRank(file FileInfo) int {
+	switch {
+	case file.IsDir:
+		return 0
+	case file.IsSymlink:
+		return 1
+	case file.Mode.IsRegular():
+		return 2
+	case file.Mode&fs.ModeDevice != 0:
+		return 3
+	default:
+		return 4
+	}
 }
 
-func displayFiles(files []FileInfo, basePath string) {
-	if opts.LongFormat || opts.GroupFormat || opts.NumericFormat {
-		displayLongFormat(files)
+func displayFiles(w io.Writer, files []FileInfo, basePath string) {
+	if opts.Markdown {
+		displayMarkdownTable(w, files)
+	} else if opts.Fields {
+		displayFields(w, files)
+	} else if opts.LongFormat || opts.GroupFormat || opts.NumericFormat {
+		displayLongFormat(w, files, basePath)
 	} else if opts.Stream {
-		displayStreamFormat(files)
+		displayStreamFormat(w, files)
+	} else if opts.Comma && !opts.One {
+		displayAcrossFormat(w, files)
 	} else if opts.Columns && !opts.One {
-		displayColumnFormat(files)
+		displayColumnFormat(w, files)
 	} else {
-		displaySimpleFormat(files)
+		displaySimpleFormat(w, files)
 	}
 }
 
-func displayLongFormat(files []FileInfo) {
-	// Calculate total blocks
+func displayLongFormat(w io.Writer, files []FileInfo, basePath string) {
+	// Total the blocks as each row shows them, so the rounding of a large
+	// block size cannot make the total disagree with the rows
 	var totalBlocks int64
 	for _, file := range files {
-		totalBlocks += file.Blocks
+		totalBlocks += blockCount(file)
 	}
 
-	if opts.Kilobytes {
-		totalBlocks = (totalBlocks * BLOCKSIZE) / 1024
+	if len(files) > 0 {
+		writeLine(w, fmt.Sprintf("total %d", totalBlocks))
 	}
 
-	if len(files) > 0 {
-		fmt.Printf("total %d\n", totalBlocks)
+	var previews []string
+	if opts.Head > 0 {
+		previews = headPreviews(basePath, files)
 	}
 
+	widths := measureLongWidths(files)
+	for i, file := range files {
+		writeLine(w, formatLongLine(file, widths))
+		if opts.XattrNames && !file.StatFailed {
+			displayXattrSizes(w, filepath.Join(basePath, file.Name))
+		}
+		if opts.XattrValues && !file.StatFailed {
+			displayXattrValues(w, filepath.Join(basePath, file.Name))
+		}
+		if previews != nil && previews[i] != "" {
+			writeLine(w, "\t"+previews[i])
+		}
+	}
+}
+
+// longWidths are the widths of the padded long format columns, measured
+// over a whole listing so that every row lines up. name is only set for
+// --align-right.
+type longWidths struct {
+	inode, blocks, mark, links, owner, group, size, disk, name int
+}
+
+// measureLongWidths finds the widest value of each column among files
+func measureLongWidths(files []FileInfo) longWidths {
+	var widths longWidths
 	for _, file := range files {
-		line := formatLongLine(file)
-		fmt.Println(line)
+		if file.StatFailed {
+			continue
+		}
+		widths.inode = max(widths.inode, len(formatInode(file)))
+		widths.blocks = max(widths.blocks, len(strconv.FormatInt(blockCount(file), 10)))
+		widths.mark = max(widths.mark, len(attributeMark(file)))
+		widths.links = max(widths.links, len(strconv.FormatUint(file.Links, 10)))
+		widths.owner = max(widths.owner, displayWidth(ownerField(file)))
+		widths.group = max(widths.group, displayWidth(groupField(file)))
+		widths.size = max(widths.size, len(sizeField(file)))
+		widths.disk = max(widths.disk, len(formatSize(file.Blocks*BLOCKSIZE)))
+		if opts.AlignRight {
+			widths.name = max(widths.name, displayWidth(longName(file)))
+		}
+	}
+	return widths
+}
+
+// blockCount returns the blocks file uses, in the unit of scaleBlocks
+func blockCount(file FileInfo) int64 {
+	return scaleBlocks(file.Blocks)
+}
+
+// ownerField returns the owner column: the user name, or the uid with -n
+func ownerField(file FileInfo) string {
+	if opts.NumericFormat {
+		return strconv.FormatUint(uint64(file.Uid), 10)
+	}
+	return getUserName(file.Uid)
+}
+
+// groupField returns the group column: the group name, or the gid with -n
+func groupField(file FileInfo) string {
+	if opts.NumericFormat {
+		return strconv.FormatUint(uint64(file.Gid), 10)
+	}
+	return getGroupName(file.Gid)
+}
+
+// padIdentity pads an owner or group column to width, left-justifying
+// names and right-justifying the numeric ids of -n
+func padIdentity(s string, width int) string {
+	if opts.NumericFormat {
+		return fmt.Sprintf("%*s", width, s)
+	}
+	return padRight(s, width)
+}
+
+// sizeField returns the size column: the size, or the major and minor
+// numbers of a device
+func sizeField(file FileInfo) string {
+	if file.Major != 0 || file.Minor != 0 {
+		return fmt.Sprintf("%3d, %3d", file.Major, file.Minor)
 	}
+	return formatSize(file.Size)
 }
 
-func formatLongLine(file FileInfo) string {
+// formatLongLine renders file as a line of long format output, padding
+// each column to widths. With --align-right the name is right-aligned too;
+// the symlink target and other notes follow it unpadded.
+func formatLongLine(file FileInfo, widths longWidths) string {
+	if file.StatFailed {
+		return formatUnknownLine(file, widths)
+	}
+
 	var parts []string
 
 	// Inode
 	if opts.Inode {
-		parts = append(parts, fmt.Sprintf("%8d", file.Inode))
+		parts = append(parts, fmt.Sprintf("%*s", widths.inode, formatInode(file)))
 	}
 
 	// Blocks
 	if opts.Blocks {
-		blocks := file.Blocks
-		if opts.Kilobytes && blocks > 0 {
-			blocks = (blocks * BLOCKSIZE) / 1024
-		}
-		parts = append(parts, fmt.Sprintf("%6d", blocks))
+		parts = append(parts, fmt.Sprintf("%*d", widths.blocks, blockCount(file)))
 	}
 
 	// Mode
-	parts = append(parts, formatMode(file.Mode, file.IsSymlink))
+	modeStr := formatMode(file.Mode, file.IsSymlink)
+	if file.IsWhiteout {
+		modeStr = "w" + modeStr[1:]
+	}
+	if opts.ModeColor {
+		modeStr = colorizeMode(modeStr)
+	}
+	modeStr = styleMode(modeStr, file.Mode)
+	if widths.mark > 0 {
+		modeStr += padRight(attributeMark(file), widths.mark)
+	}
+	parts = append(parts, modeStr)
 
-	// Links
-	parts = append(parts, fmt.Sprintf("%3d", file.Links))
+	// Links, highlighting multiply-linked files. A directory's count only
+	// reflects its subdirectories, so directories are never highlighted.
+	linksStr := fmt.Sprintf("%*d", widths.links, file.Links)
+	if opts.LinkColor > 0 && file.Links > opts.LinkColor && !file.IsDir {
+		linksStr = colorCyan + linksStr + colorReset
+	}
+	parts = append(parts, linksStr)
 
 	// Owner
 	if !opts.GroupFormat {
-		if opts.NumericFormat {
-			parts = append(parts, fmt.Sprintf("%-8d", file.Uid))
-		} else {
-			parts = append(parts, fmt.Sprintf("%-8s", getUserName(file.Uid)))
-		}
+		parts = append(parts, padIdentity(ownerField(file), widths.owner))
 	}
 
 	// Group
-	if opts.NumericFormat {
-		parts = append(parts, fmt.Sprintf("%-8d", file.Gid))
-	} else {
-		parts = append(parts, fmt.Sprintf("%-8s", getGroupName(file.Gid)))
-	}
+	parts = append(parts, padIdentity(groupField(file), widths.group))
 
 	// Flags
 	if opts.Flags {
@@ -601,38 +2481,116 @@ func formatLongLine(file FileInfo) string {
 	}
 
 	// Size or device numbers
-	if file.Major != 0 || file.Minor != 0 {
-		parts = append(parts, fmt.Sprintf("%3d, %3d", file.Major, file.Minor))
-	} else {
-		sizeStr := formatSize(file.Size)
-		parts = append(parts, fmt.Sprintf("%8s", sizeStr))
+	parts = append(parts, fmt.Sprintf("%*s", widths.size, sizeField(file)))
+
+	// On-disk size, next to the apparent size
+	if opts.BothSizes {
+		parts = append(parts, fmt.Sprintf("%*s", widths.disk, formatSize(file.Blocks*BLOCKSIZE)))
 	}
 
 	// Time
-	timeStr := formatTime(file.ModTime, file.AccessTime, file.ChangeTime)
+	timeStr := formatTime(selectedTime(file))
+	if opts.TimeColor {
+		age := time.Since(selectedTime(file))
+		timeStr = timeColor(age).escape(opts.ColorDepth) + timeStr + colorReset
+	}
 	parts = append(parts, timeStr)
 
 	// Name
-	name := file.Name
-	if opts.Quote {
-		name = quoteFileName(name)
+	name := longName(file)
+	if n := widths.name - displayWidth(name); n > 0 {
+		name = strings.Repeat(" ", n) + name
 	}
 
+	if file.IsSymlink && file.LinkTarget != "" && !opts.NoSymlinkArrow {
+		name += " " + deco.arrow + " " + quoteName(file.LinkTarget)
+	}
+	name += aliasNote(file)
+
+	line := strings.Join(append(parts, name), " ")
+	if opts.Wrap == "" || displayWidth(line) <= opts.Width {
+		return line
+	}
+
+	// --wrap keeps the metadata columns intact by moving an overflowing
+	// name to an indented continuation line
+	if opts.Wrap == "truncate" {
+		return ellipsize(line, opts.Width)
+	}
+	return strings.Join(parts, " ") + "\n" + fitToWidth(longWrapIndent+name, opts.Width)
+}
+
+// longWrapIndent starts the continuation line of a name moved by --wrap
+const longWrapIndent = "    "
+
+// longName returns the name of file as long format shows it, with its
+// indicator but without any symlink target
+func longName(file FileInfo) string {
+	name := iconPrefix(file) + colorName(file, quoteName(file.Name))
 	if opts.Classify {
 		name += getClassifyChar(file)
 	} else if opts.Slash && file.IsDir {
 		name += "/"
 	}
+	return name
+}
+
+// formatUnknownLine renders an entry whose metadata is unavailable, with '?'
+// in place of every field that could not be read
+func formatUnknownLine(file FileInfo, widths longWidths) string {
+	var parts []string
 
-	if file.IsSymlink && file.LinkTarget != "" {
-		name += " -> " + file.LinkTarget
+	if opts.Inode {
+		parts = append(parts, fmt.Sprintf("%*s", widths.inode, "?"))
+	}
+	if opts.Blocks {
+		parts = append(parts, fmt.Sprintf("%*s", widths.blocks, "?"))
 	}
 
-	parts = append(parts, name)
+	parts = append(parts, formatMode(file.Mode, file.IsSymlink)[:1]+"?????????"+strings.Repeat(" ", widths.mark))
+	parts = append(parts, fmt.Sprintf("%*s", widths.links, "?"))
+	if !opts.GroupFormat {
+		parts = append(parts, padIdentity("?", widths.owner))
+	}
+	parts = append(parts, padIdentity("?", widths.group))
+	if opts.Flags {
+		parts = append(parts, "?")
+	}
+	parts = append(parts, fmt.Sprintf("%*s", widths.size, "?"))
+	if opts.BothSizes {
+		parts = append(parts, fmt.Sprintf("%*s", widths.disk, "?"))
+	}
+	parts = append(parts, padRight("?", timeWidth()))
+	parts = append(parts, quoteName(file.Name))
 
 	return strings.Join(parts, " ")
 }
 
+// Permission styles for --perm-style
+const (
+	PermSymbolic = "symbolic"
+	PermOctal    = "octal"
+	PermBoth     = "both"
+)
+
+// styleMode renders a mode in the --perm-style format, given its symbolic
+// form from formatMode
+func styleMode(symbolic string, mode fs.FileMode) string {
+	switch opts.PermStyle {
+	case PermOctal:
+		return octalMode(mode)
+	case PermBoth:
+		return octalMode(mode) + " (" + symbolic[1:] + ")"
+	}
+	return symbolic
+}
+
+// octalMode renders the permission, setuid, setgid and sticky bits of mode
+// as the four octal digits chmod takes
+func octalMode(mode fs.FileMode) string {
+	return fmt.Sprintf("%04o", permBits(mode))
+}
+
 func formatMode(mode fs.FileMode, isSymlink bool) string {
 	var buf [10]byte
 
@@ -648,7 +2606,7 @@ func formatMode(mode fs.FileMode, isSymlink bool) string {
 		buf[0] = 's'
 	case fs.ModeDevice:
 		buf[0] = 'b'
-	case fs.ModeCharDevice:
+	case fs.ModeDevice | fs.ModeCharDevice:
 		buf[0] = 'c'
 	default:
 		buf[0] = '-'
@@ -726,200 +2684,721 @@ func formatMode(mode fs.FileMode, isSymlink bool) string {
 	return string(buf[:])
 }
 
-func formatSize(size int64) string {
-	if !opts.Human {
-		return strconv.FormatInt(size, 10)
+// ANSI escape sequences used for highlighting in long format
+const (
+	colorReset   = "\033[0m"
+	colorRed     = "\033[31m"
+	colorGreen   = "\033[32m"
+	colorYellow  = "\033[33m"
+	colorCyan    = "\033[1;36m"
+	colorSpecial = "\033[1;35m"
+)
+
+// colorizeMode wraps the permission characters of a formatMode string in
+// color: write bits yellow, execute bits green, setuid/setgid/sticky bold
+// magenta, and a world-writable bit red.
+func colorizeMode(mode string) string {
+	var result strings.Builder
+	result.WriteByte(mode[0])
+
+	for i := 1; i < len(mode); i++ {
+		c := mode[i]
+		var color string
+		switch {
+		case c == 'w' && i == 8:
+			color = colorRed
+		case c == 'w':
+			color = colorYellow
+		case c == 'x':
+			color = colorGreen
+		case c == 's' || c == 'S' || c == 't' || c == 'T':
+			color = colorSpecial
+		}
+
+		if color == "" {
+			result.WriteByte(c)
+			continue
+		}
+		result.WriteString(color)
+		result.WriteByte(c)
+		result.WriteString(colorReset)
 	}
 
-	const (
-		B  = 1
-		KB = 1024 * B
-		MB = 1024 * KB
-		GB = 1024 * MB
-		TB = 1024 * GB
-		PB = 1024 * TB
-		EB = 1024 * PB
-	)
+	return result.String()
+}
 
+func formatSize(size int64) string {
+	// --si counts in powers of 1000 and takes precedence over -h
+	base, units, suffix := 1024.0, "KMGTPE", ""
 	switch {
-	case size >= EB:
-		return fmt.Sprintf("%.1fE", float64(size)/EB)
-	case size >= PB:
-		return fmt.Sprintf("%.1fP", float64(size)/PB)
-	case size >= TB:
-		return fmt.Sprintf("%.1fT", float64(size)/TB)
-	case size >= GB:
-		return fmt.Sprintf("%.1fG", float64(size)/GB)
-	case size >= MB:
-		return fmt.Sprintf("%.1fM", float64(size)/MB)
-	case size >= KB:
-		return fmt.Sprintf("%.1fK", float64(size)/KB)
-	default:
+	case opts.SI:
+		base, units, suffix = 1000, "kMGTPE", "B"
+	case !opts.Human:
 		return strconv.FormatInt(size, 10)
 	}
+	if float64(size) < base {
+		return strconv.FormatInt(size, 10)
+	}
+
+	value := float64(size) / base
+	unit := 0
+	for value >= base && unit < len(units)-1 {
+		value /= base
+		unit++
+	}
+
+	if opts.Precision != nil {
+		// Carry into the next unit when rounding reaches the base
+		value = ceilTo(value, math.Pow(10, float64(*opts.Precision)))
+		if value >= base && unit < len(units)-1 {
+			value /= base
+			unit++
+		}
+		return fmt.Sprintf("%.*f%c%s", *opts.Precision, value, units[unit], suffix)
+	}
+
+	// Like coreutils, round up, and keep one decimal only while the value
+	// is a single digit so the column stays 3-4 characters wide (9.9K,
+	// 10K, 999K)
+	if tenths := ceilTo(value, 10); tenths < 10 {
+		return fmt.Sprintf("%.1f%c%s", tenths, units[unit], suffix)
+	}
+
+	rounded := ceilTo(value, 1)
+	if rounded >= base && unit < len(units)-1 {
+		return fmt.Sprintf("%.1f%c%s", rounded/base, units[unit+1], suffix)
+	}
+	return fmt.Sprintf("%.0f%c%s", rounded, units[unit], suffix)
 }
 
-func formatTime(modTime, accessTime, changeTime time.Time) string {
-	var t time.Time
+// ceilTo rounds v up to a multiple of 1/scale. A value that is already a
+// multiple, up to floating-point error, stays as it is.
+func ceilTo(v, scale float64) float64 {
+	return math.Ceil(v*scale-1e-9) / scale
+}
 
-	if opts.AccessTime {
-		t = accessTime
-	} else if opts.ChangeTime {
-		t = changeTime
-	} else {
-		t = modTime
+// fullTimeLayout is the --full-time timestamp, to the nanosecond
+const fullTimeLayout = "2006-01-02 15:04:05.000000000 -0700"
+
+// formatTime renders the long format time column for t. A zero time, a
+// birth time the system did not record, is shown as '-', padded to the
+// width of a real time so the names stay aligned.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return padRight("-", timeWidth())
 	}
+	return formatDate(t, true)
+}
+
+// timeWidth returns the width of the time column in the active time style,
+// which placeholders and relative ages are padded to
+func timeWidth() int {
+	return displayWidth(formatDate(time.Now(), false))
+}
 
+// formatDate renders t in the active time style, as a relative age when
+// relative is set and t is within --relative-time-threshold
+func formatDate(t time.Time, relative bool) string {
+	switch style := opts.TimeStyle; {
+	case style == TimeStyleFullISO:
+		return t.Format(fullTimeLayout)
+	case style == TimeStyleLongISO:
+		return t.Format("2006-01-02 15:04")
+	case strings.HasPrefix(style, "+"):
+		return customTime(t, style[1:])
+	}
 	if opts.FullTime {
 		return t.Format("Jan _2 15:04:05 2006")
 	}
 
 	now := time.Now()
-	if now.Sub(t) < 6*30*24*time.Hour { // Less than 6 months
-		return t.Format("Jan _2 15:04")
+	if age := now.Sub(t); relative && age >= 0 && age < opts.RelativeTime {
+		return fmt.Sprintf("%*s", timeWidth(), formatAge(age))
+	}
+
+	// --portable-dates uses numeric months, padding the year to line up
+	// with the time of day; the iso style shows older dates in full
+	recent, old := "Jan _2 15:04", "Jan _2  2006"
+	if opts.TimeStyle == TimeStyleISO {
+		recent, old = "01-02 15:04", "2006-01-02 "
+	} else if opts.PortableDates {
+		recent, old = "01-02 15:04", "01-02  2006"
+	}
+
+	// Like GNU ls, only times from the last six calendar months get the
+	// time of day; older ones and any in the future show the year
+	if t.After(now.AddDate(0, -6, 0)) && !t.After(now) {
+		return t.Format(recent)
+	}
+	return t.Format(old)
+}
+
+// formatAge renders how long ago something happened, e.g. "5m ago"
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", age/time.Minute)
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", age/time.Hour)
+	case age < 7*24*time.Hour:
+		return fmt.Sprintf("%dd ago", age/(24*time.Hour))
+	default:
+		return fmt.Sprintf("%dw ago", age/(7*24*time.Hour))
 	}
-	return t.Format("Jan _2  2006")
 }
 
 func getClassifyChar(file FileInfo) string {
+	if file.IsWhiteout {
+		return indicator('w', "%")
+	}
 	if file.IsDir {
-		return "/"
+		return indicator('d', "/")
 	}
 	if file.IsSymlink {
-		return "@"
-	}
-	if file.Mode&0111 != 0 { // Executable
-		return "*"
+		return indicator('l', "@")
 	}
 	if file.Mode&fs.ModeNamedPipe != 0 {
-		return "|"
+		return indicator('p', "|")
 	}
 	if file.Mode&fs.ModeSocket != 0 {
-		return "="
+		return indicator('s', "=")
+	}
+	if file.Mode.IsRegular() && file.Mode&0111 != 0 { // Executable
+		return indicator('x', "*")
 	}
 	return ""
 }
 
-func displayStreamFormat(files []FileInfo) {
+// indicatorCategories are the --indicators letters: directories, symlinks,
+// executables, pipes, sockets and whiteouts
+const indicatorCategories = "dlxpsw"
+
+// indicator returns mark unless --indicators leaves out its category
+func indicator(category byte, mark string) string {
+	if opts.Indicators != "" && strings.IndexByte(opts.Indicators, category) < 0 {
+		return ""
+	}
+	return mark
+}
+
+func displayStreamFormat(w io.Writer, files []FileInfo) {
 	var names []string
 	for _, file := range files {
-		name := file.Name
+		name := colorName(file, quoteName(file.Name))
 		if opts.Classify {
 			name += getClassifyChar(file)
 		}
-		names = append(names, name)
+		names = append(names, name+aliasNote(file))
+	}
+
+	if !opts.StrictWidth {
+		fmt.Fprintln(w, strings.Join(names, ", "))
+		return
+	}
+
+	// Break lines before they would exceed the width, shortening any name
+	// that cannot fit on a line of its own
+	var line string
+	for i, name := range names {
+		sep := ","
+		if i == len(names)-1 {
+			sep = ""
+		}
+		item := ellipsize(name, opts.Width-len(sep)) + sep
+		if line != "" && displayWidth(line)+1+displayWidth(item) > opts.Width {
+			fmt.Fprintln(w, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += item
+	}
+	fmt.Fprintln(w, line)
+}
+
+func displayColumnFormat(w io.Writer, files []FileInfo) {
+	if len(files) == 0 {
+		return
+	}
+	names, longest := columnCells(files)
+
+	// Fill down the columns, as ls -C does, padding all but the last
+	rows, cols := columnLayout(len(names), longest+columnGap, opts.Width)
+	for row := 0; row < rows; row++ {
+		var line strings.Builder
+		for col := 0; col < cols; col++ {
+			i := col*rows + row
+			if i >= len(names) {
+				break
+			}
+			if col+1 < cols && i+rows < len(names) {
+				line.WriteString(padRight(names[i], longest+columnGap))
+			} else {
+				line.WriteString(names[i])
+			}
+		}
+		fmt.Fprintln(w, line.String())
 	}
-	fmt.Println(strings.Join(names, ", "))
 }
 
-func displayColumnFormat(files []FileInfo) {
-	// Simple column display - can be optimized further
+// displayAcrossFormat lays entries out in a grid like -C, but fills each
+// row before moving on to the next, as ls -x does
+func displayAcrossFormat(w io.Writer, files []FileInfo) {
+	if len(files) == 0 {
+		return
+	}
+	names, longest := columnCells(files)
+
+	cols := min(max((opts.Width+columnGap)/(longest+columnGap), 1), len(names))
+	for start := 0; start < len(names); start += cols {
+		row := names[start:min(start+cols, len(names))]
+		var line strings.Builder
+		for i, name := range row {
+			if i+1 < len(row) {
+				line.WriteString(padRight(name, longest+columnGap))
+			} else {
+				line.WriteString(name)
+			}
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
+
+// columnCells renders the grid cells of -C and -x, returning them with the
+// width of the widest
+func columnCells(files []FileInfo) ([]string, int) {
+	names := make([]string, len(files))
+	longest := 0
 	for i, file := range files {
-		name := file.Name
+		name := iconPrefix(file) + colorName(file, quoteName(file.Name))
 		if opts.Classify {
 			name += getClassifyChar(file)
 		}
+		name += aliasNote(file)
 		if opts.Inode {
-			name = fmt.Sprintf("%8d %s", file.Inode, name)
+			name = fmt.Sprintf("%8s %s", formatInode(file), name)
 		}
 		if opts.Blocks {
-			blocks := file.Blocks
-			if opts.Kilobytes && blocks > 0 {
-				blocks = (blocks * BLOCKSIZE) / 1024
-			}
-			name = fmt.Sprintf("%6d %s", blocks, name)
+			name = fmt.Sprintf("%6d %s", blockCount(file), name)
 		}
-		fmt.Printf("%-20s", name)
-		if (i+1)%4 == 0 {
-			fmt.Println()
+		if opts.StrictWidth {
+			name = ellipsize(name, opts.Width)
 		}
+		names[i] = name
+		longest = max(longest, displayWidth(name))
 	}
-	if len(files)%4 != 0 {
-		fmt.Println()
+	return names, longest
+}
+
+// columnGap is the space between columns in -C and -x output
+const columnGap = 2
+
+// columnLayout returns the rows and columns of a grid holding n cells of
+// cellWidth columns, gap included, in a line of the given width. The last
+// column needs no gap. The column count is then trimmed so that filling
+// down the columns leaves none of them empty.
+func columnLayout(n, cellWidth, width int) (rows, cols int) {
+	cols = max((width+columnGap)/cellWidth, 1)
+	cols = min(cols, n)
+	rows = (n + cols - 1) / cols
+	cols = (n + rows - 1) / rows
+	return rows, cols
+}
+
+// padRight pads s with spaces to width columns
+func padRight(s string, width int) string {
+	if n := width - displayWidth(s); n > 0 {
+		return s + strings.Repeat(" ", n)
 	}
+	return s
 }
 
-func displaySimpleFormat(files []FileInfo) {
+func displaySimpleFormat(w io.Writer, files []FileInfo) {
 	for _, file := range files {
+		var line string
 		if opts.Inode {
-			fmt.Printf("%8d ", file.Inode)
+			line += fmt.Sprintf("%8s ", formatInode(file))
 		}
 		if opts.Blocks {
-			blocks := file.Blocks
-			if opts.Kilobytes && blocks > 0 {
-				blocks = (blocks * BLOCKSIZE) / 1024
-			}
-			fmt.Printf("%6d ", blocks)
+			line += fmt.Sprintf("%6d ", blockCount(file))
 		}
 
-		name := file.Name
-		if opts.Quote {
-			name = quoteFileName(name)
-		}
+		name := iconPrefix(file) + colorName(file, quoteName(file.Name))
 		if opts.Classify {
 			name += getClassifyChar(file)
 		} else if opts.Slash && file.IsDir {
 			name += "/"
 		}
+		line += name + aliasNote(file)
+
+		if opts.Wrap != "" && displayWidth(line) > opts.Width {
+			line = fitToWidth(line, opts.Width)
+		}
 
-		fmt.Println(name)
+		writeLine(w, line)
 	}
 }
 
-func processRecursive(dirPath string) {
-	entries, err := readDirFast(dirPath)
-	if err != nil {
+// writeLine writes a line of one-per-line or long format output, ending
+// it with a NUL byte under --zero
+func writeLine(w io.Writer, line string) {
+	if opts.Zero {
+		fmt.Fprint(w, line+"\x00")
 		return
 	}
+	fmt.Fprintln(w, line)
+}
 
-	var subdirs []string
-	for _, entry := range entries {
-		if entry.IsDir && entry.Name != "." && entry.Name != ".." {
-			if opts.All || !strings.HasPrefix(entry.Name, ".") {
-				subdirs = append(subdirs, filepath.Join(dirPath, entry.Name))
-			}
+// fitToWidth shortens a line wider than width for --wrap: it is either cut
+// off with an ellipsis or broken into indented continuation lines
+func fitToWidth(line string, width int) string {
+	if opts.Wrap == "truncate" {
+		return ellipsize(line, width)
+	}
+
+	const indent = "  "
+	var result strings.Builder
+	first := true
+	for line != "" {
+		avail := width
+		if !first {
+			result.WriteString("\n" + indent)
+			avail -= len(indent)
+		}
+		chunk := truncateToWidth(line, max(avail, 1))
+		if chunk == "" {
+			// A single character wider than the space left
+			_, size := utf8.DecodeRuneInString(line)
+			chunk = line[:size]
+		}
+		result.WriteString(chunk)
+		line = line[len(chunk):]
+		first = false
+	}
+	return result.String()
+}
+
+// ellipsize shortens s to fit in width columns, marking the cut with an
+// ellipsis
+func ellipsize(s string, width int) string {
+	if displayWidth(s) <= width {
+		return s
+	}
+	truncated := truncateToWidth(s, width-displayWidth(deco.ellipsis))
+	if strings.Contains(truncated, "\033[") {
+		// Don't let a color cut off before its reset run on
+		truncated += colorReset
+	}
+	return truncated + deco.ellipsis
+}
+
+// truncateToWidth returns the longest prefix of s that fits in width columns
+func truncateToWidth(s string, width int) string {
+	used := 0
+	for i := 0; i < len(s); {
+		if n := escapeLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		w := runeWidth(r)
+		if used+w > width {
+			return s[:i]
+		}
+		used += w
+		i += size
+	}
+	return s
+}
+
+// fileID identifies a file by device and inode
+type fileID struct {
+	dev, inode uint64
+}
+
+// collapseHardlinks keeps only the first name seen for each inode, in the
+// current sort order, and records how many other names were dropped
+func collapseHardlinks(files []FileInfo) []FileInfo {
+	first := make(map[fileID]int)
+	var unique []FileInfo
+	for _, file := range files {
+		if file.Links < 2 || file.StatFailed {
+			unique = append(unique, file)
+			continue
+		}
+
+		id := fileID{file.Dev, file.Inode}
+		if i, ok := first[id]; ok {
+			unique[i].Aliases++
+			continue
+		}
+		first[id] = len(unique)
+		unique = append(unique, file)
+	}
+	return unique
+}
+
+// aliasNote notes how many names a collapsed hardlinked entry stands for
+func aliasNote(file FileInfo) string {
+	if file.Aliases == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d names)", file.Aliases+1)
+}
+
+func displayExtSummary(w io.Writer, files []FileInfo) {
+	type extStats struct {
+		ext   string
+		count int
+		size  int64
+	}
+
+	byExt := make(map[string]*extStats)
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		ext := fileExtension(file.Name)
+		if ext == "" {
+			ext = "(none)"
+		}
+		stats, ok := byExt[ext]
+		if !ok {
+			stats = &extStats{ext: ext}
+			byExt[ext] = stats
+		}
+		stats.count++
+		stats.size += file.Size
+	}
+
+	summary := make([]*extStats, 0, len(byExt))
+	for _, stats := range byExt {
+		summary = append(summary, stats)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].count != summary[j].count {
+			return summary[i].count > summary[j].count
+		}
+		return summary[i].ext < summary[j].ext
+	})
+
+	fmt.Fprintf(w, "\n%-12s %8s %8s\n", "extension", "count", "size")
+	for _, stats := range summary {
+		fmt.Fprintf(w, "%-12s %8d %8s\n", stats.ext, stats.count, formatSize(stats.size))
+	}
+}
+
+// displayHardlinkSummary reports how many inodes in files are listed under
+// more than one name and how much space that sharing saves. Names merged by
+// --unique-hardlinks still count.
+func displayHardlinkSummary(w io.Writer, files []FileInfo) {
+	type inodeStats struct {
+		names int
+		size  int64
+	}
+
+	byInode := make(map[fileID]*inodeStats)
+	for _, file := range files {
+		if file.IsDir || file.StatFailed {
+			continue
+		}
+		id := fileID{file.Dev, file.Inode}
+		stats, ok := byInode[id]
+		if !ok {
+			stats = &inodeStats{size: file.Size}
+			byInode[id] = stats
+		}
+		stats.names += 1 + file.Aliases
+	}
+
+	var shared, names int
+	var saved int64
+	for _, stats := range byInode {
+		if stats.names > 1 {
+			shared++
+			names += stats.names
+			saved += stats.size * int64(stats.names-1)
 		}
 	}
 
+	switch shared {
+	case 0:
+		fmt.Fprintf(w, "\nhardlinks: no inodes shared\n")
+	case 1:
+		fmt.Fprintf(w, "\nhardlinks: 1 inode shared by %d names, %s saved\n", names, formatSize(saved))
+	default:
+		fmt.Fprintf(w, "\nhardlinks: %d inodes shared by %d names, %s saved\n", shared, names, formatSize(saved))
+	}
+}
+
+// fileExtension returns the part of name after the final dot, including the
+// dot. Names without a dot, or whose only dot is a leading one, have none.
+func fileExtension(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return ""
+	}
+	return name[i:]
+}
+
+// processRecursive lists subdirs and everything beneath them for -R.
+// visited holds the directories already listed under the same operand, so
+// a symlink followed with -L cannot lead the walk around in a loop.
+func processRecursive(w io.Writer, subdirs []FileInfo, visited map[fileID]bool) {
 	for _, subdir := range subdirs {
-		fmt.Printf("\n%s:\n", subdir)
-		processDirectory(subdir)
-		processRecursive(subdir)
+		id := fileID{subdir.Dev, subdir.Inode}
+		if visited[id] {
+			fmt.Fprintf(os.Stderr, "ls: %s: not listing already-listed directory\n", subdir.Name)
+			continue
+		}
+		visited[id] = true
+
+		if !opts.SkipEmptyHeaders {
+			writeLine(w, "")
+			writeLine(w, subdir.Name+":")
+			processRecursive(w, processDirectory(w, subdir.Name), visited)
+			continue
+		}
+
+		// Leave out the header, and the footers with it, when the
+		// directory shows no entries
+		files, children := readDirectory(subdir.Name)
+		if len(files) > 0 {
+			writeLine(w, "")
+			writeLine(w, subdir.Name+":")
+			listDirectory(w, subdir.Name, files)
+		}
+		processRecursive(w, children, visited)
 	}
 }
 
+func isExcludedDir(name string) bool {
+	for _, pattern := range opts.ExcludeDirs {
+		if name == pattern {
+			return true
+		}
+		if matched, err := filepath.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Utility functions
 var (
-	userCache  = make(map[uint32]string)
-	groupCache = make(map[uint32]string)
+	userCache  = newNameCache()
+	groupCache = newNameCache()
 )
 
-func getUserName(uid uint32) string {
-	if name, ok := userCache[uid]; ok {
+// nameCache maps user or group ids to names. With a positive limit it keeps
+// at most limit entries, evicting the least recently used one. It is shared
+// by the goroutines listing directories, so every access holds mu, and
+// concurrent misses for one id wait on a single lookup.
+type nameCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[uint32]*list.Element
+	order   *list.List
+	pending map[uint32]*pendingName
+}
+
+type nameCacheEntry struct {
+	id   uint32
+	name string
+}
+
+// pendingName is a lookup in progress; done is closed once name is set
+type pendingName struct {
+	done chan struct{}
+	name string
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{
+		entries: make(map[uint32]*list.Element),
+		order:   list.New(),
+		pending: make(map[uint32]*pendingName),
+	}
+}
+
+// lookup returns the name of id, calling resolve only when it is neither
+// cached nor already being resolved by another goroutine
+func (c *nameCache) lookup(id uint32, resolve func(uint32) string) string {
+	c.mu.Lock()
+	if elem, ok := c.entries[id]; ok {
+		c.order.MoveToFront(elem)
+		name := elem.Value.(*nameCacheEntry).name
+		c.mu.Unlock()
 		return name
 	}
+	if p, ok := c.pending[id]; ok {
+		c.mu.Unlock()
+		<-p.done
+		return p.name
+	}
+	p := &pendingName{done: make(chan struct{})}
+	c.pending[id] = p
+	c.mu.Unlock()
 
-	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
-	if err != nil {
-		userCache[uid] = strconv.FormatUint(uint64(uid), 10)
-	} else {
-		userCache[uid] = u.Username
+	p.name = resolve(id)
+
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.put(id, p.name)
+	c.mu.Unlock()
+	close(p.done)
+	return p.name
+}
+
+// put caches name for id; the caller holds mu
+func (c *nameCache) put(id uint32, name string) {
+	c.entries[id] = c.order.PushFront(&nameCacheEntry{id: id, name: name})
+	if c.limit > 0 && c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*nameCacheEntry).id)
 	}
-	return userCache[uid]
 }
 
-func getGroupName(gid uint32) string {
-	if name, ok := groupCache[gid]; ok {
-		return name
+// lookupUserId resolves a user name or numeric uid
+func lookupUserId(name string) (uint32, error) {
+	if u, err := user.Lookup(name); err == nil {
+		name = u.Uid
 	}
+	id, err := strconv.ParseUint(name, 10, 32)
+	return uint32(id), err
+}
 
-	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
-	if err != nil {
-		groupCache[gid] = strconv.FormatUint(uint64(gid), 10)
-	} else {
-		groupCache[gid] = g.Name
+// lookupGroupId resolves a group name or numeric gid
+func lookupGroupId(name string) (uint32, error) {
+	if g, err := user.LookupGroup(name); err == nil {
+		name = g.Gid
 	}
-	return groupCache[gid]
+	id, err := strconv.ParseUint(name, 10, 32)
+	return uint32(id), err
+}
+
+func getUserName(uid uint32) string {
+	return userCache.lookup(uid, func(uid uint32) string {
+		name := strconv.FormatUint(uint64(uid), 10)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		return name
+	})
+}
+
+func getGroupName(gid uint32) string {
+	return groupCache.lookup(gid, func(gid uint32) string {
+		name := strconv.FormatUint(uint64(gid), 10)
+		if g, err := user.LookupGroupId(name); err == nil {
+			name = g.Name
+		}
+		return name
+	})
 }
 
 func formatFlags(flags uint32) string {
@@ -956,6 +3435,184 @@ func formatFlags(flags uint32) string {
 	return strings.Join(flagParts, ",")
 }
 
+// Quoting styles for --quoting-style
+const (
+	QuoteLiteral     = "literal"
+	QuoteShell       = "shell"
+	QuoteShellAlways = "shell-always"
+	QuoteShellEscape = "shell-escape"
+	QuoteC           = "c"
+	QuoteEscape      = "escape"
+)
+
+// quoteName renders a file name for display according to -q and the
+// selected quoting style. --show-control-chars overrides both.
+func quoteName(name string) string {
+	if opts.ShowControl {
+		return name
+	}
+
+	// -b and -Q show control characters more precisely than the '?' of
+	// -q would
+	if opts.Quote && opts.QuotingStyle != QuoteC && opts.QuotingStyle != QuoteEscape {
+		name = quoteFileName(name)
+	}
+	return quoteStyle(name, opts.QuotingStyle)
+}
+
+// quoteStyle quotes name in the given --quoting-style
+func quoteStyle(name, style string) string {
+	switch style {
+	case QuoteShell:
+		return shellQuote(name, false)
+	case QuoteShellAlways:
+		return shellQuote(name, true)
+	case QuoteShellEscape:
+		return shellEscape(name)
+	case QuoteC:
+		return cQuote(name, true)
+	case QuoteEscape:
+		return cQuote(name, false)
+	default:
+		return name
+	}
+}
+
+// shellQuote wraps name in single quotes for a POSIX shell, either always
+// or only when it holds characters the shell would interpret. Unlike
+// shellEscape it leaves control characters as they are.
+func shellQuote(name string, always bool) string {
+	if !always && name != "" && strings.IndexFunc(name, needsShellQuote) < 0 {
+		return name
+	}
+	return "'" + strings.ReplaceAll(name, "'", `'\''`) + "'"
+}
+
+// shellEscape quotes name so it can be pasted into a POSIX shell. Names made
+// only of safe characters are left alone; otherwise the name is wrapped in
+// single quotes and control characters are written as $'\n' style escapes.
+func shellEscape(name string) string {
+	if name == "" {
+		return "''"
+	}
+	if strings.IndexFunc(name, needsShellQuote) < 0 {
+		return name
+	}
+
+	var result strings.Builder
+	quoted := false
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if (r == utf8.RuneError && size == 1) || unicode.IsControl(r) {
+			if quoted {
+				result.WriteByte('\'')
+				quoted = false
+			}
+			result.WriteString("$'")
+			for j := i; j < i+size; j++ {
+				result.WriteString(cEscape(name[j]))
+			}
+			result.WriteByte('\'')
+		} else {
+			if !quoted {
+				result.WriteByte('\'')
+				quoted = true
+			}
+			if r == '\'' {
+				result.WriteString(`'\''`)
+			} else {
+				result.WriteString(name[i : i+size])
+			}
+		}
+		i += size
+	}
+	if quoted {
+		result.WriteByte('\'')
+	}
+	return result.String()
+}
+
+func needsShellQuote(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	case strings.ContainsRune("%+,-./:=@_", r):
+		return false
+	case r > unicode.MaxASCII && r != utf8.RuneError:
+		return unicode.IsControl(r)
+	}
+	return true
+}
+
+// cQuote writes name with C backslash escapes for backslashes, control
+// characters and bytes that are not valid UTF-8. With quotes set it is
+// wrapped in double quotes as a C string literal, for -Q; otherwise spaces
+// are escaped instead, for -b.
+func cQuote(name string, quotes bool) string {
+	var result strings.Builder
+	if quotes {
+		result.WriteByte('"')
+	}
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		switch {
+		case r == '\\' || (quotes && r == '"') || (!quotes && r == ' '):
+			result.WriteByte('\\')
+			result.WriteRune(r)
+		case (r == utf8.RuneError && size == 1) || unicode.IsControl(r):
+			for j := i; j < i+size; j++ {
+				result.WriteString(cEscape(name[j]))
+			}
+		default:
+			result.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	if quotes {
+		result.WriteByte('"')
+	}
+	return result.String()
+}
+
+// cEscape returns the C backslash escape for a single byte
+func cEscape(b byte) string {
+	switch b {
+	case '\a':
+		return `\a`
+	case '\b':
+		return `\b`
+	case '\f':
+		return `\f`
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	case '\v':
+		return `\v`
+	}
+	return fmt.Sprintf("\\%03o", b)
+}
+
+// terminalWidth returns the width of the terminal on stdout, falling back to
+// $COLUMNS and then to 80 columns
+func terminalWidth() int {
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && ws.Col > 0 {
+		return int(ws.Col)
+	}
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+// isTerminal reports whether f is connected to a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	return err == nil
+}
+
 func quoteFileName(name string) string {
 	// Simple quote implementation - replace non-printable chars with ?
 	var result strings.Builder
@@ -969,6 +3626,56 @@ func quoteFileName(name string) string {
 	return result.String()
 }
 
+// displayWidth returns the number of terminal cells needed to print s.
+// Combining marks take no space and East Asian wide characters take two.
+func displayWidth(s string) int {
+	width := 0
+	for i := 0; i < len(s); {
+		if n := escapeLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		width += runeWidth(r)
+		i += size
+	}
+	return width
+}
+
+// runeWidth returns the number of terminal cells r takes
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case isWideRune(r):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// escapeLen returns the length of the ANSI escape sequence, such as a
+// color, that s starts with, or 0. Such sequences take no space on screen.
+func escapeLen(s string) int {
+	if len(s) < 2 || s[0] != '\033' || s[1] != '[' {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] >= 0x40 && s[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func isWideRune(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana) ||
+		(r >= 0x3000 && r <= 0x303f) || // CJK punctuation
+		(r >= 0xff00 && r <= 0xff60) || // fullwidth forms
+		(r >= 0xffe0 && r <= 0xffe6) ||
+		(r >= 0x1f300 && r <= 0x1faff) // emoji and pictographs
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,3320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+)
+
+func TestMain(m *testing.M) {
+	// lsCommand starts the test binary with LS_TEST_ARGS set to have it run
+	// as ls itself
+	if args, ok := os.LookupEnv("LS_TEST_ARGS"); ok {
+		os.Args = append([]string{"ls"}, strings.Split(args, argSeparator)...)
+		main()
+		os.Exit(0)
+	}
+
+	// Listings must not depend on where the tests run: times are shown in
+	// UTC, and standard output is never a terminal, so no test picks up
+	// terminal defaults such as -C or shell-escape quoting
+	time.Local = time.UTC
+	if isTerminal(os.Stdout) {
+		r, w, err := os.Pipe()
+		if err == nil {
+			go io.Copy(os.Stdout, r)
+			os.Stdout = w
+		}
+	}
+
+	pool = pond.New(8, 16)
+	code := m.Run()
+	pool.StopAndWait()
+	os.Exit(code)
+}
+
+// argSeparator joins the arguments in LS_TEST_ARGS
+const argSeparator = "\x1f"
+
+// lsCommand returns a command that runs ls with args
+func lsCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "LS_TEST_ARGS="+strings.Join(args, argSeparator))
+	return cmd
+}
+
+// lsStatus runs ls with args and returns its exit status and what it wrote
+// to stderr
+func lsStatus(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	var stderr bytes.Buffer
+	cmd := lsCommand(args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), stderr.String()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stderr.String()
+}
+
+// intPtr returns a pointer to n, for optional settings such as --precision
+func intPtr(n int) *int {
+	return &n
+}
+
+// setOptions replaces opts with o until the test ends
+func setOptions(t *testing.T, o Options) {
+	saved := opts
+	opts = o
+	t.Cleanup(func() { opts = saved })
+}
+
+// runLs lists the operands in args, parsed as on the command line, from
+// fake and returns what was written to standard output
+func runLs(t *testing.T, fake fileSystem, args ...string) string {
+	t.Helper()
+	return runLsEnv(t, nil, fake, args...)
+}
+
+// runLsWidth is runLs on a terminal width columns wide
+func runLsWidth(t *testing.T, width int, fake fileSystem, args ...string) string {
+	t.Helper()
+	return runLsEnv(t, map[string]string{"COLUMNS": strconv.Itoa(width)}, fake, args...)
+}
+
+// runLsEnv is runLs with the environment variables in env set
+func runLsEnv(t *testing.T, env map[string]string, fake fileSystem, args ...string) string {
+	t.Helper()
+	for _, name := range []string{"NO_COLOR", "LS_COLORS", "BLOCK_SIZE", "BLOCKSIZE", "COLORTERM", "TERM"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("COLUMNS", "80")
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	setOptions(t, Options{})
+	useFS(t, fake)
+
+	savedOut, savedDeco, savedColors := out, deco, lsColors
+	t.Cleanup(func() { out, deco, lsColors = savedOut, savedDeco, savedColors })
+	var buf bytes.Buffer
+	out = bufio.NewWriter(&buf)
+
+	files := parseArgs(args)
+	if opts.BlockSize == 0 && !opts.Kilobytes {
+		opts.BlockSize = envBlockSize()
+	}
+	if len(files) == 0 {
+		files = []string{"."}
+	}
+	processFiles(files)
+	out.Flush()
+	return buf.String()
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		size int64
+		want string
+	}{
+		{"bytes", Options{}, 1025, "1025"},
+		{"below a kilobyte", Options{Human: true}, 1023, "1023"},
+		{"one kilobyte", Options{Human: true}, 1024, "1.0K"},
+		{"rounds up", Options{Human: true}, 1025, "1.1K"},
+		{"last single digit", Options{Human: true}, 10137, "9.9K"},
+		{"first two digits", Options{Human: true}, 10138, "10K"},
+		{"two digits round up", Options{Human: true}, 10188, "10K"},
+		{"999K", Options{Human: true}, 999 * 1024, "999K"},
+		{"1000K", Options{Human: true}, 1000 * 1024, "1000K"},
+		{"carries into M", Options{Human: true}, 1023*1024 + 1, "1.0M"},
+		{"gigabytes", Options{Human: true}, 3 << 30, "3.0G"},
+		{"precision 0", Options{Human: true, Precision: intPtr(0)}, 1536, "2K"},
+		{"precision 1", Options{Human: true, Precision: intPtr(1)}, 1536, "1.5K"},
+		{"precision 2", Options{Human: true, Precision: intPtr(2)}, 1536, "1.50K"},
+		{"precision 2 rounds up", Options{Human: true, Precision: intPtr(2)}, 1025, "1.01K"},
+		{"precision 1 past one digit", Options{Human: true, Precision: intPtr(1)}, 100 * 1024, "100.0K"},
+		{"precision 0 carries into M", Options{Human: true, Precision: intPtr(0)}, 1023*1024 + 1, "1M"},
+		{"precision 3 below a kilobyte", Options{Human: true, Precision: intPtr(3)}, 512, "512"},
+		{"precision without -h", Options{Precision: intPtr(2)}, 1536, "1536"},
+		{"si below a kilobyte", Options{SI: true}, 999, "999"},
+		{"si one kilobyte", Options{SI: true}, 1000, "1.0kB"},
+		{"si 1024 bytes", Options{SI: true}, 1024, "1.1kB"},
+		{"-h 1000 bytes", Options{Human: true}, 1000, "1000"},
+		{"si wins over -h", Options{Human: true, SI: true}, 1000, "1.0kB"},
+		{"si two digits", Options{SI: true}, 10001, "11kB"},
+		{"si carries into MB", Options{SI: true}, 999_999, "1.0MB"},
+		{"si gigabytes", Options{SI: true}, 3_000_000_000, "3.0GB"},
+		{"si precision 2", Options{SI: true, Precision: intPtr(2)}, 1500, "1.50kB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOptions(t, tt.o)
+			if got := formatSize(tt.size); got != tt.want {
+				t.Errorf("formatSize(%d) = %q, want %q", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeDir(t *testing.T) {
+	fake := func() *fakeFS {
+		return newFakeFS(
+			fakeDir("/d"),
+			fakeDir("/d/keep"),
+			fakeReg("/d/keep/a", ""),
+			fakeDir("/d/skip"),
+			fakeReg("/d/skip/b", ""),
+			fakeDir("/d/keep/skip"),
+		)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"-R", "/d"},
+			"/d:\nkeep\nskip\n\n/d/keep:\na\nskip\n\n/d/keep/skip:\n\n/d/skip:\nb\n",
+		},
+		{
+			[]string{"-R", "--exclude-dir=skip", "/d"},
+			"/d:\nkeep\nskip\n\n/d/keep:\na\nskip\n",
+		},
+		{
+			[]string{"-R", "--exclude-dir=keep", "--exclude-dir=skip", "/d"},
+			"/d:\nkeep\nskip\n",
+		},
+		{
+			[]string{"--exclude-dir=skip", "/d/skip"},
+			"b\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake(), tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestColorizeMode(t *testing.T) {
+	const r, y, g, m, red = colorReset, colorYellow, colorGreen, colorSpecial, colorRed
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"-r--r--r--", "-r--r--r--"},
+		{"-rw-r--r--", "-r" + y + "w" + r + "-r--r--"},
+		{"drwxr-xr-x", "dr" + y + "w" + r + g + "x" + r + "r-" + g + "x" + r + "r-" + g + "x" + r},
+		{"-rw-rw-rw-", "-r" + y + "w" + r + "-r" + y + "w" + r + "-r" + red + "w" + r + "-"},
+		{"-rwsr-xr-T", "-r" + y + "w" + r + m + "s" + r + "r-" + g + "x" + r + "r-" + m + "T" + r},
+	}
+	for _, tt := range tests {
+		if got := colorizeMode(tt.mode); got != tt.want {
+			t.Errorf("colorizeMode(%q) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestBothSizes(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/big", mode: syscall.S_IFREG | 0644, content: strings.Repeat("x", 1000), mtime: old},
+		&fakeFile{path: "/d/small", mode: syscall.S_IFREG | 0644, content: "x", mtime: old},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"-ln", "/d"},
+			"total 3\n" +
+				"-rw-r--r-- 1 0 0 1000 Jan  2  2020 big\n" +
+				"-rw-r--r-- 1 0 0    1 Jan  2  2020 small\n",
+		},
+		{
+			[]string{"-ln", "--both-sizes", "/d"},
+			"total 3\n" +
+				"-rw-r--r-- 1 0 0 1000 1024 Jan  2  2020 big\n" +
+				"-rw-r--r-- 1 0 0    1  512 Jan  2  2020 small\n",
+		},
+		{
+			[]string{"-lnh", "--both-sizes", "/d"},
+			"total 3\n" +
+				"-rw-r--r-- 1 0 0 1000 1.0K Jan  2  2020 big\n" +
+				"-rw-r--r-- 1 0 0    1  512 Jan  2  2020 small\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"日本", 4},
+		{"한글", 4},
+		{"é", 1},
+		{"🎉x", 3},
+		{"\033[1;34mdir\033[0m", 3},
+	}
+	for _, tt := range tests {
+		if got := displayWidth(tt.s); got != tt.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSortNameLength(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/ccc", ""),
+		fakeReg("/d/日本", ""),
+		fakeReg("/d/dd", ""),
+		fakeReg("/d/a", ""),
+		fakeReg("/d/bb", ""),
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--sort=name-length", "/d"}, "a\nbb\ndd\nccc\n日本\n"},
+		{[]string{"--sort=name-length", "-r", "/d"}, "日本\nccc\ndd\nbb\na\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFileExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"main.go", ".go"},
+		{"archive.tar.gz", ".gz"},
+		{"Makefile", ""},
+		{".bashrc", ""},
+		{".config.yml", ".yml"},
+		{"trailing.", "."},
+	}
+	for _, tt := range tests {
+		if got := fileExtension(tt.name); got != tt.want {
+			t.Errorf("fileExtension(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtSummary(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a.go", "12345"),
+		fakeReg("/d/b.go", "123"),
+		fakeReg("/d/notes.txt", "1"),
+		fakeReg("/d/README", "12"),
+		fakeReg("/d/c.md", "1"),
+		fakeDir("/d/sub.d"),
+	)
+	want := "a.go\nb.go\nc.md\nnotes.txt\nREADME\nsub.d\n" +
+		"\nextension       count     size\n" +
+		".go                 2        8\n" +
+		"(none)              1        2\n" +
+		".md                 1        1\n" +
+		".txt                1        1\n"
+	if got := runLs(t, fake, "--ext-summary", "/d"); got != want {
+		t.Errorf("ls --ext-summary = %q, want %q", got, want)
+	}
+}
+
+func TestClosedStdout(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 2000 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%04d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		closeEarly bool
+	}{
+		{"reader stays", false},
+		{"reader gone", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stdout bytes.Buffer
+			copied := make(chan struct{})
+			if tt.closeEarly {
+				r.Close()
+				close(copied)
+			} else {
+				go func() {
+					io.Copy(&stdout, r)
+					r.Close()
+					close(copied)
+				}()
+			}
+
+			var stderr bytes.Buffer
+			cmd := lsCommand("-l", dir)
+			cmd.Stdout, cmd.Stderr = w, &stderr
+			err = cmd.Run()
+			w.Close()
+			<-copied
+
+			if err != nil {
+				t.Errorf("ls exited with %v, want success", err)
+			}
+			if stderr.Len() > 0 {
+				t.Errorf("ls wrote %q to stderr, want nothing", stderr.String())
+			}
+			if !tt.closeEarly && strings.Count(stdout.String(), "\n") != 2001 {
+				t.Errorf("ls wrote %d lines, want 2001", strings.Count(stdout.String(), "\n"))
+			}
+		})
+	}
+}
+
+func TestNameCacheLimit(t *testing.T) {
+	tests := []struct {
+		limit   int
+		lookups []uint32
+		resolve []uint32 // the ids that had to be resolved, in order
+	}{
+		{0, []uint32{1, 2, 1, 3, 2}, []uint32{1, 2, 3}},
+		{2, []uint32{1, 2, 1, 3, 2}, []uint32{1, 2, 3, 2}},
+		{2, []uint32{1, 2, 3, 1}, []uint32{1, 2, 3, 1}},
+		{1, []uint32{1, 1, 2, 1}, []uint32{1, 2, 1}},
+	}
+	for _, tt := range tests {
+		c := newNameCache()
+		c.limit = tt.limit
+		var resolved []uint32
+		for _, id := range tt.lookups {
+			name := c.lookup(id, func(id uint32) string {
+				resolved = append(resolved, id)
+				return fmt.Sprint("user", id)
+			})
+			if want := fmt.Sprint("user", id); name != want {
+				t.Errorf("limit %d: lookup(%d) = %q, want %q", tt.limit, id, name, want)
+			}
+		}
+		if fmt.Sprint(resolved) != fmt.Sprint(tt.resolve) {
+			t.Errorf("limit %d: lookups %v resolved %v, want %v", tt.limit, tt.lookups, resolved, tt.resolve)
+		}
+	}
+}
+
+func TestRecursiveReadsEachDirectoryOnce(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeDir("/d/a"),
+		fakeDir("/d/a/b"),
+		fakeReg("/d/a/b/f", ""),
+		fakeDir("/d/c"),
+	)
+	runLs(t, fake, "-R", "/d")
+	for _, dir := range []string{"/d", "/d/a", "/d/a/b", "/d/c"} {
+		if n := fake.dirOpens[dir]; n != 1 {
+			t.Errorf("-R opened %s %d times, want once", dir, n)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a", mode: syscall.S_IFREG | 0644, mtime: old},
+		&fakeFile{path: "/d/bb", mode: syscall.S_IFREG | 0644, mtime: old},
+		&fakeFile{path: "/d/ccc", mode: syscall.S_IFREG | 0644, mtime: old},
+	)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"single-column", "a\nbb\nccc\n"},
+		{"across", "a    bb   ccc\n"},
+		{"vertical", "a    bb   ccc\n"},
+		{"commas", "a, bb, ccc\n"},
+		{"long", "total 0\n" +
+			"-rw-r--r-- 1 0 0 0 Jan  2  2020 a\n" +
+			"-rw-r--r-- 1 0 0 0 Jan  2  2020 bb\n" +
+			"-rw-r--r-- 1 0 0 0 Jan  2  2020 ccc\n"},
+	}
+	for _, tt := range tests {
+		// -n implies -l, so it only joins --format=long, to keep the owner
+		// and group numeric
+		args := []string{"--format=" + tt.format, "/d"}
+		if tt.format == "long" {
+			args = append([]string{"-n"}, args...)
+		}
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls --format=%s = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	status, stderr := lsStatus(t, "--format=wide", os.DevNull)
+	if want := "ls: invalid argument 'wide' for '--format'\n"; status != 2 || stderr != want {
+		t.Errorf("ls --format=wide exited %d with %q, want 2 with %q", status, stderr, want)
+	}
+}
+
+func TestShellEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"plain-name_1.txt", "plain-name_1.txt"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"a\nb", `'a'$'\n''b'`},
+		{"\tlead", `$'\t''lead'`},
+		{"bad\xffbyte", `'bad'$'\377''byte'`},
+		{"héllo", "héllo"},
+		{"$HOME", "'$HOME'"},
+	}
+	for _, tt := range tests {
+		if got := shellEscape(tt.name); got != tt.want {
+			t.Errorf("shellEscape(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultQuoting(t *testing.T) {
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/a b", ""), fakeReg("/d/c", ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		// Standard output is not a terminal under test, so names are
+		// printed as they are unless a style is asked for
+		{[]string{"/d"}, "a b\nc\n"},
+		{[]string{"--quoting-style=shell-escape", "/d"}, "'a b'\nc\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestOwnerFilter(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/mine", mode: syscall.S_IFREG | 0644, uid: 1000, gid: 100},
+		&fakeFile{path: "/d/ours", mode: syscall.S_IFREG | 0644, uid: 1001, gid: 100},
+		&fakeFile{path: "/d/theirs", mode: syscall.S_IFREG | 0644, uid: 1001, gid: 200},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/d"}, "mine\nours\ntheirs\n"},
+		{[]string{"--user=1000", "/d"}, "mine\n"},
+		{[]string{"--group=100", "/d"}, "mine\nours\n"},
+		{[]string{"--user=1001", "--group=100", "/d"}, "ours\n"},
+		{[]string{"--user=4242", "/d"}, ""},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestLookupOwnerId(t *testing.T) {
+	tests := []struct {
+		name    string
+		lookup  func(string) (uint32, error)
+		value   string
+		want    uint32
+		wantErr bool
+	}{
+		{"numeric uid", lookupUserId, "1000", 1000, false},
+		{"root user", lookupUserId, "root", 0, false},
+		{"unknown user", lookupUserId, "no-such-user-here", 0, true},
+		{"uid out of range", lookupUserId, "4294967296", 0, true},
+		{"numeric gid", lookupGroupId, "100", 100, false},
+		{"unknown group", lookupGroupId, "no-such-group-here", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.lookup(tt.value)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("%s: lookup(%q) = %d, %v; want %d, error %v", tt.name, tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePermFilter(t *testing.T) {
+	tests := []struct {
+		value   string
+		kind    byte
+		bits    uint32
+		wantErr bool
+	}{
+		{"644", '=', 0644, false},
+		{"-4000", '-', 04000, false},
+		{"/022", '/', 0022, false},
+		{"0", '=', 0, false},
+		{"7777", '=', 07777, false},
+		{"17777", 0, 0, true},
+		{"rwx", 0, 0, true},
+		{"-", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		filter, err := parsePermFilter(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePermFilter(%q) = %+v, want an error", tt.value, filter)
+			}
+			continue
+		}
+		if err != nil || filter.kind != tt.kind || filter.bits != tt.bits {
+			t.Errorf("parsePermFilter(%q) = %+v, %v; want {%c %o}", tt.value, filter, err, tt.kind, tt.bits)
+		}
+	}
+}
+
+func TestMatchesPerm(t *testing.T) {
+	tests := []struct {
+		filter string
+		mode   fs.FileMode
+		want   bool
+	}{
+		{"644", 0644, true},
+		{"644", 0664, false},
+		{"-600", 0644, true},
+		{"-600", 0400, false},
+		{"-4000", fs.ModeSetuid | 0755, true},
+		{"-4000", 0755, false},
+		{"/022", 0644, false},
+		{"/022", 0664, true},
+		{"/022", 0646, true},
+		{"/0", 0600, true},
+		{"1777", fs.ModeDir | fs.ModeSticky | 0777, true},
+	}
+	for _, tt := range tests {
+		filter, err := parsePermFilter(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setOptions(t, Options{Perm: filter})
+		if got := matchesPerm(FileInfo{Mode: tt.mode}); got != tt.want {
+			t.Errorf("--perm=%s on %v = %v, want %v", tt.filter, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestOutputCoordinator(t *testing.T) {
+	// Each step writes to or completes one of three writers; want is what
+	// has reached the underlying writer after the step
+	type step struct {
+		writer int
+		text   string // written when not empty, else the writer completes
+		want   string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{
+			{0, "a", "a"},
+			{0, "", "a"},
+			{1, "b", "ab"},
+			{1, "", "ab"},
+			{2, "c", "abc"},
+			{2, "", "abc"},
+		}},
+		{"later writers wait", []step{
+			{2, "c", ""},
+			{1, "b", ""},
+			{0, "a", "a"},
+			{2, "", "a"},
+			{0, "", "ab"},
+			{1, "B", "abB"},
+			{1, "", "abBc"},
+		}},
+		{"head streams", []step{
+			{1, "b1", ""},
+			{0, "a1", "a1"},
+			{0, "a2", "a1a2"},
+			{0, "", "a1a2b1"},
+			{1, "b2", "a1a2b1b2"},
+			{2, "c", "a1a2b1b2"},
+			{1, "", "a1a2b1b2c"},
+			{2, "", "a1a2b1b2c"},
+		}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		c := newOutputCoordinator(&out)
+		writers := []*orderedWriter{c.reserve(), c.reserve(), c.reserve()}
+		for i, s := range tt.steps {
+			if s.text != "" {
+				fmt.Fprint(writers[s.writer], s.text)
+			} else {
+				c.complete(writers[s.writer])
+			}
+			if out.String() != s.want {
+				t.Errorf("%s: after step %d the output is %q, want %q", tt.name, i, out.String(), s.want)
+			}
+		}
+	}
+}
+
+func TestOutputCoordinatorConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	c := newOutputCoordinator(&out)
+	var want strings.Builder
+	var wg sync.WaitGroup
+	for i := range 50 {
+		w := c.reserve()
+		for j := range 20 {
+			fmt.Fprintf(&want, "%d.%d\n", i, j)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				fmt.Fprintf(w, "%d.%d\n", i, j)
+			}
+			c.complete(w)
+		}()
+	}
+	wg.Wait()
+	if out.String() != want.String() {
+		t.Errorf("concurrent writers interleaved:\n%s", out.String())
+	}
+}
+
+func TestDirectoryOperandOrder(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/b"), fakeReg("/b/1", ""),
+		fakeDir("/a"), fakeReg("/a/2", ""),
+		fakeDir("/c"), fakeReg("/c/3", ""),
+		fakeReg("/file", ""),
+	)
+	want := "/file\n\n/a:\n2\n\n/b:\n1\n\n/c:\n3\n"
+	for _, jobs := range []string{"1", "2", "8"} {
+		if got := runLs(t, fake, "-j", jobs, "/c", "/b", "/file", "/a"); got != want {
+			t.Errorf("ls -j %s = %q, want %q", jobs, got, want)
+		}
+	}
+}
+
+func TestShowControlChars(t *testing.T) {
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/a\tb", ""), fakeReg("/d/c d", ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-q", "/d"}, "a?b\nc d\n"},
+		{[]string{"--quoting-style=shell-escape", "/d"}, "'a'$'\\t''b'\n'c d'\n"},
+		{[]string{"-q", "--show-control-chars", "/d"}, "a\tb\nc d\n"},
+		{[]string{"--quoting-style=shell-escape", "--show-control-chars", "/d"}, "a\tb\nc d\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFileModeFromStat(t *testing.T) {
+	tests := []struct {
+		mode uint32
+		want fs.FileMode
+	}{
+		{syscall.S_IFREG | 0644, 0644},
+		{syscall.S_IFDIR | 0755, fs.ModeDir | 0755},
+		{syscall.S_IFLNK | 0777, fs.ModeSymlink | 0777},
+		{syscall.S_IFBLK | 0660, fs.ModeDevice | 0660},
+		{syscall.S_IFCHR | 0666, fs.ModeDevice | fs.ModeCharDevice | 0666},
+		{syscall.S_IFIFO | 0600, fs.ModeNamedPipe | 0600},
+		{syscall.S_IFSOCK | 0755, fs.ModeSocket | 0755},
+		{syscall.S_IFREG | syscall.S_ISUID | 0755, fs.ModeSetuid | 0755},
+		{syscall.S_IFDIR | syscall.S_ISGID | 0755, fs.ModeDir | fs.ModeSetgid | 0755},
+		{syscall.S_IFDIR | syscall.S_ISVTX | 0777, fs.ModeDir | fs.ModeSticky | 0777},
+	}
+	for _, tt := range tests {
+		if got := fileModeFromStat(tt.mode); got != tt.want {
+			t.Errorf("fileModeFromStat(%#o) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSortType(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a-fifo", mode: syscall.S_IFIFO | 0644},
+		fakeReg("/d/b-file", ""),
+		&fakeFile{path: "/d/c-dev", mode: syscall.S_IFBLK | 0660},
+		fakeLink("/d/d-link", "b-file"),
+		fakeDir("/d/e-dir"),
+		fakeReg("/d/f-file", ""),
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--sort=type", "/d"}, "e-dir\nd-link\nb-file\nf-file\nc-dev\na-fifo\n"},
+		{[]string{"--sort=type", "-r", "/d"}, "a-fifo\nc-dev\nf-file\nb-file\nd-link\ne-dir\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateToWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abcdef", 3, "abc"},
+		{"abc", 5, "abc"},
+		{"abc", 0, ""},
+		{"日本語", 5, "日本"},
+		{"日本語", 1, ""},
+		{"\033[31mred\033[0m", 2, "\033[31mre"},
+	}
+	for _, tt := range tests {
+		if got := truncateToWidth(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncateToWidth(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestFitToWidth(t *testing.T) {
+	tests := []struct {
+		wrap  string
+		line  string
+		width int
+		want  string
+	}{
+		{"wrap", "short", 10, "short"},
+		{"wrap", "abcdefghij", 4, "abcd\n  ef\n  gh\n  ij"},
+		{"wrap", "日本語テキスト", 6, "日本語\n  テキ\n  スト"},
+		{"wrap", "日本", 1, "日\n  本"},
+		{"truncate", "abcdefghij", 6, "abcde…"},
+		{"truncate", "short", 10, "short"},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Wrap: tt.wrap})
+		if got := fitToWidth(tt.line, tt.width); got != tt.want {
+			t.Errorf("--wrap=%s: fitToWidth(%q, %d) = %q, want %q", tt.wrap, tt.line, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestWrapOneColumn(t *testing.T) {
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/"+strings.Repeat("n", 100), ""), fakeReg("/d/short", ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "/d"}, strings.Repeat("n", 100) + "\nshort\n"},
+		{[]string{"-1", "--wrap", "/d"}, strings.Repeat("n", 80) + "\n  " + strings.Repeat("n", 20) + "\nshort\n"},
+		{[]string{"-1", "--wrap=truncate", "/d"}, strings.Repeat("n", 79) + "…\nshort\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPrintRealpath(t *testing.T) {
+	// EvalSymlinks reports the temporary directory as the kernel sees it
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		operand string
+		want    string
+	}{
+		{target, target + " -> " + target + "\n"},
+		{link, link + " -> " + target + "\n"},
+		{dir + "/./link", dir + "/./link -> " + target + "\n"},
+	}
+	for _, tt := range tests {
+		status, stderr := lsStatus(t, "--print-realpath", tt.operand)
+		if status != 0 || stderr != tt.want {
+			t.Errorf("ls --print-realpath %s exited %d with %q, want 0 with %q", tt.operand, status, stderr, tt.want)
+		}
+	}
+
+	// An operand that cannot be resolved is left to the listing to report
+	missing := filepath.Join(dir, "missing")
+	if _, stderr := lsStatus(t, "--print-realpath", missing); strings.Contains(stderr, " -> ") {
+		t.Errorf("ls --print-realpath %s wrote %q, want no resolved path", missing, stderr)
+	}
+}
+
+func TestIsWhiteout(t *testing.T) {
+	// A temporary directory is not on overlayfs, so a 0/0 character device
+	// there is an ordinary device node
+	path := t.TempDir()
+	tests := []struct {
+		name string
+		mode uint32
+		want bool
+	}{
+		{"bsd whiteout", S_IFWHT, true},
+		{"0/0 char device off overlayfs", syscall.S_IFCHR | 0600, false},
+		{"block device", syscall.S_IFBLK | 0600, false},
+		{"regular file", syscall.S_IFREG | 0644, false},
+	}
+	for _, tt := range tests {
+		var stat syscall.Stat_t
+		setUint(&stat.Mode, uint64(tt.mode))
+		if got := isWhiteout(path, &stat); got != tt.want {
+			t.Errorf("%s: isWhiteout = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShouldSkipEntry(t *testing.T) {
+	tests := []struct {
+		o     Options
+		entry FileInfo
+		want  bool
+	}{
+		{Options{}, FileInfo{Name: "file"}, false},
+		{Options{}, FileInfo{Name: ".hidden"}, true},
+		{Options{}, FileInfo{Name: "gone", IsWhiteout: true}, true},
+		{Options{AlmostAll: true}, FileInfo{Name: ".hidden"}, false},
+		{Options{AlmostAll: true}, FileInfo{Name: ".."}, true},
+		{Options{AlmostAll: true}, FileInfo{Name: "gone", IsWhiteout: true}, true},
+		{Options{All: true}, FileInfo{Name: ".."}, false},
+		{Options{All: true}, FileInfo{Name: "gone", IsWhiteout: true}, false},
+	}
+	for _, tt := range tests {
+		setOptions(t, tt.o)
+		if got := shouldSkipEntry(tt.entry); got != tt.want {
+			t.Errorf("-a=%v -A=%v: shouldSkipEntry(%+v) = %v, want %v", tt.o.All, tt.o.AlmostAll, tt.entry, got, tt.want)
+		}
+	}
+}
+
+// sortedNames sorts files with the current options and returns their names
+func sortedNames(files []FileInfo) string {
+	sorted := append([]FileInfo(nil), files...)
+	sortFiles(sorted)
+	names := make([]string, len(sorted))
+	for i, file := range sorted {
+		names[i] = file.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func TestCompoundSortKeys(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	files := []FileInfo{
+		{Name: "a", Size: 10, ModTime: older},
+		{Name: "b", Size: 20, ModTime: older},
+		{Name: "c", Size: 10, ModTime: newer},
+		{Name: "d", Size: 20, ModTime: newer},
+	}
+	tests := []struct {
+		sort []string
+		want string
+	}{
+		{[]string{"size"}, "b d a c"},
+		{[]string{"mtime"}, "c d a b"},
+		{[]string{"mtime", "size"}, "d c b a"},
+		{[]string{"size", "mtime"}, "d b c a"},
+		{[]string{"size", "mtime", "name"}, "d b c a"},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Sort: tt.sort})
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("--sort=%s = %s, want %s", strings.Join(tt.sort, ","), got, tt.want)
+		}
+	}
+
+	status, stderr := lsStatus(t, "--sort=size,bogus", os.DevNull)
+	if want := "ls: invalid argument 'size,bogus' for '--sort'\n"; status != 2 || stderr != want {
+		t.Errorf("ls --sort=size,bogus exited %d with %q, want 2 with %q", status, stderr, want)
+	}
+}
+
+func TestFastSymlinks(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/link", mode: syscall.S_IFLNK | 0777, target: "nowhere", mtime: old},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-ln", "/d"}, "total 1\nlrwxrwxrwx 1 0 0 7 Jan  2  2020 link -> nowhere\n"},
+		{[]string{"-ln", "--fast-symlinks", "/d"}, "total 1\nlrwxrwxrwx 1 0 0 7 Jan  2  2020 link\n"},
+		{[]string{"-ln", "/d/link"}, "total 1\nlrwxrwxrwx 1 0 0 7 Jan  2  2020 /d/link -> nowhere\n"},
+		{[]string{"-ln", "--fast-symlinks", "/d/link"}, "total 1\nlrwxrwxrwx 1 0 0 7 Jan  2  2020 /d/link\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestASCIIDecorations(t *testing.T) {
+	long := strings.Repeat("n", 100)
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/"+long, ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "--wrap=truncate", "/d"}, strings.Repeat("n", 79) + "…\n"},
+		{[]string{"-1", "--wrap=truncate", "--ascii", "/d"}, strings.Repeat("n", 77) + "...\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSortDirections(t *testing.T) {
+	files := []FileInfo{
+		{Name: "b", Size: 10},
+		{Name: "a", Size: 10},
+		{Name: "c", Size: 20},
+		{Name: "d", Size: 20},
+	}
+	tests := []struct {
+		o    Options
+		want string
+	}{
+		{Options{}, "a b c d"},
+		{Options{Reverse: true}, "d c b a"},
+		{Options{ReverseNames: true}, "a b c d"},
+		{Options{SizeSort: true}, "c d a b"},
+		{Options{SizeSort: true, Reverse: true}, "b a d c"},
+		{Options{SizeSort: true, ReverseNames: true}, "d c b a"},
+		{Options{SizeSort: true, Reverse: true, ReverseNames: true}, "a b c d"},
+		{Options{Sort: []string{"size"}, ReverseNames: true}, "d c b a"},
+	}
+	for _, tt := range tests {
+		setOptions(t, tt.o)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("-S=%v -r=%v --sort-reverse-only-names=%v: %s, want %s",
+				tt.o.SizeSort || len(tt.o.Sort) > 0, tt.o.Reverse, tt.o.ReverseNames, got, tt.want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"2d", 48 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"-1d", 0, true},
+		{"-5m", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.value)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseAge(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	now := time.Now()
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/hour", mode: syscall.S_IFREG | 0644, mtime: now.Add(-time.Hour)},
+		&fakeFile{path: "/d/minute", mode: syscall.S_IFREG | 0644, mtime: now.Add(-time.Minute)},
+		&fakeFile{path: "/d/week", mode: syscall.S_IFREG | 0644, mtime: now.Add(-7 * 24 * time.Hour)},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/d"}, "hour\nminute\nweek\n"},
+		{[]string{"--since=2h", "/d"}, "minute\nhour\n"},
+		{[]string{"--since=2h", "-r", "/d"}, "hour\nminute\n"},
+		{[]string{"--since=30d", "/d"}, "minute\nhour\nweek\n"},
+		{[]string{"--since=10s", "/d"}, ""},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestStatTimeout(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/fast", mode: syscall.S_IFREG | 0644, mtime: old},
+		&fakeFile{path: "/d/stuck", mode: syscall.S_IFREG | 0644, mtime: old},
+	)
+	fake.lstatDelays["/d/stuck"] = 300 * time.Millisecond
+
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+	}{
+		{
+			[]string{"-ln", "/d"},
+			"total 0\n" +
+				"-rw-r--r-- 1 0 0 0 Jan  2  2020 fast\n" +
+				"-rw-r--r-- 1 0 0 0 Jan  2  2020 stuck\n",
+			"",
+		},
+		{
+			[]string{"-ln", "--stat-timeout=20ms", "/d"},
+			"total 0\n" +
+				"-rw-r--r-- 1 0 0 0 Jan  2  2020 fast\n" +
+				"-????????? ? ? ? ? ?            stuck\n",
+			"ls: /d/stuck: stat timed out\n",
+		},
+		{
+			[]string{"-ln", "--stat-timeout=20ms", "--time-style=iso", "/d"},
+			"total 0\n" +
+				"-rw-r--r-- 1 0 0 0 2020-01-02  fast\n" +
+				"-????????? ? ? ? ? ?           stuck\n",
+			"ls: /d/stuck: stat timed out\n",
+		},
+		{
+			[]string{"-ln", "--stat-timeout=20ms", "--time-style=long-iso", "/d"},
+			"total 0\n" +
+				"-rw-r--r-- 1 0 0 0 2020-01-02 03:04 fast\n" +
+				"-????????? ? ? ? ? ?                stuck\n",
+			"ls: /d/stuck: stat timed out\n",
+		},
+	}
+	for _, tt := range tests {
+		stderr := captureStderr(t)
+		got := runLs(t, fake, tt.args...)
+		// The stuck stat outlives the run; let it finish before the
+		// options it reads change
+		timedStats.Wait()
+		if got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if got := stderr(); got != tt.stderr {
+			t.Errorf("ls %v wrote %q to stderr, want %q", tt.args, got, tt.stderr)
+		}
+	}
+}
+
+func TestUniqueHardlinks(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3},
+		&fakeFile{path: "/d/b", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3},
+		&fakeFile{path: "/d/c", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3},
+		&fakeFile{path: "/d/other", mode: syscall.S_IFREG | 0644, ino: 60, nlink: 2},
+		fakeReg("/d/single", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "/d"}, "a\nb\nc\nother\nsingle\n"},
+		{[]string{"-1", "--unique-hardlinks", "/d"}, "a (3 names)\nother\nsingle\n"},
+		{[]string{"-1r", "--unique-hardlinks", "/d"}, "single\nother\nc (3 names)\n"},
+		{[]string{"-1", "--unique-hardlinks", "/d/b", "/d/a", "/d/single"}, "/d/a (2 names)\n/d/single\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesName(t *testing.T) {
+	tests := []struct {
+		match, imatch []string
+		name          string
+		want          bool
+	}{
+		{nil, nil, "anything", true},
+		{[]string{"port"}, nil, "report.txt", true},
+		{[]string{"port"}, nil, "REPORT.txt", false},
+		{[]string{"port"}, nil, "notes.txt", false},
+		{[]string{"xyz", ".txt"}, nil, "notes.txt", true},
+		{nil, []string{"port"}, "REPORT.txt", true},
+		{nil, []string{"port"}, "notes.txt", false},
+		{[]string{"xyz"}, []string{"note"}, "Notes.txt", true},
+		{[]string{""}, nil, "anything", true},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Match: tt.match, IMatch: tt.imatch})
+		if got := matchesName(FileInfo{Name: tt.name}); got != tt.want {
+			t.Errorf("matchesName(%q) with --match=%q --imatch=%q = %v, want %v",
+				tt.name, tt.match, tt.imatch, got, tt.want)
+		}
+	}
+}
+
+func TestMatchListing(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/REPORT.md", "12345"),
+		fakeReg("/d/report.txt", "123"),
+		fakeReg("/d/notes.txt", "1"),
+	)
+	for _, f := range fake.files {
+		f.mtime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "--match=port", "/d"}, "report.txt\n"},
+		{[]string{"-1", "--imatch=PORT", "/d"}, "REPORT.md\nreport.txt\n"},
+		{[]string{"-1", "--match", "notes", "--match=.md", "/d"}, "notes.txt\nREPORT.md\n"},
+		{[]string{"-s1", "--imatch=report", "/d"}, "     1 REPORT.md\n     1 report.txt\n"},
+		{
+			[]string{"-ln", "--imatch=report", "/d"},
+			"total 2\n" +
+				"-rw-r--r-- 1 0 0 5 Jan  2  2020 REPORT.md\n" +
+				"-rw-r--r-- 1 0 0 3 Jan  2  2020 report.txt\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestLinkColor(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		&fakeFile{path: "/d", mode: syscall.S_IFDIR | 0755, nlink: 5, mtime: stamp},
+		&fakeFile{path: "/d/one", mode: syscall.S_IFREG | 0644, nlink: 1, mtime: stamp},
+		&fakeFile{path: "/d/three", mode: syscall.S_IFREG | 0644, nlink: 3, mtime: stamp},
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-ln", "/d/one", "/d/three"}, "total 0\n-rw-r--r-- 1 0 0 0 Jan  2  2020 /d/one\n-rw-r--r-- 3 0 0 0 Jan  2  2020 /d/three\n"},
+		{[]string{"-ln", "--link-color", "/d/one", "/d/three"}, "total 0\n-rw-r--r-- 1 0 0 0 Jan  2  2020 /d/one\n-rw-r--r-- " + colorCyan + "3" + colorReset + " 0 0 0 Jan  2  2020 /d/three\n"},
+		{[]string{"-ln", "--link-color=2", "/d/one", "/d/three"}, "total 0\n-rw-r--r-- 1 0 0 0 Jan  2  2020 /d/one\n-rw-r--r-- " + colorCyan + "3" + colorReset + " 0 0 0 Jan  2  2020 /d/three\n"},
+		{[]string{"-ln", "--link-color=3", "/d/one", "/d/three"}, "total 0\n-rw-r--r-- 1 0 0 0 Jan  2  2020 /d/one\n-rw-r--r-- 3 0 0 0 Jan  2  2020 /d/three\n"},
+		{[]string{"-lnd", "--link-color", "/d"}, "total 0\ndrwxr-xr-x 5 0 0 0 Jan  2  2020 /d\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEllipsize(t *testing.T) {
+	tests := []struct {
+		deco  decorations
+		s     string
+		width int
+		want  string
+	}{
+		{unicodeDecorations, "abcdef", 6, "abcdef"},
+		{unicodeDecorations, "abcdef", 4, "abc…"},
+		{asciiDecorations, "abcdef", 5, "ab..."},
+		{unicodeDecorations, "\033[31mabcdef\033[0m", 4, "\033[31mabc\033[0m…"},
+	}
+	saved := deco
+	defer func() { deco = saved }()
+	for _, tt := range tests {
+		deco = tt.deco
+		if got := ellipsize(tt.s, tt.width); got != tt.want {
+			t.Errorf("ellipsize(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestStrictWidth(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", ""),
+		fakeReg("/d/a-name-much-wider-than-the-terminal", ""),
+		fakeReg("/d/b", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-C", "--strict-width", "/d"}, "a\na-name-much-wider-t…\nb\n"},
+		{[]string{"-x", "--strict-width", "/d"}, "a\na-name-much-wider-t…\nb\n"},
+		{[]string{"-m", "--strict-width", "/d"}, "a,\na-name-much-wider-…,\nb\n"},
+		{[]string{"-C", "/d"}, "a\na-name-much-wider-than-the-terminal\nb\n"},
+	}
+	for _, tt := range tests {
+		got := runLsWidth(t, 20, fake, tt.args...)
+		if got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if !slices.Contains(tt.args, "--strict-width") {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+			if w := displayWidth(line); w > 20 {
+				t.Errorf("ls %v printed %q, %d columns wide", tt.args, line, w)
+			}
+		}
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "just now"},
+		{59 * time.Second, "just now"},
+		{time.Minute, "1m ago"},
+		{59*time.Minute + 59*time.Second, "59m ago"},
+		{time.Hour, "1h ago"},
+		{23 * time.Hour, "23h ago"},
+		{24 * time.Hour, "1d ago"},
+		{6*24*time.Hour + 23*time.Hour, "6d ago"},
+		{7 * 24 * time.Hour, "1w ago"},
+		{30 * 24 * time.Hour, "4w ago"},
+	}
+	for _, tt := range tests {
+		if got := formatAge(tt.age); got != tt.want {
+			t.Errorf("formatAge(%v) = %q, want %q", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestRelativeTimeThreshold(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-2*time.Hour - time.Minute)
+	old := now.AddDate(-1, 0, -3)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		style     string
+		threshold time.Duration
+		t         time.Time
+		want      string
+	}{
+		{"locale", 24 * time.Hour, recent, "      2h ago"},
+		{"locale", 24 * time.Hour, old, old.Format("Jan _2  2006")},
+		{"locale", 24 * time.Hour, future, future.Format("Jan _2  2006")},
+		{"locale", time.Hour, recent, recent.Format("Jan _2 15:04")},
+		{"locale", 0, recent, recent.Format("Jan _2 15:04")},
+		{"iso", 24 * time.Hour, recent, "     2h ago"},
+		{"iso", 24 * time.Hour, old, old.Format("2006-01-02 ")},
+		{"iso", time.Hour, recent, recent.Format("01-02 15:04")},
+		{"long-iso", 24 * time.Hour, recent, recent.Format("2006-01-02 15:04")},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, "--time-style="+tt.style)
+		opts.RelativeTime = tt.threshold
+		if got := formatTime(tt.t); got != tt.want {
+			t.Errorf("--time-style=%s: formatTime(%v) with threshold %v = %q, want %q", tt.style, tt.t, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestNullsLast(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "lost1", StatFailed: true},
+		{Name: "big", Size: 300, ModTime: stamp},
+		{Name: "lost2", StatFailed: true},
+		{Name: "small", Size: 1, ModTime: stamp.Add(time.Hour)},
+		{Name: "dir", IsDir: true, Size: 50, ModTime: stamp.Add(-time.Hour)},
+	}
+	tests := []struct {
+		flags string
+		o     Options
+		want  string
+	}{
+		{"-S", Options{SizeSort: true}, "big dir small lost1 lost2"},
+		{"-S --nulls-last", Options{SizeSort: true, NullsLast: true}, "big dir small lost1 lost2"},
+		{"-Sr", Options{SizeSort: true, Reverse: true}, "lost2 lost1 small dir big"},
+		{"-Sr --nulls-last", Options{SizeSort: true, Reverse: true, NullsLast: true}, "small dir big lost2 lost1"},
+		{"-t --nulls-last", Options{TimeSort: true, NullsLast: true}, "small big dir lost1 lost2"},
+		{"-tr --nulls-last", Options{TimeSort: true, Reverse: true, NullsLast: true}, "dir big small lost2 lost1"},
+		{"-r --nulls-last", Options{Reverse: true, NullsLast: true}, "small dir big lost2 lost1"},
+		{"-r --group-directories-first --nulls-last", Options{DirsFirst: true, Reverse: true, NullsLast: true}, "dir small big lost2 lost1"},
+	}
+	for _, tt := range tests {
+		setOptions(t, tt.o)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestSkipEmptyHeaders(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/top", ""),
+		fakeDir("/d/empty"),
+		fakeDir("/d/hollow"),
+		fakeDir("/d/hollow/deep"),
+		fakeReg("/d/hollow/deep/leaf", ""),
+		fakeDir("/d/hidden"),
+		fakeReg("/d/hidden/.dot", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"-R1", "/d"},
+			"/d:\nempty\nhidden\nhollow\ntop\n" +
+				"\n/d/empty:\n" +
+				"\n/d/hidden:\n" +
+				"\n/d/hollow:\ndeep\n" +
+				"\n/d/hollow/deep:\nleaf\n",
+		},
+		{
+			[]string{"-R1", "--skip-empty-headers", "/d"},
+			"/d:\nempty\nhidden\nhollow\ntop\n" +
+				"\n/d/hollow:\ndeep\n" +
+				"\n/d/hollow/deep:\nleaf\n",
+		},
+		{
+			[]string{"-R1", "--skip-empty-headers", "/d/hollow", "/d/empty"},
+			"/d/empty:\n" +
+				"\n/d/hollow:\ndeep\n" +
+				"\n/d/hollow/deep:\nleaf\n",
+		},
+		{
+			[]string{"-R1A", "--skip-empty-headers", "/d"},
+			"/d:\nempty\nhidden\nhollow\ntop\n" +
+				"\n/d/hidden:\n.dot\n" +
+				"\n/d/hollow:\ndeep\n" +
+				"\n/d/hollow/deep:\nleaf\n",
+		},
+		{
+			[]string{"-Rm", "--skip-empty-headers", "/d"},
+			"/d:\nempty, hidden, hollow, top\n" +
+				"\n/d/hollow:\ndeep\n" +
+				"\n/d/hollow/deep:\nleaf\n",
+		},
+		{
+			[]string{"-R1", "--skip-empty-headers", "--ext-summary", "/d"},
+			"/d:\nempty\nhidden\nhollow\ntop\n\nextension       count     size\n(none)              1        0\n" +
+				"\n/d/hollow:\ndeep\n\nextension       count     size\n" +
+				"\n/d/hollow/deep:\nleaf\n\nextension       count     size\n(none)              1        0\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSortTime(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	tests := []struct {
+		unit string
+		want time.Time
+	}{
+		{"ns", stamp},
+		{"us", time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)},
+		{"ms", time.Date(2020, 1, 2, 3, 4, 5, 123000000, time.UTC)},
+		{"s", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{TimeResolution: timeResolutions[tt.unit]})
+		if got := sortTime(stamp); !got.Equal(tt.want) {
+			t.Errorf("sortTime(%v) with --time-resolution=%s = %v, want %v", stamp, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSortNanoseconds(t *testing.T) {
+	dir := t.TempDir()
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 100, time.UTC)
+	// b is modified a nanosecond after a
+	for i, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := stamp.Add(time.Duration(i) * time.Nanosecond)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Skipf("%s does not keep nanosecond timestamps", dir)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1t", dir}, "b\na\n"},
+		{[]string{"-1tr", dir}, "a\nb\n"},
+		{[]string{"-1t", "--time-resolution=ns", dir}, "b\na\n"},
+		{[]string{"-1t", "--time-resolution=us", dir}, "a\nb\n"},
+		{[]string{"-1t", "--time-resolution=s", dir}, "a\nb\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, osFileSystem{}, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPreserveArgOrder(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/a"),
+		fakeReg("/a/1", ""),
+		fakeDir("/b"),
+		fakeReg("/b/2", ""),
+		fakeDir("/c"),
+		fakeReg("/c/3", ""),
+		fakeReg("/y", ""),
+		fakeReg("/x", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "/c", "/a", "/b"}, "/a:\n1\n\n/b:\n2\n\n/c:\n3\n"},
+		{[]string{"-1", "--preserve-arg-order", "/c", "/a", "/b"}, "/c:\n3\n\n/a:\n1\n\n/b:\n2\n"},
+		{[]string{"-1r", "--preserve-arg-order", "/c", "/a", "/b"}, "/c:\n3\n\n/a:\n1\n\n/b:\n2\n"},
+		{[]string{"-1", "--preserve-arg-order", "/b", "/y", "/a", "/x"}, "/x\n/y\n\n/b:\n2\n\n/a:\n1\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPermStyle(t *testing.T) {
+	tests := []struct {
+		style string
+		mode  fs.FileMode
+		want  string
+	}{
+		{PermSymbolic, 0644, "-rw-r--r--"},
+		{PermOctal, 0644, "0644"},
+		{PermBoth, 0644, "0644 (rw-r--r--)"},
+		{PermOctal, fs.ModeDir | 0755, "0755"},
+		{PermBoth, fs.ModeDir | 0755, "0755 (rwxr-xr-x)"},
+		{PermSymbolic, fs.ModeSetuid | 0755, "-rwsr-xr-x"},
+		{PermOctal, fs.ModeSetuid | 0755, "4755"},
+		{PermBoth, fs.ModeSetgid | 0750, "2750 (rwxr-s---)"},
+		{PermSymbolic, fs.ModeDir | fs.ModeSticky | 0777, "drwxrwxrwt"},
+		{PermOctal, fs.ModeDir | fs.ModeSticky | 0777, "1777"},
+		{PermBoth, fs.ModeDir | fs.ModeSticky | 0776, "1776 (rwxrwxrwT)"},
+		{PermOctal, fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky, "7000"},
+		{PermBoth, fs.ModeSetuid | fs.ModeSetgid, "6000 (--S--S---)"},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{PermStyle: tt.style})
+		if got := styleMode(formatMode(tt.mode, false), tt.mode); got != tt.want {
+			t.Errorf("--perm-style=%s of %v = %q, want %q", tt.style, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestDirectoryWithRecursive(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeDir("/d/sub"),
+		fakeReg("/d/sub/deep", ""),
+		fakeReg("/d/file", ""),
+		fakeDir("/e"),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1d", "/d"}, "/d\n"},
+		{[]string{"-1dR", "/d"}, "/d\n"},
+		{[]string{"-1Rd", "/e", "/d"}, "/d\n/e\n"},
+		{[]string{"-1dR", "/d/sub", "/d/file"}, "/d/file\n/d/sub\n"},
+		{[]string{"-1R", "/d"}, "/d:\nfile\nsub\n\n/d/sub:\ndeep\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// With -d nothing may be read beneath the operands
+	clear(fake.dirOpens)
+	runLs(t, fake, "-dR", "/d", "/e")
+	if len(fake.dirOpens) != 0 {
+		t.Errorf("ls -dR opened directories %v", fake.dirOpens)
+	}
+}
+
+func TestNameCacheConcurrent(t *testing.T) {
+	tests := []struct {
+		ids        int
+		goroutines int
+		delay      time.Duration
+	}{
+		{1, 64, time.Millisecond},
+		{16, 64, time.Millisecond},
+		{500, 32, 0},
+	}
+	for _, tt := range tests {
+		c := newNameCache()
+		var mu sync.Mutex
+		calls := make(map[uint32]int)
+		resolve := func(id uint32) string {
+			mu.Lock()
+			calls[id]++
+			mu.Unlock()
+			time.Sleep(tt.delay)
+			return fmt.Sprint("user", id)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < tt.goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < tt.ids; i++ {
+					id := uint32((g + i) % tt.ids)
+					if name, want := c.lookup(id, resolve), fmt.Sprint("user", id); name != want {
+						t.Errorf("lookup(%d) = %q, want %q", id, name, want)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(calls) != tt.ids {
+			t.Errorf("%d ids: resolved %d distinct ids", tt.ids, len(calls))
+		}
+		for id, n := range calls {
+			if n != 1 {
+				t.Errorf("%d ids over %d goroutines: id %d resolved %d times, want once", tt.ids, tt.goroutines, id, n)
+			}
+		}
+	}
+}
+
+func TestOwnerNamesConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := uint32(0); id < 200; id++ {
+				getUserName(id + uint32(g))
+				getGroupName(id + uint32(g))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if name := getUserName(0); name != "root" {
+		t.Errorf("getUserName(0) = %q, want root", name)
+	}
+	if name := getUserName(4000000000); name != "4000000000" {
+		t.Errorf("getUserName(4000000000) = %q, want the number", name)
+	}
+}
+
+func TestFindGitRoot(t *testing.T) {
+	repo := t.TempDir()
+	worktree := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{filepath.Join(repo, ".git"), filepath.Join(repo, "src", "pkg")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A linked worktree or submodule has a .git file instead
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: elsewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cwd     string
+		want    string
+		wantErr bool
+	}{
+		{repo, repo, false},
+		{filepath.Join(repo, "src"), repo, false},
+		{filepath.Join(repo, "src", "pkg"), repo, false},
+		{worktree, worktree, false},
+		{outside, "", true},
+	}
+
+	saved, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(saved)
+	for _, tt := range tests {
+		if err := os.Chdir(tt.cwd); err != nil {
+			t.Fatal(err)
+		}
+		got, err := findGitRoot()
+		if tt.wantErr && err == nil {
+			t.Errorf("findGitRoot() in %s = %q, want an error", tt.cwd, got)
+		}
+		if !tt.wantErr && (err != nil || got != tt.want) {
+			t.Errorf("findGitRoot() in %s = %q, %v; want %q", tt.cwd, got, err, tt.want)
+		}
+	}
+}
+
+func TestGitRootListing(t *testing.T) {
+	repo := t.TempDir()
+	for _, dir := range []string{".git", "cmd", "docs"} {
+		if err := os.Mkdir(filepath.Join(repo, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repo, "go.mod"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir    string
+		args   []string
+		status int
+		want   string
+	}{
+		{filepath.Join(repo, "cmd"), []string{"-1", "--git-root"}, 0, "cmd\ndocs\ngo.mod\n"},
+		{filepath.Join(repo, "docs"), []string{"-1", "--git-root", "ignored"}, 0, "cmd\ndocs\ngo.mod\n"},
+		{"/", []string{"-1", "--git-root"}, 2, ""},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		cmd := lsCommand(tt.args...)
+		cmd.Dir, cmd.Stdout, cmd.Stderr = tt.dir, &stdout, &stderr
+		err := cmd.Run()
+		status := 0
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			status = exit.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status || stdout.String() != tt.want {
+			t.Errorf("ls %v in %s = %q, status %d; want %q, status %d (stderr %q)",
+				tt.args, tt.dir, stdout.String(), status, tt.want, tt.status, stderr.String())
+		}
+		if tt.status != 0 && !strings.Contains(stderr.String(), "not inside a git work tree") {
+			t.Errorf("ls %v in %s wrote %q, want a clear error", tt.args, tt.dir, stderr.String())
+		}
+	}
+}
+
+func TestColumnLayout(t *testing.T) {
+	tests := []struct {
+		n, cellWidth, width int
+		rows, cols          int
+	}{
+		{1, 5, 80, 1, 1},
+		{3, 5, 80, 1, 3},
+		{10, 10, 80, 2, 5},  // 8 columns fit, but 2 rows only need 5
+		{10, 10, 78, 2, 5},  // the last column needs no gap
+		{10, 10, 77, 2, 5},  // 7 columns fit, still 2 rows
+		{10, 10, 38, 3, 4},  // 4 columns fit
+		{9, 10, 38, 3, 3},   // 3 rows of 4 would leave the last column short
+		{5, 100, 80, 5, 1},  // a cell wider than the terminal
+		{100, 3, 80, 4, 25}, // 27 columns fit, 4 rows fill 25
+		{7, 12, 0, 7, 1},    // no width at all
+		{12, 6, 24, 3, 4},   // exactly 4 cells of 6 with the gap dropped at the end
+		{12, 6, 21, 4, 3},
+	}
+	for _, tt := range tests {
+		rows, cols := columnLayout(tt.n, tt.cellWidth, tt.width)
+		if rows != tt.rows || cols != tt.cols {
+			t.Errorf("columnLayout(%d, %d, %d) = %d rows, %d cols; want %d, %d",
+				tt.n, tt.cellWidth, tt.width, rows, cols, tt.rows, tt.cols)
+		}
+	}
+}
+
+func TestColumnFormat(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", ""), fakeReg("/d/bb", ""), fakeReg("/d/ccc", ""),
+		fakeReg("/d/d", ""), fakeReg("/d/eeeee", ""), fakeReg("/d/f", ""),
+		fakeReg("/d/g", ""),
+	)
+
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{80, "a      bb     ccc    d      eeeee  f      g\n"},
+		{40, "a      ccc    eeeee  g\nbb     d      f\n"},
+		{22, "a      d      g\nbb     eeeee\nccc    f\n"},
+		{14, "a      eeeee\nbb     f\nccc    g\nd\n"},
+		{5, "a\nbb\nccc\nd\neeeee\nf\ng\n"},
+		{3, "a\nbb\nccc\nd\neeeee\nf\ng\n"},
+	}
+	for _, tt := range tests {
+		got := runLsWidth(t, tt.width, fake, "-C", "/d")
+		if got != tt.want {
+			t.Errorf("ls -C at %d columns =\n%s\nwant\n%s", tt.width, got, tt.want)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+			if displayWidth(line) > max(tt.width, 5) {
+				t.Errorf("ls -C at %d columns printed %q", tt.width, line)
+			}
+		}
+	}
+}
+
+func TestTerminalWidth(t *testing.T) {
+	tests := []struct {
+		columns string
+		want    int
+	}{
+		{"132", 132},
+		{"", 80},
+		{"0", 80},
+		{"-5", 80},
+		{"wide", 80},
+	}
+	for _, tt := range tests {
+		// stdout is a pipe under test, so the width comes from $COLUMNS
+		t.Setenv("COLUMNS", tt.columns)
+		if got := terminalWidth(); got != tt.want {
+			t.Errorf("COLUMNS=%q: terminalWidth() = %d, want %d", tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestFlattenSortDepth(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeDir("/d/a"),
+		fakeDir("/d/a/b"),
+		fakeReg("/d/a/b/deep", ""),
+		fakeReg("/d/a/mid", ""),
+		fakeReg("/d/z", ""),
+		fakeDir("/d/m"),
+		fakeReg("/d/m/b", ""),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "--flatten", "/d"}, "a\na/b\na/b/deep\na/mid\nm\nm/b\nz\n"},
+		{[]string{"-1", "--flatten", "--sort=depth", "/d"}, "a\nm\nz\na/b\na/mid\nm/b\na/b/deep\n"},
+		{[]string{"-1r", "--flatten", "--sort=depth", "/d"}, "a/b/deep\nm/b\na/mid\na/b\nz\nm\na\n"},
+		{[]string{"-1", "--flatten", "--sort=depth", "--match=b", "/d"}, "a/b\nm/b\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCompareDepth(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"a", "b", 0},
+		{"a", "a/b", -1},
+		{"z/y", "a", 1},
+		{"x/y/z", "a/b/c", 0},
+	}
+	for _, tt := range tests {
+		if got := compareDepth(FileInfo{Name: tt.a}, FileInfo{Name: tt.b}); got != tt.want {
+			t.Errorf("compareDepth(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAcrossFormat(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a", ""), fakeReg("/d/bb", ""), fakeReg("/d/ccc", ""),
+		fakeReg("/d/d", ""), fakeReg("/d/eeeee", ""), fakeReg("/d/f", ""),
+		fakeReg("/d/g", ""),
+	)
+
+	tests := []struct {
+		args  []string
+		width int
+		want  string
+	}{
+		{[]string{"-x", "/d"}, 80, "a      bb     ccc    d      eeeee  f      g\n"},
+		{[]string{"-x", "/d"}, 40, "a      bb     ccc    d      eeeee  f\ng\n"},
+		{[]string{"-x", "/d"}, 22, "a      bb     ccc\nd      eeeee  f\ng\n"},
+		{[]string{"-x", "/d"}, 14, "a      bb\nccc    d\neeeee  f\ng\n"},
+		{[]string{"-x", "/d"}, 3, "a\nbb\nccc\nd\neeeee\nf\ng\n"},
+		{[]string{"-xr", "/d"}, 22, "g      f      eeeee\nd      ccc    bb\na\n"},
+		{[]string{"-C", "/d"}, 22, "a      d      g\nbb     eeeee\nccc    f\n"},
+	}
+	for _, tt := range tests {
+		if got := runLsWidth(t, tt.width, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v at %d columns =\n%s\nwant\n%s", tt.args, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestPrecisionArgument(t *testing.T) {
+	tests := []struct {
+		value  string
+		status int
+	}{
+		{"0", 0},
+		{"2", 0},
+		{"9", 0},
+		{"10", 2},
+		{"-1", 2},
+		{"two", 2},
+	}
+	for _, tt := range tests {
+		status, stderr := lsStatus(t, "-h", "--precision="+tt.value, "/")
+		if status != tt.status {
+			t.Errorf("--precision=%s exited %d, want %d (stderr %q)", tt.value, status, tt.status, stderr)
+		}
+		if tt.status != 0 && !strings.Contains(stderr, "invalid argument '"+tt.value+"' for '--precision'") {
+			t.Errorf("--precision=%s wrote %q", tt.value, stderr)
+		}
+	}
+}
+
+func TestIndicators(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeDir("/d/dir"),
+		fakeLink("/d/link", "dir"),
+		&fakeFile{path: "/d/pipe", mode: syscall.S_IFIFO | 0644},
+		fakeReg("/d/plain", ""),
+		&fakeFile{path: "/d/prog", mode: syscall.S_IFREG | 0755},
+		&fakeFile{path: "/d/sock", mode: syscall.S_IFSOCK | 0755},
+		&fakeFile{path: "/d/tty", mode: syscall.S_IFCHR | 0755},
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1F", "/d"}, "dir/\nlink@\npipe|\nplain\nprog*\nsock=\ntty\n"},
+		{[]string{"-1", "--indicators=d", "/d"}, "dir/\nlink\npipe\nplain\nprog\nsock\ntty\n"},
+		{[]string{"-1", "--indicators=l", "/d"}, "dir\nlink@\npipe\nplain\nprog\nsock\ntty\n"},
+		{[]string{"-1", "--indicators=x", "/d"}, "dir\nlink\npipe\nplain\nprog*\nsock\ntty\n"},
+		{[]string{"-1", "--indicators=d,l,x", "/d"}, "dir/\nlink@\npipe\nplain\nprog*\nsock\ntty\n"},
+		{[]string{"-1", "--indicators=p,s", "/d"}, "dir\nlink\npipe|\nplain\nprog\nsock=\ntty\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"q", "dl", "d,", ""} {
+		status, stderr := lsStatus(t, "--indicators="+value, "/")
+		if status != 2 || !strings.Contains(stderr, "invalid argument '"+value+"' for '--indicators'") {
+			t.Errorf("--indicators=%s exited %d with %q, want status 2", value, status, stderr)
+		}
+	}
+}
+
+func TestRecursiveSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "top", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"top/sub/up":   "..",
+		"top/sub/self": ".",
+		"top/back":     "sub",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args   []string
+		want   string
+		stderr []string
+	}{
+		{
+			// Without -L the links are entries, not directories to enter
+			[]string{"-R1", "top"},
+			"top:\nback\nsub\n\ntop/sub:\nself\nup\n",
+			nil,
+		},
+		{
+			[]string{"-R1L", "top"},
+			"top:\nback\nsub\n\ntop/back:\nself\nup\n",
+			[]string{
+				"ls: top/back/self: not listing already-listed directory\n",
+				"ls: top/back/up: not listing already-listed directory\n",
+				"ls: top/sub: not listing already-listed directory\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, os.Args[0])
+		cmd.Env = append(os.Environ(), "LS_TEST_ARGS="+strings.Join(tt.args, argSeparator))
+		cmd.Dir, cmd.Stdout, cmd.Stderr = dir, &stdout, &stderr
+		err := cmd.Run()
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			t.Fatalf("ls %v did not terminate", tt.args)
+		}
+		if err != nil {
+			t.Errorf("ls %v: %v (stderr %q)", tt.args, err, stderr.String())
+		}
+		if stdout.String() != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, stdout.String(), tt.want)
+		}
+		notes := strings.SplitAfter(stderr.String(), "\n")
+		notes = notes[:len(notes)-1]
+		slices.Sort(notes)
+		if !slices.Equal(notes, tt.stderr) {
+			t.Errorf("ls %v wrote %q to stderr, want %q", tt.args, notes, tt.stderr)
+		}
+	}
+}
+
+func TestAlignRight(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a", mode: syscall.S_IFREG | 0644, mtime: stamp},
+		&fakeFile{path: "/d/longer.txt", mode: syscall.S_IFREG | 0644, mtime: stamp},
+		&fakeFile{path: "/d/ln", mode: syscall.S_IFLNK | 0777, target: "a-distant-target", mtime: stamp},
+		&fakeFile{path: "/d/sub", mode: syscall.S_IFDIR | 0755, mtime: stamp},
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"-ln", "/d"},
+			"total 1\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020 a\n" +
+				"lrwxrwxrwx 1 0 0 16 Jan  2  2020 ln -> a-distant-target\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020 longer.txt\n" +
+				"drwxr-xr-x 1 0 0  0 Jan  2  2020 sub\n",
+		},
+		{
+			[]string{"-ln", "--align-right", "/d"},
+			"total 1\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020          a\n" +
+				"lrwxrwxrwx 1 0 0 16 Jan  2  2020         ln -> a-distant-target\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020 longer.txt\n" +
+				"drwxr-xr-x 1 0 0  0 Jan  2  2020        sub\n",
+		},
+		{
+			[]string{"-lnF", "--align-right", "/d"},
+			"total 1\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020          a\n" +
+				"lrwxrwxrwx 1 0 0 16 Jan  2  2020        ln@ -> a-distant-target\n" +
+				"-rw-r--r-- 1 0 0  0 Jan  2  2020 longer.txt\n" +
+				"drwxr-xr-x 1 0 0  0 Jan  2  2020       sub/\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v =\n%s\nwant\n%s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestHardlinkSummary(t *testing.T) {
+	big := strings.Repeat("x", 1000)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a1", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3, content: big},
+		&fakeFile{path: "/d/a2", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3, content: big},
+		&fakeFile{path: "/d/a3", mode: syscall.S_IFREG | 0644, ino: 50, nlink: 3, content: big},
+		&fakeFile{path: "/d/b1", mode: syscall.S_IFREG | 0644, ino: 60, nlink: 2, content: "12345"},
+		&fakeFile{path: "/d/b2", mode: syscall.S_IFREG | 0644, ino: 60, nlink: 2, content: "12345"},
+		&fakeFile{path: "/d/lone", mode: syscall.S_IFREG | 0644, ino: 70, nlink: 2, content: "abc"},
+		fakeReg("/d/single", "abcdef"),
+		fakeDir("/d/sub"),
+		fakeDir("/e"),
+		fakeReg("/e/x", "x"),
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "--hardlink-summary", "/d"}, "hardlinks: 2 inodes shared by 5 names, 2005 saved\n"},
+		{[]string{"-1", "--hardlink-summary", "--unique-hardlinks", "/d"}, "hardlinks: 2 inodes shared by 5 names, 2005 saved\n"},
+		{[]string{"-1h", "--hardlink-summary", "/d"}, "hardlinks: 2 inodes shared by 5 names, 2.0K saved\n"},
+		{[]string{"-1", "--hardlink-summary", "/e"}, "hardlinks: no inodes shared\n"},
+		{[]string{"-1", "--hardlink-summary", "/d/a1", "/d/a2", "/d/single"}, "hardlinks: 1 inode shared by 2 names, 1000 saved\n"},
+	}
+	for _, tt := range tests {
+		got := runLs(t, fake, tt.args...)
+		if _, footer, _ := strings.Cut(got, "\n\n"); footer != tt.want {
+			t.Errorf("ls %v footer = %q, want %q (output %q)", tt.args, footer, tt.want, got)
+		}
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		&fakeFile{path: "/real", mode: syscall.S_IFDIR | 0755, mtime: stamp},
+		&fakeFile{path: "/real/file", mode: syscall.S_IFREG | 0644, content: "hello", mtime: stamp},
+		&fakeFile{path: "/real/inner", mode: syscall.S_IFLNK | 0777, target: "file", mtime: stamp},
+		&fakeFile{path: "/link", mode: syscall.S_IFLNK | 0777, target: "real", mtime: stamp},
+	)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1", "/link"}, "/link\n"},
+		{[]string{"-1H", "/link"}, "file\ninner\n"},
+		{[]string{"-1L", "/link"}, "file\ninner\n"},
+		{
+			[]string{"-ln", "/link"},
+			"total 1\nlrwxrwxrwx 1 0 0 4 Jan  2  2020 /link -> real\n",
+		},
+		{
+			[]string{"-lnH", "/link"},
+			"total 2\n" +
+				"-rw-r--r-- 1 0 0 5 Jan  2  2020 file\n" +
+				"lrwxrwxrwx 1 0 0 4 Jan  2  2020 inner -> file\n",
+		},
+		{
+			[]string{"-lnL", "/link"},
+			"total 2\n" +
+				"-rw-r--r-- 1 0 0 5 Jan  2  2020 file\n" +
+				"-rw-r--r-- 1 0 0 5 Jan  2  2020 inner\n",
+		},
+		{[]string{"-1H", "/link/inner"}, "/link/inner\n"},
+		{
+			[]string{"-lnH", "/link/inner"},
+			"total 1\n-rw-r--r-- 1 0 0 5 Jan  2  2020 /link/inner\n",
+		},
+		{[]string{"-1dH", "/link"}, "/link\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPortableDates(t *testing.T) {
+	recent := time.Now().Add(-2 * time.Hour)
+	old := time.Date(2019, 3, 7, 8, 9, 10, 0, time.Local)
+	future := time.Now().AddDate(1, 0, 0)
+
+	tests := []struct {
+		flags string
+		o     Options
+		t     time.Time
+		want  string
+	}{
+		{"--portable-dates", Options{PortableDates: true}, recent, recent.Format("01-02 15:04")},
+		{"--portable-dates", Options{PortableDates: true}, old, "03-07  2019"},
+		{"--portable-dates", Options{PortableDates: true}, future, future.Format("01-02  2006")},
+		{"", Options{}, old, "Mar  7  2019"},
+		{"--portable-dates --time-style=long-iso", Options{PortableDates: true, TimeStyle: TimeStyleLongISO}, old, "2019-03-07 08:09"},
+		{"--portable-dates --relative-time-threshold=1d", Options{PortableDates: true, RelativeTime: 24 * time.Hour}, recent, "     2h ago"},
+	}
+	for _, tt := range tests {
+		setOptions(t, tt.o)
+		got := formatTime(tt.t)
+		if got != tt.want {
+			t.Errorf("%s: formatTime(%v) = %q, want %q", tt.flags, tt.t, got, tt.want)
+		}
+	}
+}
+
+// parsedOptions returns the options and operands parseArgs makes of args
+func parsedOptions(t *testing.T, args ...string) (Options, []string) {
+	setOptions(t, Options{})
+	files := parseArgs(args)
+	return opts, files
+}
+
+func TestLongOptions(t *testing.T) {
+	tests := []struct {
+		long, short []string
+	}{
+		{[]string{"--all"}, []string{"-a"}},
+		{[]string{"--almost-all"}, []string{"-A"}},
+		{[]string{"--reverse"}, []string{"-r"}},
+		{[]string{"--recursive"}, []string{"-R"}},
+		{[]string{"--human-readable"}, []string{"-h"}},
+		{[]string{"--numeric-uid-gid"}, []string{"-n"}},
+		{[]string{"--inode", "--size"}, []string{"-is"}},
+		{[]string{"--classify", "--directory"}, []string{"-Fd"}},
+		{[]string{"--dereference"}, []string{"-L"}},
+		{[]string{"--dereference-command-line"}, []string{"-H"}},
+		{[]string{"--escape"}, []string{"-b"}},
+		{[]string{"--quote-name"}, []string{"-Q"}},
+		{[]string{"--hide-control-chars"}, []string{"-q"}},
+		{[]string{"--kibibytes"}, []string{"-k"}},
+		{[]string{"--all", "x", "--reverse", "y"}, []string{"-ar", "x", "y"}},
+		{[]string{"--jobs=3"}, []string{"-j3"}},
+		{[]string{"--jobs", "3"}, []string{"-j", "3"}},
+		{[]string{"--sort", "size"}, []string{"--sort=size"}},
+		{[]string{"--block-size", "1K", "d"}, []string{"--block-size=1K", "d"}},
+		{[]string{"--match", "--all"}, []string{"--match=--all"}},
+	}
+	for _, tt := range tests {
+		long, longFiles := parsedOptions(t, tt.long...)
+		short, shortFiles := parsedOptions(t, tt.short...)
+		if !reflect.DeepEqual(long, short) || !slices.Equal(longFiles, shortFiles) {
+			t.Errorf("%v parsed as %+v %q, want the same as %v: %+v %q",
+				tt.long, long, longFiles, tt.short, short, shortFiles)
+		}
+	}
+
+	// The letters of a long option are not short options
+	if o, _ := parsedOptions(t, "--all"); o.LongFormat {
+		t.Errorf("--all set -l")
+	}
+}
+
+func TestLongOptionErrors(t *testing.T) {
+	tests := []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"--foo"}, "ls: unrecognized option '--foo'\n"},
+		{[]string{"--al"}, "ls: unrecognized option '--al'\n"},
+		{[]string{"--all=yes"}, "ls: option '--all' doesn't allow an argument\n"},
+		{[]string{"--sort"}, "ls: option '--sort' requires an argument\n"},
+		{[]string{".", "--block-size"}, "ls: option '--block-size' requires an argument\n"},
+		{[]string{"--sort", "bogus"}, "ls: invalid argument 'bogus' for '--sort'\n"},
+		{[]string{"-j"}, "ls: option requires an argument -- 'j'\n"},
+	}
+	for _, tt := range tests {
+		status, stderr := lsStatus(t, tt.args...)
+		if status != 2 || !strings.HasPrefix(stderr, tt.stderr) {
+			t.Errorf("ls %v exited %d with %q, want status 2 and %q", tt.args, status, stderr, tt.stderr)
+		}
+	}
+}
+
+func TestRecurseSymlinkArgs(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/real"),
+		fakeReg("/real/a", ""),
+		fakeLink("/real/inner", "sub"),
+		fakeDir("/real/sub"),
+		fakeReg("/real/sub/b", ""),
+		fakeLink("/link", "real"),
+	)
+
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+	}{
+		{[]string{"-R1", "/link"}, "/link\n", ""},
+		{[]string{"-1", "--recurse-symlink-args", "/link"}, "/link\n", ""},
+		{
+			[]string{"-R1", "--recurse-symlink-args", "/link"},
+			"/link:\na\ninner\nsub\n\n/link/sub:\nb\n",
+			"",
+		},
+		{
+			[]string{"-R1", "--recurse-symlink-args", "/link", "/real"},
+			"/link:\na\ninner\nsub\n\n/link/sub:\nb\n\n/real:\na\ninner\nsub\n\n/real/sub:\nb\n",
+			"",
+		},
+		{
+			[]string{"-R1L", "/link"},
+			"/link:\na\ninner\nsub\n\n/link/inner:\nb\n",
+			"ls: /link/sub: not listing already-listed directory\n",
+		},
+	}
+	for _, tt := range tests {
+		stderr := captureStderr(t)
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if got := stderr(); got != tt.stderr {
+			t.Errorf("ls %v wrote %q to stderr, want %q", tt.args, got, tt.stderr)
+		}
+	}
+}
+
+func TestEndOfOptions(t *testing.T) {
+	tests := []struct {
+		args  []string
+		files []string
+		long  bool
+	}{
+		{[]string{"-l"}, nil, true},
+		{[]string{"--", "-l"}, []string{"-l"}, false},
+		{[]string{"-1", "--", "-l", "--", "-"}, []string{"-l", "--", "-"}, false},
+		{[]string{"-l", "--"}, nil, true},
+		{[]string{"a", "--", "--all"}, []string{"a", "--all"}, false},
+		{[]string{"-"}, []string{"-"}, false},
+	}
+	for _, tt := range tests {
+		o, files := parsedOptions(t, tt.args...)
+		if !slices.Equal(files, tt.files) || o.LongFormat != tt.long {
+			t.Errorf("parseArgs(%q) = %q, -l %v; want %q, -l %v", tt.args, files, o.LongFormat, tt.files, tt.long)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"-l", "other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stdout bytes.Buffer
+	cmd := lsCommand("--", "-l")
+	cmd.Dir, cmd.Stdout = dir, &stdout
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "-l\n" {
+		t.Errorf("ls -- -l = %q, want the file named -l", stdout.String())
+	}
+}
+
+func TestInvalidShortOption(t *testing.T) {
+	tests := []struct {
+		args   []string
+		status int
+		stderr string
+	}{
+		{[]string{"-Z"}, 2, "ls: invalid option -- 'Z'\nTry 'ls --help' for more information.\n"},
+		{[]string{"-laZ", "."}, 2, "ls: invalid option -- 'Z'\nTry 'ls --help' for more information.\n"},
+		{[]string{".", "-W"}, 2, "ls: invalid option -- 'W'\nTry 'ls --help' for more information.\n"},
+		{[]string{"-é"}, 2, "ls: invalid option -- 'é'\nTry 'ls --help' for more information.\n"},
+		{[]string{"-la", "/"}, 0, ""},
+	}
+	for _, tt := range tests {
+		status, stderr := lsStatus(t, tt.args...)
+		if status != tt.status || stderr != tt.stderr {
+			t.Errorf("ls %q exited %d with %q, want %d and %q", tt.args, status, stderr, tt.status, tt.stderr)
+		}
+	}
+}
+
+func TestSortWord(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "file9", Size: 20, ModTime: base.Add(4 * time.Hour)},
+		{Name: "b.txt", Size: 30, ModTime: base.Add(time.Hour)},
+		{Name: "README", Size: 5, ModTime: base},
+		{Name: "file10", Size: 20, ModTime: base.Add(2 * time.Hour)},
+		{Name: "a.tar.gz", Size: 10, ModTime: base.Add(3 * time.Hour)},
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "a.tar.gz b.txt file10 file9 README"},
+		{[]string{"--sort=name"}, "a.tar.gz b.txt file10 file9 README"},
+		{[]string{"--sort=none"}, "file9 b.txt README file10 a.tar.gz"},
+		{[]string{"-f"}, "file9 b.txt README file10 a.tar.gz"},
+		{[]string{"--sort=size"}, "b.txt file10 file9 a.tar.gz README"},
+		{[]string{"-S"}, "b.txt file10 file9 a.tar.gz README"},
+		{[]string{"--sort=time"}, "file9 a.tar.gz file10 b.txt README"},
+		{[]string{"-t"}, "file9 a.tar.gz file10 b.txt README"},
+		{[]string{"--sort=extension"}, "file10 file9 README a.tar.gz b.txt"},
+		// Version order compares bytes, as in the C locale
+		{[]string{"--sort=version"}, "README a.tar.gz b.txt file9 file10"},
+		{[]string{"-v"}, "README a.tar.gz b.txt file9 file10"},
+		{[]string{"--sort=version", "-r"}, "file10 file9 b.txt a.tar.gz README"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("ls %v sorted %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParallelOutputIsDeterministic(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []*fakeFile{}
+	for _, dir := range []string{"/a", "/b", "/c", "/d"} {
+		files = append(files, &fakeFile{path: dir, mode: syscall.S_IFDIR | 0755, mtime: stamp})
+		files = append(files, &fakeFile{path: dir + "/sub", mode: syscall.S_IFDIR | 0755, mtime: stamp})
+		for i := 0; i < 20; i++ {
+			files = append(files,
+				&fakeFile{path: fmt.Sprintf("%s/f%02d", dir, i), mode: syscall.S_IFREG | 0644, content: strings.Repeat("x", i), mtime: stamp},
+				&fakeFile{path: fmt.Sprintf("%s/sub/g%02d", dir, i), mode: syscall.S_IFREG | 0600, mtime: stamp.Add(time.Duration(i) * time.Minute)})
+		}
+	}
+	fake := newFakeFS(files...)
+	// Make the earlier operands the slower ones, so that later ones finish
+	// first and have to wait their turn
+	for i, f := range files {
+		if strings.HasPrefix(f.path, "/a/") && i%3 == 0 {
+			fake.lstatDelays[f.path] = time.Millisecond
+		}
+	}
+
+	tests := [][]string{
+		{"-R1", "/d", "/c", "/b", "/a"},
+		{"-lnR", "/a", "/b", "/c", "/d"},
+		{"-lnt", "/b", "/a/sub", "/d/sub", "/c"},
+		{"-1", "--preserve-arg-order", "/c", "/a", "/d", "/b"},
+	}
+	for _, args := range tests {
+		want := runLs(t, fake, append([]string{"-j1"}, args...)...)
+		for run := 0; run < 20; run++ {
+			if got := runLs(t, fake, append([]string{"-j8"}, args...)...); got != want {
+				t.Fatalf("ls -j8 %v run %d differs from -j1:\n%s\nwant\n%s", args, run, got, want)
+			}
+		}
+	}
+}
+
+func TestFormatInode(t *testing.T) {
+	tests := []struct {
+		file FileInfo
+		want string
+	}{
+		{FileInfo{Inode: 1234}, "1234"},
+		{FileInfo{Inode: 1234, Generation: 7}, "1234"},
+		{FileInfo{Inode: 1234, Generation: 7, HasGeneration: true}, "1234.7"},
+		{FileInfo{Inode: 1234, HasGeneration: true}, "1234.0"},
+	}
+	for _, tt := range tests {
+		if got := formatInode(tt.file); got != tt.want {
+			t.Errorf("formatInode(%+v) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		x, y string
+		want int // the sign of the result
+	}{
+		{"file2", "file10", -1},
+		{"file10", "file2", 1},
+		{"file10", "file10", 0},
+		{"file002", "file10", -1},
+		{"file010", "file9", 1},
+		{"1.2.10", "1.2.9", 1},
+		{"1.10.1", "1.9.20", 1},
+		{"v1.2", "v1.2.1", -1},
+		{"a1b2", "a1b10", -1},
+		{"a10b1", "a9b20", 1},
+		{"file", "file1", -1},
+		{"file1", "filea", -1},
+		{"99999999999999999999", "100000000000000000000", -1},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		if got := cmp.Compare(naturalCompare(tt.x, tt.y), 0); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) has sign %d, want %d", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestWrapLongFormat(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	long := strings.Repeat("n", 30)
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/"+long, ""), fakeReg("/d/short", ""))
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	const meta = "-rw-r--r-- 1 root 0 2024-05-01 12:00"
+	tests := []struct {
+		width int
+		args  []string
+		want  string
+	}{
+		{50, nil, meta + " " + long + "\n" + meta + " short\n"},
+		{50, []string{"--wrap"}, meta + "\n    " + long + "\n" + meta + " short\n"},
+		{50, []string{"--wrap=wrap"}, meta + "\n    " + long + "\n" + meta + " short\n"},
+		{50, []string{"--wrap=truncate"}, meta + " " + strings.Repeat("n", 12) + "…\n" + meta + " short\n"},
+		// Names that overflow even the continuation line are broken up
+		{30, []string{"--wrap"}, strings.Join([]string{
+			meta, "    " + strings.Repeat("n", 26), "  nnnn", meta, "    short",
+		}, "\n") + "\n"},
+		{200, []string{"--wrap"}, meta + " " + long + "\n" + meta + " short\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-g", "--time-style=long-iso"}, tt.args...)
+		args = append(args, "/d")
+		got := runLsWidth(t, tt.width, fake, args...)
+		if want := "total 0\n" + tt.want; got != want {
+			t.Errorf("ls %v at width %d = %q, want %q", args, tt.width, got, want)
+		}
+	}
+}
+
+func TestGroupDirectoriesFirst(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "beta", Size: 10, ModTime: base.Add(time.Hour)},
+		{Name: "zdir", IsDir: true, Size: 4096, ModTime: base},
+		{Name: "alpha", Size: 300, ModTime: base.Add(3 * time.Hour)},
+		{Name: "adir", IsDir: true, Size: 64, ModTime: base.Add(2 * time.Hour)},
+		{Name: "gamma", Size: 5000, ModTime: base.Add(4 * time.Hour)},
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "adir alpha beta gamma zdir"},
+		{[]string{"--group-directories-first"}, "adir zdir alpha beta gamma"},
+		{[]string{"--group-directories-first", "-r"}, "zdir adir gamma beta alpha"},
+		{[]string{"--group-directories-first", "-S"}, "zdir adir gamma alpha beta"},
+		{[]string{"--group-directories-first", "-Sr"}, "adir zdir beta alpha gamma"},
+		{[]string{"--group-directories-first", "-t"}, "adir zdir gamma alpha beta"},
+		{[]string{"--group-directories-first", "-tr"}, "zdir adir beta alpha gamma"},
+		{[]string{"--group-directories-first", "-f"}, "beta zdir alpha adir gamma"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("ls %v sorted %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDirectoryBase(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/base"),
+		fakeReg("/base/a", ""),
+		fakeDir("/base/sub"),
+		fakeReg("/base/sub/x", ""),
+		fakeDir("/other"),
+		fakeReg("/other/abs", ""),
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--directory-base=/base", "a"}, "/base/a\n"},
+		{[]string{"--directory-base", "/base", "a"}, "/base/a\n"},
+		{[]string{"--directory-base=/base", "/other/abs"}, "/other/abs\n"},
+		{[]string{"--directory-base=/base", "a", "sub", "/other/abs"}, "/base/a\n/other/abs\n\n/base/sub:\nx\n"},
+		{[]string{"--directory-base=/base", "../other"}, "abs\n"},
+		// Without operands, the base itself is listed
+		{[]string{"--directory-base=/base"}, "a\nsub\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestMeasureLongWidths(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []FileInfo
+		want  longWidths
+	}{
+		{"empty", nil, longWidths{}},
+		{"one tiny file", []FileInfo{{Size: 1, Links: 1}}, longWidths{inode: 1, blocks: 1, links: 1, owner: 1, group: 1, size: 1, disk: 1}},
+		{
+			"widest of each column",
+			[]FileInfo{
+				{Size: 10 << 30, Links: 1, Uid: 1000},
+				{Size: 3, Links: 120, Gid: 65534, Blocks: 8},
+			},
+			longWidths{inode: 1, blocks: 1, links: 3, owner: 4, group: 5, size: 11, disk: 4},
+		},
+		{
+			"stat failures are not measured",
+			[]FileInfo{{Size: 7, Links: 1}, {Size: 123456, Links: 1000, StatFailed: true}},
+			longWidths{inode: 1, blocks: 1, links: 1, owner: 1, group: 1, size: 1, disk: 1},
+		},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, "-ln")
+		if got := measureLongWidths(tt.files); got != tt.want {
+			t.Errorf("%s: measureLongWidths = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLongFormatColumnWidths(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "huge", Mode: 0644, Size: 10 << 30, Links: 1, ModTime: stamp},
+		{Name: "tiny", Mode: 0644, Size: 1, Links: 1, ModTime: stamp},
+		{Name: "empty", Mode: 0644, Links: 1, ModTime: stamp},
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-ln"}, "total 0\n" +
+			"-rw-r--r-- 1 0 0 10737418240 Jan  2  2020 huge\n" +
+			"-rw-r--r-- 1 0 0           1 Jan  2  2020 tiny\n" +
+			"-rw-r--r-- 1 0 0           0 Jan  2  2020 empty\n"},
+		{[]string{"-lnh"}, "total 0\n" +
+			"-rw-r--r-- 1 0 0 10G Jan  2  2020 huge\n" +
+			"-rw-r--r-- 1 0 0   1 Jan  2  2020 tiny\n" +
+			"-rw-r--r-- 1 0 0   0 Jan  2  2020 empty\n"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		var buf strings.Builder
+		displayLongFormat(&buf, files, t.TempDir())
+		if got := buf.String(); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// useNames makes the long format show users and groups by the given names
+// until the test ends, without consulting the system databases
+func useNames(t *testing.T, users, groups map[uint32]string) {
+	savedUsers, savedGroups := userCache, groupCache
+	userCache, groupCache = newNameCache(), newNameCache()
+	for id, name := range users {
+		userCache.put(id, name)
+	}
+	for id, name := range groups {
+		groupCache.put(id, name)
+	}
+	t.Cleanup(func() { userCache, groupCache = savedUsers, savedGroups })
+}
+
+func TestLongFormatIdentityWidths(t *testing.T) {
+	useNames(t,
+		map[uint32]string{0: "root", 4001: "build-automation"},
+		map[uint32]string{0: "wheel", 4001: "ci"},
+	)
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "mine", Mode: 0644, Size: 1, Links: 1, ModTime: stamp},
+		{Name: "theirs", Mode: 0644, Size: 1, Links: 12, Uid: 4001, Gid: 4001, ModTime: stamp},
+		{Name: "shared", Mode: 0644, Size: 1, Links: 345, Uid: 4001, ModTime: stamp},
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		// Names are left-justified and numbers right-justified, each to
+		// the widest value in the listing
+		{[]string{"-l"}, "total 0\n" +
+			"-rw-r--r--   1 root             wheel 1 Jan  2  2020 mine\n" +
+			"-rw-r--r--  12 build-automation ci    1 Jan  2  2020 theirs\n" +
+			"-rw-r--r-- 345 build-automation wheel 1 Jan  2  2020 shared\n"},
+		{[]string{"-ln"}, "total 0\n" +
+			"-rw-r--r--   1    0    0 1 Jan  2  2020 mine\n" +
+			"-rw-r--r--  12 4001 4001 1 Jan  2  2020 theirs\n" +
+			"-rw-r--r-- 345 4001    0 1 Jan  2  2020 shared\n"},
+		{[]string{"-g"}, "total 0\n" +
+			"-rw-r--r--   1 wheel 1 Jan  2  2020 mine\n" +
+			"-rw-r--r--  12 ci    1 Jan  2  2020 theirs\n" +
+			"-rw-r--r-- 345 wheel 1 Jan  2  2020 shared\n"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		var buf strings.Builder
+		displayLongFormat(&buf, files, t.TempDir())
+		if got := buf.String(); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestNoSymlinkArrow(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/f", ""), fakeLink("/d/ln", "f"))
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-lgn"}, "total 1\n" +
+			"-rw-r--r-- 1 0 0 May  1  2024 f\n" +
+			"lrwxrwxrwx 1 0 1 May  1  2024 ln -> f\n"},
+		{[]string{"-lgn", "--no-symlink-arrow"}, "total 1\n" +
+			"-rw-r--r-- 1 0 0 May  1  2024 f\n" +
+			"lrwxrwxrwx 1 0 1 May  1  2024 ln\n"},
+		{[]string{"-lgnF", "--no-symlink-arrow"}, "total 1\n" +
+			"-rw-r--r-- 1 0 0 May  1  2024 f\n" +
+			"lrwxrwxrwx 1 0 1 May  1  2024 ln@\n"},
+		{[]string{"-F", "--no-symlink-arrow"}, "f\nln@\n"},
+		{[]string{"--tree"}, "/d\n├── f\n└── ln -> f\n"},
+		{[]string{"--tree", "--no-symlink-arrow"}, "/d\n├── f\n└── ln\n"},
+		{[]string{"--tree", "-F", "--no-symlink-arrow"}, "/d\n├── f\n└── ln@\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
+
+func TestRotationSuffix(t *testing.T) {
+	tests := []struct {
+		name, base, num string
+	}{
+		{"app.log", "app.log", ""},
+		{"app.log.1", "app.log", "1"},
+		{"app.log.10", "app.log", "10"},
+		{"app.1", "app", "1"},
+		{"app.log.1a", "app.log.1a", ""},
+		{"app.log.", "app.log.", ""},
+		{".1", ".1", ""},
+		{"plain", "plain", ""},
+	}
+	for _, tt := range tests {
+		if base, num := rotationSuffix(tt.name); base != tt.base || num != tt.num {
+			t.Errorf("rotationSuffix(%q) = %q, %q, want %q, %q", tt.name, base, num, tt.base, tt.num)
+		}
+	}
+}
+
+func TestLogSort(t *testing.T) {
+	var files []FileInfo
+	for _, name := range []string{"app.log.10", "app.log", "db.log.2", "app.log.2", "app.log.1", "db.log", "access.log.3", "app.log.old"} {
+		files = append(files, FileInfo{Name: name})
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "access.log.3 app.log app.log.1 app.log.10 app.log.2 app.log.old db.log db.log.2"},
+		{[]string{"--log-sort"}, "access.log.3 app.log app.log.1 app.log.2 app.log.10 app.log.old db.log db.log.2"},
+		{[]string{"--log-sort", "-r"}, "db.log.2 db.log app.log.old app.log.10 app.log.2 app.log.1 app.log access.log.3"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("ls %v sorted %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSIOption(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-h"}, "1.0K 1000"},
+		{[]string{"--si"}, "1.1kB 1.0kB"},
+		{[]string{"-h", "--si"}, "1.1kB 1.0kB"},
+		{[]string{"--si", "-h"}, "1.1kB 1.0kB"},
+		{[]string{"--human-readable", "--si"}, "1.1kB 1.0kB"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := formatSize(1024) + " " + formatSize(1000); got != tt.want {
+			t.Errorf("ls %v sizes 1024 and 1000 as %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWorkerCount(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{nil, min(MAX_WORKERS, runtime.NumCPU()*4)},
+		{[]string{"-j", "1"}, 1},
+		{[]string{"-j3"}, 3},
+		{[]string{"--jobs=200"}, 200},
+		{[]string{"--jobs", "8"}, 8},
+		{[]string{"-j", "2", "--jobs=5"}, 5},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := workerCount(); got != tt.want {
+			t.Errorf("ls %v: workerCount() = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"-j", "0"}, {"--jobs=-2"}, {"--jobs=many"}} {
+		value := strings.TrimPrefix(args[len(args)-1], "--jobs=")
+		status, stderr := lsStatus(t, append(args, os.DevNull)...)
+		want := "ls: invalid argument '" + value + "' for '--jobs'\n"
+		if status != 2 || stderr != want {
+			t.Errorf("ls %v exited %d with %q, want 2 with %q", args, status, stderr, want)
+		}
+	}
+}
+
+func TestPoolHonorsJobs(t *testing.T) {
+	for _, jobs := range []int{1, 3} {
+		parsedOptions(t, "-j", strconv.Itoa(jobs))
+		workers := workerCount()
+		p := pond.New(workers, workers*2)
+
+		var mu sync.Mutex
+		running, peak := 0, 0
+		for range 20 {
+			p.Submit(func() {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			})
+		}
+		p.StopAndWait()
+		if peak > jobs {
+			t.Errorf("-j %d ran %d tasks at once", jobs, peak)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	tests := []struct {
+		args       []string
+		sequential bool
+	}{
+		{nil, false},
+		{[]string{"-j", "4"}, false},
+		{[]string{"-j", "1"}, true},
+		{[]string{"--no-concurrency"}, true},
+		{[]string{"--no-concurrency", "-j", "8"}, true},
+	}
+	var want []int
+	for i := range 100 {
+		want = append(want, i)
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		saved := pool
+		if tt.sequential {
+			// The sequential path must not touch the pool at all
+			pool = nil
+		}
+
+		var mu sync.Mutex
+		var order []int
+		forEach(100, func(i int) {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+		pool = saved
+
+		// Calls through the pool finish in any order
+		if !tt.sequential {
+			slices.Sort(order)
+		}
+		if !slices.Equal(order, want) {
+			t.Errorf("ls %v: forEach called %v, want each of 0 to 99 once", tt.args, order)
+		}
+	}
+}
+
+func TestNoConcurrencyOutput(t *testing.T) {
+	files := []*fakeFile{fakeDir("/d")}
+	for i := range 40 {
+		files = append(files, fakeReg(fmt.Sprintf("/d/f%02d", (i*17)%40), strings.Repeat("x", i*100)))
+	}
+	files = append(files, fakeDir("/d/sub"), fakeReg("/d/sub/inner", "abc"), fakeLink("/d/ln", "f01"))
+	fake := newFakeFS(files...)
+
+	for _, args := range [][]string{{"-lR"}, {"-f"}, {"-lSr"}} {
+		args = append(args, "/d")
+		want := runLs(t, fake, args...)
+		for _, extra := range []string{"--no-concurrency", "-j1"} {
+			if got := runLs(t, fake, append([]string{extra}, args...)...); got != want {
+				t.Errorf("ls %s %v =\n%s\nwant the concurrent output\n%s", extra, args, got, want)
+			}
+		}
+	}
+}
+
+func TestZero(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a b", ""),
+		fakeReg("/d/new\nline", ""),
+		fakeDir("/d/sub"),
+		fakeReg("/d/sub/x", ""),
+	)
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--zero", "/d"}, "a b\x00new\nline\x00sub\x00"},
+		// Names are never quoted or escaped, and never laid out in columns
+		{[]string{"--zero", "-Q", "/d"}, "a b\x00new\nline\x00sub\x00"},
+		{[]string{"--zero", "-b", "/d"}, "a b\x00new\nline\x00sub\x00"},
+		{[]string{"--zero", "-C", "/d"}, "a b\x00new\nline\x00sub\x00"},
+		{[]string{"--zero", "-m", "/d"}, "a b\x00new\nline\x00sub\x00"},
+		{[]string{"--zero", "-lgn", "/d"}, "total 0\x00" +
+			"-rw-r--r-- 1 0 0 May  1  2024 a b\x00" +
+			"-rw-r--r-- 1 0 0 May  1  2024 new\nline\x00" +
+			"drwxr-xr-x 1 0 0 May  1  2024 sub\x00"},
+		{[]string{"--zero", "-R", "/d"}, "/d:\x00a b\x00new\nline\x00sub\x00\x00/d/sub:\x00x\x00"},
+	}
+	for _, tt := range tests {
+		got := runLs(t, fake, tt.args...)
+		if got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if strings.HasSuffix(got, "\n") {
+			t.Errorf("ls %v ends in a newline", tt.args)
+		}
+	}
+}
+
+func TestStatEntryPanic(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a", mode: syscall.S_IFREG | 0644, mtime: old},
+		&fakeFile{path: "/d/bad", mode: syscall.S_IFREG | 0644, mtime: old, infoPanic: "unexpected Sys type"},
+		&fakeFile{path: "/d/c", mode: syscall.S_IFREG | 0644, content: "abc", mtime: old},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-ln", "/d"}, "total 1\n" +
+			"-rw-r--r-- 1 0 0 0 Jan  2  2020 a\n" +
+			"-????????? ? ? ? ? ?            bad\n" +
+			"-rw-r--r-- 1 0 0 3 Jan  2  2020 c\n"},
+		{[]string{"-1", "/d"}, "a\nbad\nc\n"},
+		{[]string{"-1", "--no-concurrency", "/d"}, "a\nbad\nc\n"},
+		{[]string{"-ln", "--stat-timeout=1s", "/d"}, "total 1\n" +
+			"-rw-r--r-- 1 0 0 0 Jan  2  2020 a\n" +
+			"-????????? ? ? ? ? ?            bad\n" +
+			"-rw-r--r-- 1 0 0 3 Jan  2  2020 c\n"},
+	}
+	for _, tt := range tests {
+		stderr := captureStderr(t)
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if got, want := stderr(), "ls: /d/bad: unexpected Sys type\n"; got != want {
+			t.Errorf("ls %v wrote %q to stderr, want %q", tt.args, got, want)
+		}
+	}
+}
+
+func TestStatRetry(t *testing.T) {
+	tests := []struct {
+		failures, retries int
+		wantErr           error
+		wantCalls         int
+	}{
+		{0, 0, nil, 1},
+		{1, 0, syscall.EIO, 1},
+		{1, 1, nil, 2},
+		{2, 1, syscall.EIO, 2},
+		{2, 3, nil, 3},
+	}
+	for _, tt := range tests {
+		fake := newFakeFS(fakeReg("/f", ""))
+		fake.lstatFailures["/f"] = tt.failures
+		useFS(t, fake)
+		setOptions(t, Options{StatRetry: tt.retries})
+
+		var stat syscall.Stat_t
+		err := statPath("/f", false, &stat)
+		if err != tt.wantErr {
+			t.Errorf("%d failures, %d retries: statPath = %v, want %v", tt.failures, tt.retries, err, tt.wantErr)
+		}
+		if calls := fake.lstatCalls["/f"]; calls != tt.wantCalls {
+			t.Errorf("%d failures, %d retries: %d calls, want %d", tt.failures, tt.retries, calls, tt.wantCalls)
+		}
+	}
+}
+
+func TestStatRetryListing(t *testing.T) {
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+	}{
+		{[]string{"/f"}, "", "ls: /f: input/output error\n"},
+		{[]string{"--stat-retry=1", "/f"}, "/f\n", ""},
+		{[]string{"--stat-retry", "2", "/f"}, "/f\n", ""},
+	}
+	for _, tt := range tests {
+		fake := newFakeFS(fakeReg("/f", ""))
+		fake.lstatFailures["/f"] = 1
+		stderr := captureStderr(t)
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if got := stderr(); got != tt.stderr {
+			t.Errorf("ls %v wrote %q to stderr, want %q", tt.args, got, tt.stderr)
+		}
+	}
+
+	for _, value := range []string{"-1", "x"} {
+		status, stderr := lsStatus(t, "--stat-retry="+value, os.DevNull)
+		want := "ls: invalid argument '" + value + "' for '--stat-retry'\n"
+		if status != 2 || stderr != want {
+			t.Errorf("ls --stat-retry=%s exited %d with %q, want 2 with %q", value, status, stderr, want)
+		}
+	}
+}
+
+func TestCQuote(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       string // --quoting-style=c, as -Q
+		escaped string // --quoting-style=escape, as -b
+	}{
+		{"plain", `"plain"`, `plain`},
+		{"a b", `"a b"`, `a\ b`},
+		{"tab\there", `"tab\there"`, `tab\there`},
+		{"new\nline", `"new\nline"`, `new\nline`},
+		{"bell\a\r", `"bell\a\r"`, `bell\a\r`},
+		{"del\x7f", `"del\177"`, `del\177`},
+		{"esc\x1b", `"esc\033"`, `esc\033`},
+		{"bad\xff\xfe", `"bad\377\376"`, `bad\377\376`},
+		{"café", `"café"`, `café`},
+		{`say "hi"`, `"say \"hi\""`, `say\ "hi"`},
+		{`back\slash`, `"back\\slash"`, `back\\slash`},
+		{"", `""`, ``},
+	}
+	for _, tt := range tests {
+		if got := cQuote(tt.name, true); got != tt.c {
+			t.Errorf("cQuote(%q, true) = %s, want %s", tt.name, got, tt.c)
+		}
+		if got := cQuote(tt.name, false); got != tt.escaped {
+			t.Errorf("cQuote(%q, false) = %s, want %s", tt.name, got, tt.escaped)
+		}
+	}
+}
+
+func TestQuoteNameFormats(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		fakeReg("/d/a b", ""),
+		fakeReg("/d/new\nline", ""),
+		fakeReg("/d/x\xff", ""),
+	)
+	for _, f := range fake.files {
+		f.mtime = mtime
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-1Q"}, `"a b"` + "\n" + `"new\nline"` + "\n" + `"x\377"` + "\n"},
+		// Columns are as wide as the longest quoted name
+		{[]string{"-CQ"}, `"a b"        "new\nline"  "x\377"` + "\n"},
+		{[]string{"-mQ"}, `"a b", "new\nline", "x\377"` + "\n"},
+		{[]string{"-lgnQ"}, "total 0\n" +
+			`-rw-r--r-- 1 0 0 May  1  2024 "a b"` + "\n" +
+			`-rw-r--r-- 1 0 0 May  1  2024 "new\nline"` + "\n" +
+			`-rw-r--r-- 1 0 0 May  1  2024 "x\377"` + "\n"},
+		{[]string{"-1", "--quote-name"}, `"a b"` + "\n" + `"new\nline"` + "\n" + `"x\377"` + "\n"},
+		{[]string{"-1b"}, `a\ b` + "\n" + `new\nline` + "\n" + `x\377` + "\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteStyle(t *testing.T) {
+	tests := []struct {
+		style string
+		space string // "a b"
+		quote string // "it's"
+		plain string // "plain"
+	}{
+		{QuoteLiteral, `a b`, `it's`, `plain`},
+		{QuoteShell, `'a b'`, `'it'\''s'`, `plain`},
+		{QuoteShellAlways, `'a b'`, `'it'\''s'`, `'plain'`},
+		{QuoteShellEscape, `'a b'`, `'it'\''s'`, `plain`},
+		{QuoteC, `"a b"`, `"it's"`, `"plain"`},
+		{QuoteEscape, `a\ b`, `it's`, `plain`},
+	}
+	for _, tt := range tests {
+		for _, c := range []struct{ name, want string }{{"a b", tt.space}, {"it's", tt.quote}, {"plain", tt.plain}} {
+			if got := quoteStyle(c.name, tt.style); got != c.want {
+				t.Errorf("quoteStyle(%q, %s) = %s, want %s", c.name, tt.style, got, c.want)
+			}
+		}
+	}
+}
+
+func TestQuotingStyleOption(t *testing.T) {
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/a b", ""), fakeReg("/d/it's", ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--quoting-style=literal"}, "a b\nit's\n"},
+		{[]string{"--quoting-style=shell"}, `'a b'` + "\n" + `'it'\''s'` + "\n"},
+		{[]string{"--quoting-style=shell-always"}, `'a b'` + "\n" + `'it'\''s'` + "\n"},
+		{[]string{"--quoting-style=shell-escape"}, `'a b'` + "\n" + `'it'\''s'` + "\n"},
+		{[]string{"--quoting-style=c"}, `"a b"` + "\n" + `"it's"` + "\n"},
+		{[]string{"--quoting-style=escape"}, `a\ b` + "\n" + `it's` + "\n"},
+		{[]string{"-Q"}, `"a b"` + "\n" + `"it's"` + "\n"},
+		{[]string{"-b"}, `a\ b` + "\n" + `it's` + "\n"},
+		{[]string{"--quote-name"}, `"a b"` + "\n" + `"it's"` + "\n"},
+		{[]string{"--escape"}, `a\ b` + "\n" + `it's` + "\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+
+	status, stderr := lsStatus(t, "--quoting-style=perl", os.DevNull)
+	if want := "ls: invalid argument 'perl' for '--quoting-style'\n"; status != 2 || stderr != want {
+		t.Errorf("ls --quoting-style=perl exited %d with %q, want 2 with %q", status, stderr, want)
+	}
+}
+
+func TestEscapeOverQuestionMarks(t *testing.T) {
+	fake := newFakeFS(fakeDir("/d"), fakeReg("/d/a b", ""), fakeReg("/d/new\nline", ""), fakeReg("/d/tab\t", ""))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-q"}, "a b\nnew?line\ntab?\n"},
+		{[]string{"-b"}, `a\ b` + "\n" + `new\nline` + "\n" + `tab\t` + "\n"},
+		// -b and -Q show control characters more precisely than -q, in
+		// either order
+		{[]string{"-qb"}, `a\ b` + "\n" + `new\nline` + "\n" + `tab\t` + "\n"},
+		{[]string{"-bq"}, `a\ b` + "\n" + `new\nline` + "\n" + `tab\t` + "\n"},
+		{[]string{"-qQ"}, `"a b"` + "\n" + `"new\nline"` + "\n" + `"tab\t"` + "\n"},
+		{[]string{"-q", "--quoting-style=shell-always"}, "'a b'\n'new?line'\n'tab?'\n"},
+		{[]string{"-q", "--show-control-chars"}, "a b\nnew\nline\ntab\t\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "-1", "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
+
+func TestNoColor(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/multi", mode: syscall.S_IFREG | 0755, nlink: 5, mtime: time.Now()},
+		fakeDir("/d/sub"),
+	)
+	tests := []struct {
+		noColor string
+		args    []string
+		colored bool
+	}{
+		{"", []string{"--color=always", "/d"}, true},
+		{"1", []string{"--color=always", "/d"}, false},
+		{"yes", []string{"--color", "/d"}, false},
+		{"1", []string{"--color=always", "-l", "--time-color", "--link-color=2", "/d"}, false},
+		{"", []string{"-l", "--time-color", "/d"}, true},
+		{"1", []string{"-l", "--time-color", "/d"}, false},
+		{"", []string{"-l", "--link-color=2", "/d"}, true},
+		{"1", []string{"-l", "--link-color=2", "/d"}, false},
+		{"", []string{"-l", "--mode-color", "/d"}, true},
+		{"1", []string{"-l", "--mode-color", "/d"}, false},
+	}
+	for _, tt := range tests {
+		got := runLsEnv(t, map[string]string{"NO_COLOR": tt.noColor}, fake, tt.args...)
+		if colored := strings.Contains(got, "\x1b["); colored != tt.colored {
+			t.Errorf("NO_COLOR=%q ls %v colored %v, want %v:\n%q", tt.noColor, tt.args, colored, tt.colored, got)
+		}
+	}
+}
+
+func TestBirthTime(t *testing.T) {
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	files := []FileInfo{
+		{Name: "middle", Mode: 0644, Links: 1, ModTime: base, BirthTime: base.Add(-48 * time.Hour)},
+		{Name: "oldest", Mode: 0644, Links: 1, ModTime: base.Add(time.Hour), BirthTime: base.Add(-72 * time.Hour)},
+		{Name: "newest", Mode: 0644, Links: 1, ModTime: base.Add(-time.Hour), BirthTime: base.Add(-24 * time.Hour)},
+		{Name: "unknown", Mode: 0644, Links: 1, ModTime: base.Add(2 * time.Hour)},
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-t"}, "unknown oldest middle newest"},
+		// A birth time the system did not record sorts as the oldest
+		{[]string{"-tU"}, "newest middle oldest unknown"},
+		{[]string{"-t", "--time=birth"}, "newest middle oldest unknown"},
+		{[]string{"-t", "--time=creation"}, "newest middle oldest unknown"},
+		{[]string{"-tUr"}, "unknown oldest middle newest"},
+		{[]string{"-U", "--time=mtime", "-t"}, "unknown oldest middle newest"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := sortedNames(files); got != tt.want {
+			t.Errorf("ls %v sorted %s, want %s", tt.args, got, tt.want)
+		}
+	}
+
+	parsedOptions(t, "-lnU")
+	var buf strings.Builder
+	displayLongFormat(&buf, files, t.TempDir())
+	want := "total 0\n" +
+		"-rw-r--r-- 1 0 0 0 Feb 28  2024 middle\n" +
+		"-rw-r--r-- 1 0 0 0 Feb 27  2024 oldest\n" +
+		"-rw-r--r-- 1 0 0 0 Feb 29  2024 newest\n" +
+		"-rw-r--r-- 1 0 0 0 -            unknown\n"
+	if got := buf.String(); got != want {
+		t.Errorf("ls -lnU = %q, want %q", got, want)
+	}
+
+	status, stderr := lsStatus(t, "--time=born", os.DevNull)
+	if want := "ls: invalid argument 'born' for '--time'\n"; status != 2 || stderr != want {
+		t.Errorf("ls --time=born exited %d with %q, want 2 with %q", status, stderr, want)
+	}
+}
+
+func TestFullTime(t *testing.T) {
+	zone := time.FixedZone("", -7*60*60)
+	file := FileInfo{
+		ModTime:    time.Date(2006, 1, 2, 15, 4, 5, 123456789, zone),
+		AccessTime: time.Date(2023, 11, 30, 23, 59, 59, 1, time.UTC),
+		ChangeTime: time.Date(2024, 2, 29, 0, 0, 0, 0, time.FixedZone("", 5*60*60+30*60)),
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--full-time"}, "2006-01-02 15:04:05.123456789 -0700"},
+		{[]string{"--full-time", "-u"}, "2023-11-30 23:59:59.000000001 +0000"},
+		{[]string{"--full-time", "-c"}, "2024-02-29 00:00:00.000000000 +0530"},
+		{[]string{"--full-time", "--time=atime"}, "2023-11-30 23:59:59.000000001 +0000"},
+		{[]string{"--time-style=full-iso"}, "2006-01-02 15:04:05.123456789 -0700"},
+		// -T keeps to whole seconds
+		{[]string{"-T"}, "Jan  2 15:04:05 2006"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, tt.args...)
+		if got := formatTime(selectedTime(file)); got != tt.want {
+			t.Errorf("ls %v shows %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// Like GNU ls, --full-time implies -l
+	if parsedOptions(t, "--full-time"); !opts.LongFormat {
+		t.Error("ls --full-time does not select the long format")
+	}
+}
+
+func TestRecentCutoff(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		t      time.Time
+		recent bool
+	}{
+		{"an hour ago", now.Add(-time.Hour), true},
+		{"2 months ago", now.AddDate(0, -2, 0), true},
+		{"a day inside 6 months", now.AddDate(0, -6, 1), true},
+		{"a day past 6 months", now.AddDate(0, -6, -1), false},
+		{"7 months ago", now.AddDate(0, -7, 0), false},
+		{"a minute ahead", now.Add(time.Minute), false},
+		{"a year ahead", now.AddDate(1, 0, 0), false},
+	}
+	for _, tt := range tests {
+		parsedOptions(t)
+		want := tt.t.Format("Jan _2  2006")
+		if tt.recent {
+			want = tt.t.Format("Jan _2 15:04")
+		}
+		if got := formatTime(tt.t); got != want {
+			t.Errorf("%s: formatTime(%v) = %q, want %q", tt.name, tt.t, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// markdownColumn is one column of the --format=markdown table
+type markdownColumn struct {
+	header string
+	right  bool // right-align numeric columns
+	value  func(file FileInfo) string
+}
+
+// markdownColumns returns the long-format columns enabled by the options
+func markdownColumns() []markdownColumn {
+	var columns []markdownColumn
+
+	if opts.Inode {
+		columns = append(columns, markdownColumn{"Inode", true, formatInode})
+	}
+	if opts.Blocks {
+		columns = append(columns, markdownColumn{"Blocks", true, func(file FileInfo) string {
+			return strconv.FormatInt(blockCount(file), 10)
+		}})
+	}
+
+	columns = append(columns,
+		markdownColumn{"Mode", false, func(file FileInfo) string {
+			return styleMode(formatMode(file.Mode, file.IsSymlink), file.Mode)
+		}},
+		markdownColumn{"Links", true, func(file FileInfo) string {
+			return strconv.FormatUint(file.Links, 10)
+		}},
+	)
+
+	if !opts.GroupFormat {
+		columns = append(columns, markdownColumn{"Owner", false, ownerField})
+	}
+	columns = append(columns, markdownColumn{"Group", false, groupField})
+
+	if opts.Flags {
+		columns = append(columns, markdownColumn{"Flags", false, func(file FileInfo) string {
+			return formatFlags(file.Flags)
+		}})
+	}
+
+	columns = append(columns,
+		markdownColumn{"Size", true, sizeField},
+		markdownColumn{"Time", false, func(file FileInfo) string {
+			return formatTime(selectedTime(file))
+		}},
+		markdownColumn{"Name", false, func(file FileInfo) string {
+			name := file.Name
+			if opts.Classify {
+				name += getClassifyChar(file)
+			} else if opts.Slash && file.IsDir {
+				name += "/"
+			}
+			if file.IsSymlink && file.LinkTarget != "" && !opts.NoSymlinkArrow {
+				name += " " + deco.arrow + " " + file.LinkTarget
+			}
+			return name
+		}},
+	)
+
+	return columns
+}
+
+// displayMarkdownTable renders the long-format columns as a GitHub-flavored
+// Markdown table for --format=markdown
+func displayMarkdownTable(w io.Writer, files []FileInfo) {
+	columns := markdownColumns()
+
+	// Gather every cell first so each column can be padded to its widest value
+	rows := make([][]string, len(files))
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		widths[i] = max(displayWidth(column.header), 3)
+	}
+	for r, file := range files {
+		rows[r] = make([]string, len(columns))
+		for i, column := range columns {
+			cell := escapeMarkdownCell(column.value(file))
+			rows[r][i] = cell
+			widths[i] = max(widths[i], displayWidth(cell))
+		}
+	}
+
+	headers := make([]string, len(columns))
+	separators := make([]string, len(columns))
+	for i, column := range columns {
+		headers[i] = column.header
+		if column.right {
+			separators[i] = strings.Repeat("-", widths[i]-1) + ":"
+		} else {
+			separators[i] = strings.Repeat("-", widths[i])
+		}
+	}
+
+	writeMarkdownRow(w, columns, widths, headers)
+	writeMarkdownRow(w, columns, widths, separators)
+	for _, row := range rows {
+		writeMarkdownRow(w, columns, widths, row)
+	}
+}
+
+func writeMarkdownRow(w io.Writer, columns []markdownColumn, widths []int, cells []string) {
+	var line strings.Builder
+	line.WriteString("|")
+	for i, cell := range cells {
+		padding := strings.Repeat(" ", widths[i]-displayWidth(cell))
+		line.WriteString(" ")
+		if columns[i].right {
+			line.WriteString(padding + cell)
+		} else {
+			line.WriteString(cell + padding)
+		}
+		line.WriteString(" |")
+	}
+	fmt.Fprintln(w, line.String())
+}
+
+// escapeMarkdownCell keeps cell text from breaking the table: pipes and
+// backslashes are escaped and line breaks become spaces
+func escapeMarkdownCell(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
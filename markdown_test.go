@@ -0,0 +1,58 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEscapeMarkdownCell(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"a|b", `a\|b`},
+		{`back\slash`, `back\\slash`},
+		{`\|`, `\\\|`},
+		{"two\nlines\r", "two lines "},
+	}
+	for _, tt := range tests {
+		if got := escapeMarkdownCell(tt.s); got != tt.want {
+			t.Errorf("escapeMarkdownCell(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMarkdownTable(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/a|b", mode: syscall.S_IFREG | 0644, content: "12345", mtime: old, uid: 1000, gid: 100},
+		&fakeFile{path: "/d/link", mode: syscall.S_IFLNK | 0777, target: "a|b", mtime: old, uid: 1000, gid: 100},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"--format=markdown", "-n", "/d"},
+			"| Mode       | Links | Owner | Group | Size | Time         | Name         |\n" +
+				"| ---------- | ----: | ----- | ----- | ---: | ------------ | ------------ |\n" +
+				"| -rw-r--r-- |     1 | 1000  | 100   |    5 | Jan  2  2020 | a\\|b         |\n" +
+				"| lrwxrwxrwx |     1 | 1000  | 100   |    3 | Jan  2  2020 | link -> a\\|b |\n",
+		},
+		{
+			[]string{"--format=markdown", "-g", "-n", "-i", "/d"},
+			"| Inode | Mode       | Links | Group | Size | Time         | Name         |\n" +
+				"| ----: | ---------- | ----: | ----- | ---: | ------------ | ------------ |\n" +
+				"|     3 | -rw-r--r-- |     1 | 100   |    5 | Jan  2  2020 | a\\|b         |\n" +
+				"|     4 | lrwxrwxrwx |     1 | 100   |    3 | Jan  2  2020 | link -> a\\|b |\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, fake, tt.args...); got != tt.want {
+			t.Errorf("ls %v =\n%s\nwant\n%s", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// pager pauses the listing after every --page lines and waits for a key on
+// the controlling terminal: space shows the next page, return the next
+// line, and q ends the listing.
+type pager struct {
+	w     io.Writer
+	tty   *os.File
+	lines int
+}
+
+// pagerPrompt is shown while waiting, and erased before output resumes
+const pagerPrompt = "--More--"
+
+func (p *pager) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// Pause before a line rather than after one, so the listing never
+		// ends on a prompt
+		if p.lines >= opts.Page {
+			p.lines -= p.wait()
+		}
+
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+			p.lines++
+		}
+		n, err := p.w.Write(line)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(line):]
+	}
+	return written, nil
+}
+
+// wait shows the prompt and reads a key, returning how many more lines may
+// be written before the next pause
+func (p *pager) wait() int {
+	io.WriteString(p.w, pagerPrompt)
+	key := p.readKey()
+	io.WriteString(p.w, "\r\033[K")
+
+	switch key {
+	case 'q', 'Q', 3, 4: // q, Ctrl-C or Ctrl-D
+		os.Exit(0)
+	case '\r', '\n':
+		return 1
+	}
+	return opts.Page
+}
+
+// readKey reads a single keypress with the terminal in raw mode, restoring
+// its settings afterwards. Without a usable terminal it returns a space, so
+// the listing carries on.
+func (p *pager) readKey() byte {
+	fd := int(p.tty.Fd())
+	saved, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return ' '
+	}
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return ' '
+	}
+	defer unix.IoctlSetTermios(fd, ioctlSetTermios, saved)
+
+	var key [1]byte
+	if n, err := p.tty.Read(key[:]); n == 0 || err != nil {
+		return 'q'
+	}
+	return key[0]
+}
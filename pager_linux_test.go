@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty opens a pseudo-terminal pair, returning the controlling side and
+// the terminal the pager reads keys from
+func openPty(t *testing.T) (master, tty *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("unlockpt: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Skipf("ptsname: %v", err)
+	}
+	tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("open pty: %v", err)
+	}
+	t.Cleanup(func() { tty.Close() })
+	return master, tty
+}
+
+func TestPagerKeys(t *testing.T) {
+	tests := []struct {
+		keys string
+		want string
+	}{
+		// space shows a whole page, return a single line
+		{" ", "1\n2\n" + pageBreak + "3\n4\n"},
+		{"\r \n", "1\n2\n" + pageBreak + "3\n" + pageBreak + "4\n"},
+		{"\n\n", "1\n2\n" + pageBreak + "3\n" + pageBreak + "4\n"},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Page: 2})
+		master, tty := openPty(t)
+
+		// The keys arrive without a newline to end them, so they only reach
+		// the pager if it has put the terminal in raw mode
+		if _, err := master.Write([]byte(tt.keys)); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p := &pager{w: &buf, tty: tty}
+			p.Write([]byte("1\n2\n3\n4\n"))
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pager with keys %q never finished", tt.keys)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("pager with keys %q wrote %q, want %q", tt.keys, buf.String(), tt.want)
+		}
+
+		// The terminal is back in canonical mode afterwards
+		termios, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlGetTermios)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if termios.Lflag&unix.ICANON == 0 {
+			t.Errorf("pager with keys %q left the terminal in raw mode", tt.keys)
+		}
+	}
+}
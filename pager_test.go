@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pageBreak is what the pager writes around a pause
+const pageBreak = pagerPrompt + "\r\033[K"
+
+func TestPagerWithoutTerminal(t *testing.T) {
+	// Anything that is not a terminal reads as a space, so the pager runs
+	// through a page at a time without blocking
+	tty, err := os.Create(filepath.Join(t.TempDir(), "tty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	tests := []struct {
+		page  int
+		input string
+		want  string
+	}{
+		{3, "a\nb\n", "a\nb\n"},
+		{2, "a\nb\n", "a\nb\n"},
+		{2, "a\nb\nc\n", "a\nb\n" + pageBreak + "c\n"},
+		{1, "a\nb\nc\n", "a\n" + pageBreak + "b\n" + pageBreak + "c\n"},
+		{2, "a\nb\nc\nd\ne", "a\nb\n" + pageBreak + "c\nd\n" + pageBreak + "e"},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{Page: tt.page})
+		var buf bytes.Buffer
+		p := &pager{w: &buf, tty: tty}
+
+		// Split the writes mid-line to check lines are counted, not writes
+		for _, chunk := range strings.SplitAfter(tt.input, "b") {
+			if _, err := p.Write([]byte(chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.String() != tt.want {
+			t.Errorf("--page=%d of %q = %q, want %q", tt.page, tt.input, buf.String(), tt.want)
+		}
+	}
+}
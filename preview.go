@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+)
+
+// headPreviews reads the first opts.Head bytes of each regular file among
+// files, the contents of basePath, concurrently with forEach. The result
+// is indexed like files, empty for entries that have no preview.
+func headPreviews(basePath string, files []FileInfo) []string {
+	previews := make([]string, len(files))
+	forEach(len(files), func(i int) {
+		file := files[i]
+		if file.StatFailed || !file.Mode.IsRegular() {
+			return
+		}
+		previews[i] = headPreview(filepath.Join(basePath, file.Name), file.Size)
+	})
+	return previews
+}
+
+// headPreview renders the first opts.Head bytes of the file at path, which
+// is size bytes long, ending in an ellipsis when there is more. Unreadable
+// files show as '?'.
+func headPreview(path string, size int64) string {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "?"
+	}
+	defer f.Close()
+
+	buf := make([]byte, opts.Head)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "?"
+	}
+
+	preview := escapeBytes(buf[:n])
+	if size > int64(n) {
+		preview += deco.ellipsis
+	}
+	return preview
+}
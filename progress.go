@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressReporter shows a running count of directories and files on stderr
+// for --progress. The line is redrawn in place with a carriage return and
+// erased whenever the listing itself is written, so the two never mix.
+type progressReporter struct {
+	dirs  atomic.Int64
+	files atomic.Int64
+
+	mu    sync.Mutex
+	shown bool
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+const progressInterval = 200 * time.Millisecond
+
+// progress is nil unless --progress is active and stderr is a terminal
+var progress *progressReporter
+
+func startProgress() *progressReporter {
+	p := &progressReporter{done: make(chan struct{})}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.draw()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// addDirectory records a scanned directory holding entries files
+func (p *progressReporter) addDirectory(entries int) {
+	if p == nil {
+		return
+	}
+	p.dirs.Add(1)
+	p.files.Add(int64(entries))
+}
+
+func (p *progressReporter) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "\rls: %d directories, %d files scanned", p.dirs.Load(), p.files.Load())
+	p.shown = true
+}
+
+// hidden runs write with the progress line erased from the terminal
+func (p *progressReporter) hidden(write func()) {
+	if p == nil {
+		write()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+	write()
+}
+
+// stop ends reporting and erases the progress line
+func (p *progressReporter) stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	p.hidden(func() {})
+}
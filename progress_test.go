@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureStderr points os.Stderr at a file until the test ends and returns
+// a function reading what was written so far
+func captureStderr(t *testing.T) func() string {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = f
+	t.Cleanup(func() {
+		os.Stderr = saved
+		f.Close()
+	})
+	return func() string {
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestProgressCounts(t *testing.T) {
+	tests := []struct {
+		entries []int
+		dirs    int64
+		files   int64
+	}{
+		{nil, 0, 0},
+		{[]int{0}, 1, 0},
+		{[]int{3, 0, 7}, 3, 10},
+	}
+	for _, tt := range tests {
+		p := &progressReporter{done: make(chan struct{})}
+		for _, n := range tt.entries {
+			p.addDirectory(n)
+		}
+		if p.dirs.Load() != tt.dirs || p.files.Load() != tt.files {
+			t.Errorf("after %v: %d directories, %d files; want %d, %d", tt.entries, p.dirs.Load(), p.files.Load(), tt.dirs, tt.files)
+		}
+	}
+
+	// Without --progress there is no reporter, and every method still works
+	var p *progressReporter
+	p.addDirectory(5)
+	ran := false
+	p.hidden(func() { ran = true })
+	p.stop()
+	if !ran {
+		t.Error("a nil reporter did not run the write passed to hidden")
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps func(p *progressReporter)
+		want  string
+	}{
+		{"nothing drawn", func(p *progressReporter) {
+			p.hidden(func() {})
+		}, ""},
+		{"drawn", func(p *progressReporter) {
+			p.addDirectory(4)
+			p.draw()
+		}, "\rls: 1 directories, 4 files scanned"},
+		{"erased before writing", func(p *progressReporter) {
+			p.draw()
+			p.hidden(func() { os.Stderr.WriteString("out") })
+			p.hidden(func() {})
+		}, "\rls: 0 directories, 0 files scanned\r\033[Kout"},
+	}
+	for _, tt := range tests {
+		stderr := captureStderr(t)
+		p := &progressReporter{done: make(chan struct{})}
+		tt.steps(p)
+		if got := stderr(); got != tt.want {
+			t.Errorf("%s: stderr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStatBirthTimeUnset(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		birth time.Time
+		want  time.Time
+	}{
+		{time.Unix(-1, 0), time.Time{}},
+		{time.Unix(0, 0), time.Time{}},
+		{time.Unix(1, 0), time.Unix(1, 0)},
+		{created, created},
+	}
+	for _, tt := range tests {
+		stat := syscall.Stat_t{Birthtimespec: syscall.NsecToTimespec(tt.birth.UnixNano())}
+		if got := statBirthTime("file", &stat, false); !got.Equal(tt.want) {
+			t.Errorf("statBirthTime with a birth time of %v = %v, want %v", tt.birth, got, tt.want)
+		}
+	}
+}
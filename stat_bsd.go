@@ -0,0 +1,45 @@
+//go:build freebsd || netbsd
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statTimes returns the modification, access and change times from a stat result
+func statTimes(stat *syscall.Stat_t) (mtime, atime, ctime time.Time) {
+	mtime = time.Unix(int64(stat.Mtimespec.Sec), int64(stat.Mtimespec.Nsec))
+	atime = time.Unix(int64(stat.Atimespec.Sec), int64(stat.Atimespec.Nsec))
+	ctime = time.Unix(int64(stat.Ctimespec.Sec), int64(stat.Ctimespec.Nsec))
+	return mtime, atime, ctime
+}
+
+// statBirthTime returns the creation time recorded in the stat result.
+// UFS1 and other filesystems that keep none report -1 or zero, for which
+// the zero time is returned.
+func statBirthTime(path string, stat *syscall.Stat_t, follow bool) time.Time {
+	if stat.Birthtimespec.Sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(stat.Birthtimespec.Sec), int64(stat.Birthtimespec.Nsec))
+}
+
+// deviceNumbers splits the device id of a block or character device into
+// its major and minor numbers
+func deviceNumbers(stat *syscall.Stat_t) (major, minor uint32) {
+	return unix.Major(stat.Rdev), unix.Minor(stat.Rdev)
+}
+
+// inodeGeneration is unavailable: the kernel only reports st_gen to root
+func inodeGeneration(path string) (uint32, bool) {
+	return 0, false
+}
+
+// onOverlayfs always reports false: overlayfs is Linux only, and the BSDs
+// mark whiteouts with S_IFWHT instead
+func onOverlayfs(path string) bool {
+	return false
+}
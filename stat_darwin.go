@@ -0,0 +1,44 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// statTimes returns the modification, access and change times from a stat result
+func statTimes(stat *syscall.Stat_t) (mtime, atime, ctime time.Time) {
+	mtime = time.Unix(stat.Mtimespec.Sec, stat.Mtimespec.Nsec)
+	atime = time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec)
+	ctime = time.Unix(stat.Ctimespec.Sec, stat.Ctimespec.Nsec)
+	return mtime, atime, ctime
+}
+
+// statBirthTime returns the creation time recorded in the stat result.
+// Filesystems without one, such as those mounted over NFS, leave it zero,
+// and the zero time is returned for them.
+func statBirthTime(path string, stat *syscall.Stat_t, follow bool) time.Time {
+	if stat.Birthtimespec.Sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(stat.Birthtimespec.Sec, stat.Birthtimespec.Nsec)
+}
+
+// deviceNumbers splits the device id of a block or character device into
+// its major and minor numbers: the top 8 bits and the low 24, as the
+// major() and minor() macros do
+func deviceNumbers(stat *syscall.Stat_t) (major, minor uint32) {
+	rdev := uint32(stat.Rdev)
+	return (rdev >> 24) & 0xff, rdev & 0xffffff
+}
+
+// inodeGeneration is unavailable: Darwin only reports st_gen to root, and
+// syscall leaves it zero
+func inodeGeneration(path string) (uint32, bool) {
+	return 0, false
+}
+
+// onOverlayfs always reports false: overlayfs is Linux only, and Darwin
+// marks whiteouts with S_IFWHT instead
+func onOverlayfs(path string) bool {
+	return false
+}
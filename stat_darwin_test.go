@@ -0,0 +1,27 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	tests := []struct {
+		rdev         int32
+		major, minor uint32
+	}{
+		{0, 0, 0},
+		{0x03000002, 3, 2},  // /dev/null
+		{0x01000000, 1, 0},  // /dev/disk0
+		{0x01000004, 1, 4},  // /dev/disk1
+		{0x10000003, 16, 3}, // /dev/ttys003
+		{0x7f123456, 0x7f, 0x123456},
+		{-1, 0xff, 0xffffff},
+	}
+	for _, tt := range tests {
+		major, minor := deviceNumbers(&syscall.Stat_t{Rdev: tt.rdev})
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("deviceNumbers(%#x) = %d, %d; want %d, %d", tt.rdev, major, minor, tt.major, tt.minor)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// statTimes returns the modification, access and change times from a stat result
+func statTimes(stat *syscall.Stat_t) (mtime, atime, ctime time.Time) {
+	mtime = time.Unix(stat.Mtim.Sec, stat.Mtim.Nsec)
+	atime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	ctime = time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
+	return mtime, atime, ctime
+}
+
+// statBirthTime queries the creation time with statx(2), since stat(2) does
+// not report it on Linux. A zero time is returned when the kernel or the
+// filesystem does not record birth times.
+func statBirthTime(path string, stat *syscall.Stat_t, follow bool) time.Time {
+	flags := unix.AT_SYMLINK_NOFOLLOW
+	if follow {
+		flags = 0
+	}
+
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, flags, unix.STATX_BTIME, &stx); err != nil {
+		return time.Time{}
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
+
+// deviceNumbers splits the device id of a block or character device into
+// its major and minor numbers, using glibc's dev_t layout
+func deviceNumbers(stat *syscall.Stat_t) (major, minor uint32) {
+	return unix.Major(stat.Rdev), unix.Minor(stat.Rdev)
+}
+
+// fsIocGetVersion is FS_IOC_GETVERSION, _IOR('v', 1, long), which x/sys
+// does not define
+const fsIocGetVersion = 0x80007601 | uint(unsafe.Sizeof(uintptr(0)))<<16
+
+// inodeGeneration reads the generation number of the inode at path, which
+// ext4 and a few other filesystems expose through FS_IOC_GETVERSION
+func inodeGeneration(path string) (uint32, bool) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, false
+	}
+	defer unix.Close(fd)
+
+	gen, err := unix.IoctlGetUint32(fd, fsIocGetVersion)
+	if err != nil {
+		return 0, false
+	}
+	return gen, true
+}
+
+// onOverlayfs reports whether path lives on an overlayfs mount, the only
+// place a 0/0 character device marks a whiteout
+func onOverlayfs(path string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return fs.Type == unix.OVERLAYFS_SUPER_MAGIC
+}
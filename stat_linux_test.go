@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStatBirthTime(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().Add(-time.Second)
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Second)
+
+	var stat syscall.Stat_t
+	if statBirthTime(file, &stat, false).IsZero() {
+		t.Skip("the filesystem does not record birth times")
+	}
+
+	tests := []struct {
+		path   string
+		follow bool
+		want   bool // whether a birth time is found
+	}{
+		{file, false, true},
+		{link, false, true},
+		{link, true, true},
+		{filepath.Join(dir, "missing"), false, false},
+	}
+	for _, tt := range tests {
+		got := statBirthTime(tt.path, &stat, tt.follow)
+		if got.IsZero() == tt.want {
+			t.Errorf("statBirthTime(%q, follow=%v) = %v, want a birth time: %v", tt.path, tt.follow, got, tt.want)
+			continue
+		}
+		if tt.want && (got.Before(before) || got.After(after)) {
+			t.Errorf("statBirthTime(%q, follow=%v) = %v, want between %v and %v", tt.path, tt.follow, got, before, after)
+		}
+	}
+}
+
+func TestGetFileInfoBirthTime(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stat syscall.Stat_t
+	if statBirthTime(file, &stat, false).IsZero() {
+		t.Skip("the filesystem does not record birth times")
+	}
+
+	// The statx call is only made when -U asks for birth times
+	tests := []struct {
+		birthTime bool
+		want      bool
+	}{
+		{false, false},
+		{true, true},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{BirthTime: tt.birthTime})
+		info, err := getFileInfo(file, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := !info.BirthTime.IsZero(); got != tt.want {
+			t.Errorf("with BirthTime=%v, getFileInfo found a birth time: %v, want %v", tt.birthTime, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceNumbers(t *testing.T) {
+	tests := []struct {
+		rdev         uint64
+		major, minor uint32
+	}{
+		{0, 0, 0},
+		{0x103, 1, 3},    // /dev/null
+		{0x801, 8, 1},    // /dev/sda1
+		{0x8800, 136, 0}, // /dev/pts/0
+		{0x12310345, 259, 0x12345},
+		{0xfffff, 4095, 255},
+		{0x100000100000, 4096, 256},
+		{0xffffffffffffffff, 0xffffffff, 0xffffffff},
+	}
+	for _, tt := range tests {
+		major, minor := deviceNumbers(&syscall.Stat_t{Rdev: tt.rdev})
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("deviceNumbers(%#x) = %d, %d; want %d, %d", tt.rdev, major, minor, tt.major, tt.minor)
+		}
+	}
+}
+
+func TestDeviceListing(t *testing.T) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat("/dev/null", &stat); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		t.Skip("no /dev/null character device")
+	}
+
+	got := runLs(t, osFileSystem{}, "-ln", "/dev/null")
+	lines := strings.Split(got, "\n")
+	if fields := strings.Fields(lines[len(lines)-2]); len(fields) < 6 || fields[4] != "1," || fields[5] != "3" {
+		t.Errorf("ls -ln /dev/null = %q, want device 1, 3", got)
+	}
+}
+
+func TestInodeGeneration(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	gen, ok := inodeGeneration(file)
+	if !ok {
+		t.Skip("the filesystem does not support FS_IOC_GETVERSION")
+	}
+	if _, ok := inodeGeneration(link); ok {
+		t.Errorf("inodeGeneration followed the symlink %s", link)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(file, &stat); err != nil {
+		t.Fatal(err)
+	}
+	withGen := fmt.Sprintf("%d.%d file\n", stat.Ino, gen)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-i", "--inode-generation", file}, fmt.Sprintf("%8s %s\n", fmt.Sprintf("%d.%d", stat.Ino, gen), file)},
+		{[]string{"-i", file}, fmt.Sprintf("%8d %s\n", stat.Ino, file)},
+		{[]string{"--inode-generation", file}, file + "\n"},
+	}
+	for _, tt := range tests {
+		if got := runLs(t, osFileSystem{}, tt.args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := runLs(t, osFileSystem{}, "-i1", "--inode-generation", dir); !strings.Contains(got, withGen) {
+		t.Errorf("ls -i1 --inode-generation %s = %q, want a line %q", dir, got, withGen)
+	}
+}
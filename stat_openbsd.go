@@ -0,0 +1,42 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statTimes returns the modification, access and change times from a stat result
+func statTimes(stat *syscall.Stat_t) (mtime, atime, ctime time.Time) {
+	mtime = time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec))
+	atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+	return mtime, atime, ctime
+}
+
+// statBirthTime returns the creation time recorded in the stat result. Only
+// FFS2 records one; elsewhere the field is zero and so is the result.
+func statBirthTime(path string, stat *syscall.Stat_t, follow bool) time.Time {
+	if stat.X__st_birthtim.Sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(stat.X__st_birthtim.Sec), int64(stat.X__st_birthtim.Nsec))
+}
+
+// deviceNumbers splits the device id of a block or character device into
+// its major and minor numbers
+func deviceNumbers(stat *syscall.Stat_t) (major, minor uint32) {
+	return unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+}
+
+// inodeGeneration is unavailable: the kernel only reports st_gen to root
+func inodeGeneration(path string) (uint32, bool) {
+	return 0, false
+}
+
+// onOverlayfs always reports false: overlayfs is Linux only, and OpenBSD
+// marks whiteouts with S_IFWHT instead
+func onOverlayfs(path string) bool {
+	return false
+}
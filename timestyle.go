@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Time styles for --time-style; a style may also be +FORMAT
+const (
+	TimeStyleFullISO = "full-iso"
+	TimeStyleLongISO = "long-iso"
+	TimeStyleISO     = "iso"
+	TimeStyleLocale  = "locale"
+)
+
+// validTimeStyle reports whether style is a --time-style argument
+func validTimeStyle(style string) bool {
+	switch style {
+	case TimeStyleFullISO, TimeStyleLongISO, TimeStyleISO, TimeStyleLocale:
+		return true
+	}
+	return strings.HasPrefix(style, "+")
+}
+
+// customTime renders t in the layout of a --time-style=+FORMAT. A layout
+// holding '%' is read as strftime(3) directives, anything else as a Go
+// reference-time layout.
+func customTime(t time.Time, layout string) string {
+	if !strings.Contains(layout, "%") {
+		return t.Format(layout)
+	}
+	return strftime(t, layout)
+}
+
+// strftime renders t by the common strftime(3) directives, along with %N
+// for nanoseconds as GNU date has it. Unknown directives are copied as is.
+func strftime(t time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'N':
+			fmt.Fprintf(&b, "%09d", t.Nanosecond())
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'b', 'h':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'R':
+			b.WriteString(t.Format("15:04"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
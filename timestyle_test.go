@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	tm := time.Date(2024, 3, 5, 14, 7, 9, 12345, time.FixedZone("CET", 60*60))
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%Y-%m-%d %H:%M:%S", "2024-03-05 14:07:09"},
+		{"%y/%e %j", "24/ 5 065"},
+		{"%I:%M %p", "02:07 PM"},
+		{"%a %A %b %h %B", "Tue Tuesday Mar Mar March"},
+		{"%F %T %R", "2024-03-05 14:07:09 14:07"},
+		{"%z %Z", "+0100 CET"},
+		{"%s", "1709644029"},
+		{"%N", "000012345"},
+		{"100%% %q", "100% %q"},
+		{"trailing %", "trailing %"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := strftime(tm, tt.format); got != tt.want {
+			t.Errorf("strftime(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestTimeStyle(t *testing.T) {
+	old := time.Date(2019, 3, 7, 8, 9, 10, 11, time.UTC)
+	recent := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		style string
+		t     time.Time
+		want  string
+	}{
+		{"locale", old, "Mar  7  2019"},
+		{"locale", recent, recent.Format("Jan _2 15:04")},
+		{"iso", old, "2019-03-07 "},
+		{"iso", recent, recent.Format("01-02 15:04")},
+		{"long-iso", old, "2019-03-07 08:09"},
+		{"long-iso", recent, recent.Format("2006-01-02 15:04")},
+		{"full-iso", old, "2019-03-07 08:09:10.000000011 +0000"},
+		{"+%Y%m%d", old, "20190307"},
+		{"+%d.%m.%Y %H:%M", recent, recent.Format("02.01.2006 15:04")},
+		{"+2006/01/02", old, "2019/03/07"},
+		{"+week %V", old, "week %V"},
+	}
+	for _, tt := range tests {
+		parsedOptions(t, "--time-style="+tt.style)
+		if got := formatTime(tt.t); got != tt.want {
+			t.Errorf("--time-style=%s: formatTime(%v) = %q, want %q", tt.style, tt.t, got, tt.want)
+		}
+	}
+
+	status, stderr := lsStatus(t, "-l", "--time-style=short", os.DevNull)
+	if want := "ls: invalid argument 'short' for '--time-style'\n"; status != 2 || stderr != want {
+		t.Errorf("ls --time-style=short exited %d with %q, want 2 with %q", status, stderr, want)
+	}
+}
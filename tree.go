@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// processTree renders everything beneath the directory operand dir as an
+// indented tree for --tree, with the operand itself as the root
+func processTree(w io.Writer, dir FileInfo) {
+	fmt.Fprintln(w, colorName(dir, quoteName(dir.Name)))
+
+	visited := map[fileID]bool{{dir.Dev, dir.Inode}: true}
+	entries, ok := readTreeLevel(dir.Name)
+	if ok {
+		writeTreeEntries(w, dir.Name, entries, "", 1, visited)
+	}
+}
+
+// readTreeLevel returns the entries of dirPath that the tree shows, in
+// sort order. Directories stay visible even when the filters leave them
+// out, so the files beneath them keep their place in the hierarchy.
+func readTreeLevel(dirPath string) ([]FileInfo, bool) {
+	entries, err := readDirFast(dirPath)
+	if err != nil {
+		reportError(dirPath, err)
+		return nil, false
+	}
+	progress.addDirectory(len(entries))
+
+	var visible []FileInfo
+	for _, entry := range entries {
+		if shouldSkipEntry(entry) || !(entry.IsDir || matchesFilters(entry)) {
+			continue
+		}
+		visible = append(visible, entry)
+	}
+	sortFiles(visible)
+	histogram.add(visible)
+	return visible, true
+}
+
+// writeTreeEntries draws entries, the contents of dirPath at depth levels
+// below the operand, each behind prefix and a connector, descending into
+// subdirectories as far as --tree-depth allows
+func writeTreeEntries(w io.Writer, dirPath string, entries []FileInfo, prefix string, depth int, visited map[fileID]bool) {
+	for i, entry := range entries {
+		connector, indent := deco.treeBranch, deco.treeIndent
+		if i == len(entries)-1 {
+			connector, indent = deco.treeLast, deco.treeBlank
+		}
+
+		name := colorName(entry, quoteName(entry.Name))
+		path := filepath.Join(dirPath, entry.Name)
+
+		var children []FileInfo
+		level := depth
+		descend := treeWithinDepth(level) && treeDescends(entry, visited)
+		if descend {
+			children, descend = readTreeLevel(path)
+		}
+
+		// --collapse folds a chain of directories that each hold nothing
+		// but one subdirectory into a single a/b/c line
+		for descend && opts.Collapse && len(children) == 1 && treeWithinDepth(level+1) && treeDescends(children[0], visited) {
+			child := children[0]
+			name += "/" + colorName(child, quoteName(child.Name))
+			path = filepath.Join(path, child.Name)
+			entry = child
+			level++
+			children, descend = readTreeLevel(path)
+		}
+
+		if opts.Classify {
+			name += getClassifyChar(entry)
+		} else if opts.Slash && entry.IsDir {
+			name += "/"
+		}
+		if entry.IsSymlink && entry.LinkTarget != "" && !opts.NoSymlinkArrow {
+			name += " " + deco.arrow + " " + quoteName(entry.LinkTarget)
+		}
+		fmt.Fprintln(w, prefix+connector+name+aliasNote(entry))
+
+		if descend {
+			writeTreeEntries(w, path, children, prefix+indent, level+1, visited)
+		}
+	}
+}
+
+// treeWithinDepth reports whether --tree-depth lets the tree show the
+// contents of a directory depth levels below the operand
+func treeWithinDepth(depth int) bool {
+	return opts.TreeDepth == 0 || depth < opts.TreeDepth
+}
+
+// treeDescends reports whether the tree should open entry, marking it as
+// visited when so. Directories seen before, which -L can lead back to,
+// are reported on stderr and drawn as leaves.
+func treeDescends(entry FileInfo, visited map[fileID]bool) bool {
+	if !entry.IsDir || isExcludedDir(entry.Name) {
+		return false
+	}
+	id := fileID{entry.Dev, entry.Inode}
+	if visited[id] {
+		fmt.Fprintf(os.Stderr, "ls: %s: not listing already-listed directory\n", entry.Name)
+		return false
+	}
+	visited[id] = true
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/p"),
+		fakeReg("/p/b", ""),
+		fakeReg("/p/.hidden", ""),
+		fakeDir("/p/a"),
+		fakeDir("/p/a/x"),
+		fakeReg("/p/a/x/deep", ""),
+		fakeReg("/p/a/c.txt", "hello"),
+	)
+	full := []string{
+		"/p",
+		"├── a",
+		"│   ├── c.txt",
+		"│   └── x",
+		"│       └── deep",
+		"└── b",
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--tree"}, full},
+		{[]string{"--tree", "-a"}, []string{
+			"/p",
+			"├── .hidden",
+			"├── a",
+			"│   ├── c.txt",
+			"│   └── x",
+			"│       └── deep",
+			"└── b",
+		}},
+		{[]string{"--tree", "-r"}, []string{
+			"/p",
+			"├── b",
+			"└── a",
+			"    ├── x",
+			"    │   └── deep",
+			"    └── c.txt",
+		}},
+		{[]string{"--tree", "--tree-depth=1"}, []string{"/p", "├── a", "└── b"}},
+		{[]string{"--tree", "--tree-depth=2"}, []string{
+			"/p",
+			"├── a",
+			"│   ├── c.txt",
+			"│   └── x",
+			"└── b",
+		}},
+		{[]string{"--tree", "--tree-depth=3"}, full},
+		{[]string{"--tree", "--ascii"}, []string{
+			"/p",
+			"|-- a",
+			"|   |-- c.txt",
+			"|   `-- x",
+			"|       `-- deep",
+			"`-- b",
+		}},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/p")
+		want := strings.Join(tt.want, "\n") + "\n"
+		if got := runLs(t, fake, args...); got != want {
+			t.Errorf("ls %v =\n%s\nwant\n%s", args, got, want)
+		}
+	}
+
+	for _, value := range []string{"0", "-1", "deep"} {
+		status, stderr := lsStatus(t, "--tree", "--tree-depth="+value, os.DevNull)
+		want := "ls: invalid argument '" + value + "' for '--tree-depth'\n"
+		if status != 2 || stderr != want {
+			t.Errorf("ls --tree-depth=%s exited %d with %q, want 2 with %q", value, status, stderr, want)
+		}
+	}
+}
+
+func TestTreeCollapse(t *testing.T) {
+	fake := newFakeFS(
+		fakeDir("/p"),
+		fakeDir("/p/a"),
+		fakeDir("/p/a/b"),
+		fakeDir("/p/a/b/c"),
+		fakeReg("/p/a/b/c/leaf", ""),
+		fakeReg("/p/a/b/c/leaf2", ""),
+		fakeDir("/p/e"),
+		fakeDir("/p/e/f"),
+		fakeDir("/p/g"),
+		fakeReg("/p/g/only", ""),
+		fakeDir("/p/m"),
+		fakeReg("/p/m/file", ""),
+		fakeDir("/p/m/n"),
+		fakeReg("/p/z", ""),
+	)
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--tree"}, []string{
+			"/p",
+			"├── a",
+			"│   └── b",
+			"│       └── c",
+			"│           ├── leaf",
+			"│           └── leaf2",
+			"├── e",
+			"│   └── f",
+			"├── g",
+			"│   └── only",
+			"├── m",
+			"│   ├── file",
+			"│   └── n",
+			"└── z",
+		}},
+		// Only chains of lone subdirectories fold; a lone file or a
+		// directory beside a file stays on its own line
+		{[]string{"--tree", "--collapse"}, []string{
+			"/p",
+			"├── a/b/c",
+			"│   ├── leaf",
+			"│   └── leaf2",
+			"├── e/f",
+			"├── g",
+			"│   └── only",
+			"├── m",
+			"│   ├── file",
+			"│   └── n",
+			"└── z",
+		}},
+		{[]string{"--tree", "--collapse", "-F"}, []string{
+			"/p",
+			"├── a/b/c/",
+			"│   ├── leaf",
+			"│   └── leaf2",
+			"├── e/f/",
+			"├── g/",
+			"│   └── only",
+			"├── m/",
+			"│   ├── file",
+			"│   └── n/",
+			"└── z",
+		}},
+		// A chain stops folding where --tree-depth stops descending
+		{[]string{"--tree", "--collapse", "--tree-depth=3"}, []string{
+			"/p",
+			"├── a/b",
+			"│   └── c",
+			"├── e/f",
+			"├── g",
+			"│   └── only",
+			"├── m",
+			"│   ├── file",
+			"│   └── n",
+			"└── z",
+		}},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/p")
+		want := strings.Join(tt.want, "\n") + "\n"
+		if got := runLs(t, fake, args...); got != want {
+			t.Errorf("ls %v =\n%s\nwant\n%s", args, got, want)
+		}
+	}
+}
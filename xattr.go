@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// xattrPreviewBytes caps how much of each value --xattr-values prints
+const xattrPreviewBytes = 64
+
+// displayXattrSizes prints the name and size in bytes of each extended
+// attribute of path, indented beneath the entry's long-format line, for -@
+func displayXattrSizes(w io.Writer, path string) {
+	names, err := fsys.Listxattr(path)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		value, err := fsys.Getxattr(path, name)
+		if err != nil {
+			writeLine(w, "\t"+name+" ?")
+			continue
+		}
+		writeLine(w, fmt.Sprintf("\t%s %d", name, len(value)))
+	}
+}
+
+// setAttributes records whether the file at path has extended attributes
+// or an access control list, for the '@' and '+' of the long format.
+// Detection is best-effort: files whose attributes cannot be listed get
+// neither mark.
+func setAttributes(info *FileInfo, path string) {
+	if !(opts.LongFormat || opts.GroupFormat || opts.NumericFormat) {
+		return
+	}
+	names, err := fsys.Listxattr(path)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		switch {
+		case strings.HasPrefix(name, "system.posix_acl_"):
+			info.HasACL = true
+		case name == "security.selinux":
+			// Present on every file where SELinux is enabled
+		default:
+			info.HasXattr = true
+		}
+	}
+}
+
+// attributeMark returns the character the long format shows after the
+// mode: '@' for extended attributes, else '+' for an ACL, as BSD ls does
+func attributeMark(file FileInfo) string {
+	switch {
+	case file.HasXattr:
+		return "@"
+	case file.HasACL:
+		return "+"
+	}
+	return ""
+}
+
+// displayXattrValues prints each extended attribute of path with a preview
+// of its value, indented beneath the entry's long-format line
+func displayXattrValues(w io.Writer, path string) {
+	names, err := fsys.Listxattr(path)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		value, err := fsys.Getxattr(path, name)
+		if err != nil {
+			writeLine(w, "\t"+name+": ?")
+			continue
+		}
+		writeLine(w, "\t"+name+": "+xattrPreview(value))
+	}
+}
+
+// xattrPreview renders the first xattrPreviewBytes of value, printable
+// text as-is and anything else as \xHH escapes, ending in an ellipsis when
+// the value was cut short
+func xattrPreview(value []byte) string {
+	// Many text attributes are stored NUL-terminated
+	value = bytes.TrimSuffix(value, []byte{0})
+
+	truncated := len(value) > xattrPreviewBytes
+	if truncated {
+		value = value[:xattrPreviewBytes]
+	}
+
+	preview := escapeBytes(value)
+	if truncated {
+		preview += deco.ellipsis
+	}
+	return preview
+}
+
+// escapeBytes renders value with printable text as-is and anything else,
+// including backslashes, as \xHH escapes
+func escapeBytes(value []byte) string {
+	var b strings.Builder
+	for len(value) > 0 {
+		r, size := utf8.DecodeRune(value)
+		if r == utf8.RuneError || r < 0x20 || r == 0x7f || r == '\\' {
+			fmt.Fprintf(&b, "\\x%02x", value[0])
+			value = value[1:]
+			continue
+		}
+		b.Write(value[:size])
+		value = value[size:]
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEscapeBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{"café", "café"},
+		{"a\tb\n", "a\\x09b\\x0a"},
+		{"\x00\x7f", "\\x00\\x7f"},
+		{`back\slash`, `back\x5cslash`},
+		{"\xff\xfeok", "\\xff\\xfeok"},
+		{"\xe2\x82", "\\xe2\\x82"},
+	}
+	for _, tt := range tests {
+		if got := escapeBytes([]byte(tt.value)); got != tt.want {
+			t.Errorf("escapeBytes(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestXattrPreview(t *testing.T) {
+	long := strings.Repeat("x", xattrPreviewBytes)
+	tests := []struct {
+		deco  decorations
+		value string
+		want  string
+	}{
+		{unicodeDecorations, "com.apple.quarantine\x00", "com.apple.quarantine"},
+		{unicodeDecorations, "mid\x00dle", "mid\\x00dle"},
+		{unicodeDecorations, long, long},
+		{unicodeDecorations, long + "\x00", long},
+		{unicodeDecorations, long + "yz", long + "…"},
+		{asciiDecorations, long + "yz", long + "..."},
+		{unicodeDecorations, strings.Repeat("\x01", xattrPreviewBytes+1), strings.Repeat("\\x01", xattrPreviewBytes) + "…"},
+	}
+	saved := deco
+	defer func() { deco = saved }()
+	for _, tt := range tests {
+		deco = tt.deco
+		if got := xattrPreview([]byte(tt.value)); got != tt.want {
+			t.Errorf("xattrPreview(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAttributeMark(t *testing.T) {
+	tests := []struct {
+		xattrs map[string]string
+		want   string
+	}{
+		{nil, ""},
+		{map[string]string{"user.note": "hi"}, "@"},
+		{map[string]string{"system.posix_acl_access": "\x02"}, "+"},
+		{map[string]string{"system.posix_acl_default": "\x02"}, "+"},
+		// Extended attributes win over an ACL, as BSD ls has it
+		{map[string]string{"system.posix_acl_access": "\x02", "user.note": "hi"}, "@"},
+		// SELinux labels every file, so its label alone marks nothing
+		{map[string]string{"security.selinux": "system_u:object_r:tmp_t:s0"}, ""},
+	}
+	for _, tt := range tests {
+		useFS(t, newFakeFS(&fakeFile{path: "/f", mode: syscall.S_IFREG | 0644, xattrs: tt.xattrs}))
+		for _, long := range []bool{false, true} {
+			setOptions(t, Options{LongFormat: long})
+			var info FileInfo
+			setAttributes(&info, "/f")
+			want := tt.want
+			if !long {
+				// Only the long format shows the mark, so only it looks
+				want = ""
+			}
+			if got := attributeMark(info); got != want {
+				t.Errorf("long format %v, xattrs %v: mark %q, want %q", long, tt.xattrs, got, want)
+			}
+		}
+	}
+}
+
+func TestAttributeMarkListing(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/acl", mode: syscall.S_IFREG | 0644, mtime: mtime, xattrs: map[string]string{"system.posix_acl_access": "\x02"}},
+		&fakeFile{path: "/d/plain", mode: syscall.S_IFREG | 0644, mtime: mtime},
+		&fakeFile{path: "/d/tagged", mode: syscall.S_IFREG | 0644, mtime: mtime, xattrs: map[string]string{"user.note": "hi"}},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-lgn"}, "total 0\n" +
+			"-rw-r--r--+ 1 0 0 May  1  2024 acl\n" +
+			"-rw-r--r--  1 0 0 May  1  2024 plain\n" +
+			"-rw-r--r--@ 1 0 0 May  1  2024 tagged\n"},
+		{[]string{"-lgn", "/d/plain"}, "total 0\n-rw-r--r-- 1 0 0 May  1  2024 /d/plain\n"},
+		{[]string{"-1"}, "acl\nplain\ntagged\n"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if len(args) == 1 {
+			args = append(args, "/d")
+		}
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
+
+func TestXattrSizesListing(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeFS(
+		fakeDir("/d"),
+		&fakeFile{path: "/d/plain", mode: syscall.S_IFREG | 0644, mtime: mtime},
+		&fakeFile{path: "/d/tagged", mode: syscall.S_IFREG | 0644, mtime: mtime, xattrs: map[string]string{
+			"user.origin": "https://example.com/",
+			"user.empty":  "",
+		}},
+	)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-lgn@"}, "total 0\n" +
+			"-rw-r--r--  1 0 0 May  1  2024 plain\n" +
+			"-rw-r--r--@ 1 0 0 May  1  2024 tagged\n" +
+			"\tuser.empty 0\n" +
+			"\tuser.origin 20\n"},
+		// The names only accompany the long format
+		{[]string{"-1@"}, "plain\ntagged\n"},
+	}
+	for _, tt := range tests {
+		args := append(tt.args, "/d")
+		if got := runLs(t, fake, args...); got != tt.want {
+			t.Errorf("ls %v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
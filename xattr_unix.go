@@ -0,0 +1,52 @@
+//go:build !openbsd
+
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the extended attribute names of path, without
+// following a final symlink
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name on path,
+// without following a final symlink
+func getXattr(path, name string) ([]byte, error) {
+	size, err := xattrSize(path, name)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// xattrSize returns the size in bytes of the extended attribute name on
+// path, without following a final symlink
+func xattrSize(path, name string) (int, error) {
+	return unix.Lgetxattr(path, name, nil)
+}
@@ -0,0 +1,105 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDisplayXattrValuesOnDisk(t *testing.T) {
+	tests := []struct {
+		xattrs map[string]string
+		want   string
+	}{
+		{nil, ""},
+		{map[string]string{"user.origin": "https://example.com/f\x00"}, "\tuser.origin: https://example.com/f\n"},
+		{
+			map[string]string{"user.origin": "x", "user.blob": "\x01\x02"},
+			"\tuser.blob: \\x01\\x02\n\tuser.origin: x\n",
+		},
+	}
+	for _, tt := range tests {
+		setOptions(t, Options{})
+		path := filepath.Join(t.TempDir(), "f")
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range tt.xattrs {
+			if err := unix.Setxattr(path, name, []byte(value), 0); err != nil {
+				if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+					t.Skipf("no user xattrs on %s: %v", filepath.Dir(path), err)
+				}
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		displayXattrValues(&buf, path)
+		if got := sortLines(buf.String()); got != tt.want {
+			t.Errorf("displayXattrValues with %v wrote %q, want %q", tt.xattrs, got, tt.want)
+		}
+	}
+}
+
+func TestAttributeMarkOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tagged")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The mode is set whatever the umask was
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(path, "user.note", []byte("hi"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			t.Skipf("no user xattrs on %s: %v", filepath.Dir(path), err)
+		}
+		t.Fatal(err)
+	}
+
+	got := runLs(t, osFileSystem{}, "-l", path)
+	if want := "total 0\n-rw-r--r--@ "; !strings.HasPrefix(got, want) {
+		t.Errorf("ls -l %s = %q, want it to start %q", path, got, want)
+	}
+}
+
+func TestDisplayXattrSizesOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	setOptions(t, Options{})
+
+	for name, value := range map[string]string{"user.one": "abc", "user.two": strings.Repeat("z", 300)} {
+		if err := unix.Setxattr(path, name, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				t.Skipf("no user xattrs on %s: %v", filepath.Dir(path), err)
+			}
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	displayXattrSizes(&buf, path)
+	if got, want := sortLines(buf.String()), "\tuser.one 3\n\tuser.two 300\n"; got != want {
+		t.Errorf("displayXattrSizes wrote %q, want %q", got, want)
+	}
+}
+
+// sortLines sorts the lines of s, as the order the system lists attributes
+// in is up to the filesystem
+func sortLines(s string) string {
+	if s == "" {
+		return s
+	}
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	slices.Sort(lines)
+	return strings.Join(lines, "\n") + "\n"
+}